@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/gojson"
+)
+
+// Alert states.  A rule whose condition holds is pending until it
+// has held for the rule's for duration, and then firing.  A firing
+// rule whose condition stops holding is resolved, and then ok.
+const (
+	alertOK       = "ok"
+	alertPending  = "pending"
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertHistoryDB is the system database recording alert state
+// transitions.  It's hidden from database listings.
+const alertHistoryDB = "_alerts"
+
+// alertRule is a threshold on the value of a reducer over the most
+// recent window of a database.
+type alertRule struct {
+	Name    string `json:"name"`
+	DB      string `json:"db"`
+	Ptr     string `json:"ptr"`
+	Reducer string `json:"reducer"`
+	// Where optionally filters the documents considered.
+	Where     string  `json:"where,omitempty"`
+	Window    string  `json:"window"`
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+	For       string  `json:"for,omitempty"`
+	// Webhook overrides the server's alert webhook for this rule.
+	Webhook string `json:"webhook,omitempty"`
+
+	window, forDuration time.Duration
+	filter              filterExpr
+}
+
+var alertOps = map[string]bool{
+	"=": true, "==": true, "!=": true, "<": true, "<=": true, ">": true,
+	">=": true,
+}
+
+// alertStatus is the evaluated state of a rule.
+type alertStatus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	// Value is the reducer's value at the last evaluation, or nil
+	// if there was no data.
+	Value     interface{} `json:"value"`
+	Evaluated time.Time   `json:"evaluated,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type alert struct {
+	Rule   *alertRule  `json:"rule"`
+	Status alertStatus `json:"status"`
+}
+
+// alerts holds the defined rules and their states, guarded by
+// alertLock.
+var alerts = map[string]*alert{}
+var alertLock sync.Mutex
+
+// validate checks a rule and parses its durations and filter.
+func (r *alertRule) validate() error {
+	if !validReducerName.MatchString(r.Name) {
+		return paramError{"Bad alert name", r.Name}
+	}
+	if !validDBName.MatchString(r.DB) {
+		return paramError{"Bad db value", r.DB}
+	}
+	if r.Ptr == "" {
+		return paramError{"Pointer required", "an alert needs a ptr"}
+	}
+	if _, err := parsePointerExprs([]string{r.Ptr}); err != nil {
+		return err
+	}
+	if err := validateReducers([]string{r.Reducer}); err != nil {
+		return err
+	}
+	if !alertOps[r.Op] {
+		return paramError{"Bad op value", r.Op}
+	}
+	var err error
+	r.window, err = time.ParseDuration(r.Window)
+	if err != nil || r.window <= 0 {
+		return paramError{"Bad window value", r.Window}
+	}
+	if r.For != "" {
+		r.forDuration, err = time.ParseDuration(r.For)
+		if err != nil || r.forDuration < 0 {
+			return paramError{"Bad for value", r.For}
+		}
+	}
+	r.filter = nil
+	if r.Where != "" {
+		r.filter, err = parseFilterExpr(r.Where)
+		if err != nil {
+			return paramError{"Bad filter expression", err.Error()}
+		}
+	}
+	return nil
+}
+
+// nextAlertState finds a rule's state after an evaluation finding
+// whether its condition holds.
+func nextAlertState(s alertStatus, holds bool, now time.Time,
+	forDuration time.Duration) alertStatus {
+
+	next := s.State
+	switch {
+	case holds && (s.State == alertPending || s.State == alertFiring):
+		if s.State == alertPending && now.Sub(s.Since) >= forDuration {
+			next = alertFiring
+		}
+	case holds && forDuration == 0:
+		next = alertFiring
+	case holds:
+		next = alertPending
+	case s.State == alertFiring:
+		next = alertResolved
+	default:
+		next = alertOK
+	}
+	if next != s.State {
+		s.State, s.Since = next, now
+	}
+	return s
+}
+
+// singleGrouper puts every document in a single group.
+type singleGrouper struct{}
+
+func (singleGrouper) bucket(t int64) (int64, int64) {
+	return 0, math.MaxInt64
+}
+
+// evaluate computes a rule's reducer over its window ending at now.
+// The value is nil if there's no data.  If the query or any of its
+// chunks fail, the first error is returned.
+func (r *alertRule) evaluate(now time.Time) (interface{}, error) {
+	q := &queryIn{
+		dbname:  r.DB,
+		from:    now.Add(-r.window).UTC().Format(time.RFC3339Nano),
+		to:      now.UTC().Format(time.RFC3339Nano),
+		grouper: singleGrouper{},
+		ptrs:    []string{r.Ptr},
+		reds:    []string{r.Reducer},
+		filter:  r.filter,
+	}
+	var value interface{}
+	var chunkErr error
+	err := awaitQuery(executeQuery(context.Background(), q),
+		func(po *processOut) {
+			switch {
+			case po.err != nil:
+				if chunkErr == nil {
+					chunkErr = po.err
+				}
+			case len(po.value) > 0:
+				value = po.value[0]
+			}
+		})
+	if err == nil {
+		err = chunkErr
+	}
+	return value, err
+}
+
+// holds reports whether a rule's condition holds for a value.
+func (r *alertRule) holds(value interface{}) bool {
+	v, ok := toFloat(value)
+	if !ok {
+		return false
+	}
+	f, _ := compareExpr{r.Op, numberExpr(v), numberExpr(r.Threshold)}.eval(nil)
+	return f == 1
+}
+
+// alertEvent describes a state transition, as recorded in the
+// history database and sent to webhooks.
+type alertEvent struct {
+	Rule      string      `json:"rule"`
+	DB        string      `json:"db"`
+	State     string      `json:"state"`
+	Previous  string      `json:"previous"`
+	Value     interface{} `json:"value"`
+	Op        string      `json:"op"`
+	Threshold float64     `json:"threshold"`
+	Time      time.Time   `json:"time"`
+}
+
+var lastHistoryKey struct {
+	sync.Mutex
+	t time.Time
+}
+
+// recordAlertEvent stores a transition in the history database.
+// Each is keyed by a distinct time.
+func recordAlertEvent(e alertEvent) {
+	lastHistoryKey.Lock()
+	t := e.Time
+	if !t.After(lastHistoryKey.t) {
+		t = lastHistoryKey.t.Add(time.Nanosecond)
+	}
+	lastHistoryKey.t = t
+	lastHistoryKey.Unlock()
+
+	body, err := json.Marshal(e)
+	if err == nil {
+		err = dbcreate(dbPath(alertHistoryDB))
+	}
+	if err == nil {
+		err = dbstore(alertHistoryDB, t.UTC().Format(time.RFC3339Nano), body)
+	}
+	if err != nil {
+		log.Printf("Error recording alert %v: %v", e.Rule, err)
+	}
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func postAlertWebhook(url string, e alertEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding alert %v: %v", e.Rule, err)
+		return
+	}
+	res, err := webhookClient.Post(url, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error notifying %v of alert %v: %v", url, e.Rule, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Printf("Error notifying %v of alert %v: %v", url, e.Rule,
+			res.Status)
+	}
+}
+
+// evaluateAlerts evaluates every rule, recording transitions and
+// notifying webhooks when rules fire or resolve.
+func evaluateAlerts(now time.Time) {
+	alertLock.Lock()
+	rules := make([]*alertRule, 0, len(alerts))
+	for _, a := range alerts {
+		rules = append(rules, a.Rule)
+	}
+	alertLock.Unlock()
+
+	for _, r := range rules {
+		value, err := r.evaluate(now)
+
+		alertLock.Lock()
+		a, ok := alerts[r.Name]
+		if !ok || a.Rule != r {
+			// Redefined or deleted while evaluating.
+			alertLock.Unlock()
+			continue
+		}
+		prev := a.Status
+		a.Status.Evaluated = now
+		a.Status.Error = ""
+		if err != nil {
+			// The rule's state is left as it was until it can
+			// be evaluated.
+			a.Status.Error = err.Error()
+		} else {
+			a.Status.Value = value
+			a.Status = nextAlertState(a.Status, r.holds(value), now,
+				r.forDuration)
+		}
+		status := a.Status
+		alertLock.Unlock()
+
+		if status.State == prev.State {
+			continue
+		}
+		e := alertEvent{r.Name, r.DB, status.State, prev.State,
+			status.Value, r.Op, r.Threshold, now}
+		recordAlertEvent(e)
+		url := r.Webhook
+		if url == "" {
+			url = *alertWebhook
+		}
+		if url != "" && (e.State == alertFiring || e.State == alertResolved) {
+			go postAlertWebhook(url, e)
+		}
+	}
+}
+
+func alertScheduler() {
+	for t := range time.Tick(*alertInterval) {
+		evaluateAlerts(t)
+	}
+}
+
+func alertRulesPath() string {
+	return filepath.Join(*dbRoot, "_alerts.json")
+}
+
+// loadAlertRules defines the rules saved by a previous run.
+func loadAlertRules() error {
+	data, err := ioutil.ReadFile(alertRulesPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := map[string]*alertRule{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for name, r := range saved {
+		r.Name = name
+		if err := defineAlert(r, false); err != nil {
+			return fmt.Errorf("alert %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// saveAlertRules writes the rules so they survive a restart.
+// alertLock must be held.
+func saveAlertRules() error {
+	rules := make(map[string]*alertRule, len(alerts))
+	for name, a := range alerts {
+		rules[name] = a.Rule
+	}
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := alertRulesPath()
+	if err := ioutil.WriteFile(path+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// defineAlert adds or replaces a rule.  A replaced rule starts over
+// in the ok state.
+func defineAlert(r *alertRule, save bool) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	alertLock.Lock()
+	defer alertLock.Unlock()
+	alerts[r.Name] = &alert{r, alertStatus{State: alertOK,
+		Since: time.Now()}}
+	if save {
+		return saveAlertRules()
+	}
+	return nil
+}
+
+type alertsByName []*alert
+
+func (a alertsByName) Len() int           { return len(a) }
+func (a alertsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a alertsByName) Less(i, j int) bool { return a[i].Rule.Name < a[j].Rule.Name }
+
+func listAlerts(args []string, w http.ResponseWriter, req *http.Request) {
+	alertLock.Lock()
+	rv := make(alertsByName, 0, len(alerts))
+	for _, a := range alerts {
+		c := *a
+		rv = append(rv, &c)
+	}
+	alertLock.Unlock()
+	sort.Sort(rv)
+	mustEncode(200, w, rv)
+}
+
+func getAlert(args []string, w http.ResponseWriter, req *http.Request) {
+	alertLock.Lock()
+	a, ok := alerts[args[0]]
+	var c alert
+	if ok {
+		c = *a
+	}
+	alertLock.Unlock()
+	if !ok {
+		emitError(404, w, "No such alert", args[0])
+		return
+	}
+	mustEncode(200, w, c)
+}
+
+func putAlert(args []string, w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	r := &alertRule{}
+	if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+		emitError(400, w, "Error parsing JSON data", err.Error())
+		return
+	}
+	r.Name = args[0]
+	if err := defineAlert(r, true); err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	mustEncode(201, w, map[string]interface{}{"ok": true})
+}
+
+func deleteAlert(args []string, w http.ResponseWriter, req *http.Request) {
+	alertLock.Lock()
+	defer alertLock.Unlock()
+	if _, ok := alerts[args[0]]; !ok {
+		emitError(404, w, "No such alert", args[0])
+		return
+	}
+	delete(alerts, args[0])
+	if err := saveAlertRules(); err != nil {
+		emitError(500, w, "Error saving alerts", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
+
+// alertHistory lists a rule's state transitions, optionally limited
+// by from and to.
+func alertHistory(args []string, w http.ResponseWriter, req *http.Request) {
+	from, err := cleanupRangeParam(req.FormValue("from"), "")
+	if err != nil {
+		emitError(400, w, "Bad from value", err.Error())
+		return
+	}
+	to, err := cleanupRangeParam(req.FormValue("to"), "")
+	if err != nil {
+		emitError(400, w, "Bad to value", err.Error())
+		return
+	}
+
+	rv := []alertEvent{}
+	if _, err := os.Stat(dbPath(alertHistoryDB)); err == nil {
+		err = dbwalk(alertHistoryDB, from, to, func(k string, v []byte) error {
+			e := alertEvent{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if e.Rule == args[0] {
+				rv = append(rv, e)
+			}
+			return nil
+		})
+		if err != nil {
+			emitError(500, w, "Error reading alert history", err.Error())
+			return
+		}
+	}
+	mustEncode(200, w, rv)
+}
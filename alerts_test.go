@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mschoch/gouchstore"
+)
+
+func TestNextAlertState(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	minute := time.Minute
+
+	tests := []struct {
+		state string
+		holds bool
+		after time.Duration
+		exp   string
+	}{
+		{alertOK, false, minute, alertOK},
+		{alertOK, true, minute, alertPending},
+		{alertPending, true, 30 * time.Second, alertPending},
+		{alertPending, true, 5 * minute, alertFiring},
+		{alertPending, false, minute, alertOK},
+		{alertFiring, true, minute, alertFiring},
+		{alertFiring, false, minute, alertResolved},
+		{alertResolved, false, minute, alertOK},
+		{alertResolved, true, minute, alertPending},
+	}
+	for _, test := range tests {
+		s := alertStatus{State: test.state, Since: t0}
+		got := nextAlertState(s, test.holds, t0.Add(test.after), 2*minute)
+		if got.State != test.exp {
+			t.Errorf("Expected %v -> %v (holds=%v after %v), got %v",
+				test.state, test.exp, test.holds, test.after, got.State)
+		}
+		exp := t0
+		if got.State != test.state {
+			exp = t0.Add(test.after)
+		}
+		if !got.Since.Equal(exp) {
+			t.Errorf("Expected %v -> %v since %v, got %v",
+				test.state, got.State, exp, got.Since)
+		}
+	}
+
+	s := nextAlertState(alertStatus{State: alertOK, Since: t0}, true, t0, 0)
+	if s.State != alertFiring {
+		t.Errorf("Expected to fire immediately without a for duration, got %v",
+			s.State)
+	}
+}
+
+func TestAlertRuleValidate(t *testing.T) {
+	good := alertRule{Name: "hot", DB: "temps", Ptr: "/temp",
+		Reducer: "avg", Window: "5m", Op: ">", Threshold: 90, For: "10m",
+		Where: `/room = "a"`}
+	if err := good.validate(); err != nil {
+		t.Fatalf("Error validating %+v: %v", good, err)
+	}
+	if good.window != 5*time.Minute || good.forDuration != 10*time.Minute ||
+		good.filter == nil {
+		t.Errorf("Expected parsed window, for and filter, got %+v", good)
+	}
+
+	for _, f := range []func(r *alertRule){
+		func(r *alertRule) { r.Name = "bad name" },
+		func(r *alertRule) { r.DB = "" },
+		func(r *alertRule) { r.Ptr = "" },
+		func(r *alertRule) { r.Reducer = "nosuch" },
+		func(r *alertRule) { r.Op = "~" },
+		func(r *alertRule) { r.Window = "5" },
+		func(r *alertRule) { r.For = "-1m" },
+		func(r *alertRule) { r.Where = "/x =" },
+	} {
+		r := good
+		f(&r)
+		if err := r.validate(); err == nil {
+			t.Errorf("Expected error validating %+v", r)
+		}
+	}
+}
+
+func TestAlertHolds(t *testing.T) {
+	r := alertRule{Op: ">=", Threshold: 5}
+	for v, exp := range map[interface{}]bool{
+		5.0: true, 4.0: false, 6: true, nil: false, "x": false,
+	} {
+		if got := r.holds(v); got != exp {
+			t.Errorf("Expected %v >= 5 to be %v", v, exp)
+		}
+	}
+}
+
+func TestEvaluateAlerts(t *testing.T) {
+	root, err := ioutil.TempDir("", "seriesly")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	defer func(r string, f time.Duration) {
+		*dbRoot, *flushTime = r, f
+	}(*dbRoot, *flushTime)
+	*dbRoot, *flushTime = root, 10*time.Millisecond
+	startTestPipeline()
+	defer func() {
+		dbRemoveConn(alertHistoryDB)
+		dbWg.Wait()
+	}()
+
+	// A value of 20 every minute for five minutes.
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := dbcreate(dbPath("metrics")); err != nil {
+		t.Fatalf("Error creating db: %v", err)
+	}
+	db, err := dbopen("metrics")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	bulk := db.Bulk()
+	for i := 0; i < 5; i++ {
+		k := base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339Nano)
+		bulk.Set(gouchstore.NewDocumentInfo(k),
+			gouchstore.NewDocument(k, []byte(`{"v": 20}`)))
+	}
+	bulk.Commit()
+	bulk.Close()
+	closeDBConn(db)
+
+	hooks := make(chan alertEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			e := alertEvent{}
+			json.NewDecoder(req.Body).Decode(&e)
+			hooks <- e
+		}))
+	defer srv.Close()
+
+	rules := []*alertRule{
+		{Name: "hot", DB: "metrics", Ptr: "/v", Reducer: "avg",
+			Window: "5m", Op: ">", Threshold: 10, For: "1m",
+			Webhook: srv.URL},
+		{Name: "broken", DB: "missing", Ptr: "/v", Reducer: "avg",
+			Window: "5m", Op: ">", Threshold: 10, Webhook: srv.URL},
+	}
+	for _, r := range rules {
+		if err := defineAlert(r, false); err != nil {
+			t.Fatalf("Error defining %v: %v", r.Name, err)
+		}
+		defer func(name string) {
+			alertLock.Lock()
+			delete(alerts, name)
+			alertLock.Unlock()
+		}(r.Name)
+	}
+
+	status := func(name string) alertStatus {
+		alertLock.Lock()
+		defer alertLock.Unlock()
+		return alerts[name].Status
+	}
+	noHook := func() {
+		select {
+		case e := <-hooks:
+			t.Errorf("Unexpected webhook for %+v", e)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// Data older than the window leaves nothing to reduce, resolving
+	// the firing rule.
+	steps := []struct {
+		at    time.Duration
+		state string
+		hook  bool
+	}{
+		{5 * time.Minute, alertPending, false},
+		{6 * time.Minute, alertFiring, true},
+		{20 * time.Minute, alertResolved, true},
+		{21 * time.Minute, alertOK, false},
+	}
+	for _, step := range steps {
+		now := base.Add(step.at)
+		evaluateAlerts(now)
+		if got := status("hot"); got.State != step.state {
+			t.Fatalf("Expected %v at %v, got %+v", step.state, step.at, got)
+		}
+		if !step.hook {
+			noHook()
+			continue
+		}
+		select {
+		case e := <-hooks:
+			if e.Rule != "hot" || e.State != step.state || !e.Time.Equal(now) {
+				t.Errorf("Expected %v webhook at %v, got %+v",
+					step.state, now, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the %v webhook", step.state)
+		}
+	}
+
+	// A rule that can't be evaluated keeps its state.
+	if got := status("broken"); got.State != alertOK || got.Error == "" {
+		t.Errorf("Expected an unchanged state with an error, got %+v", got)
+	}
+
+	exp := []string{alertPending, alertFiring, alertResolved, alertOK}
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		rec := httptest.NewRecorder()
+		alertHistory([]string{"hot"}, rec,
+			httptest.NewRequest("GET", "/_alerts/hot/history", nil))
+		var events []alertEvent
+		if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+			t.Fatalf("Error reading history %s: %v", rec.Body, err)
+		}
+		got = nil
+		for _, e := range events {
+			got = append(got, e.State)
+		}
+		if len(got) >= len(exp) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected history %v, got %v", exp, got)
+	}
+	if dbs := dblist(root); !reflect.DeepEqual(dbs, []string{"metrics"}) {
+		t.Errorf("Expected only metrics listed, got %v", dbs)
+	}
+}
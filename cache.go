@@ -5,6 +5,7 @@ import (
 	"log"
 	"math"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/dustin/gojson"
@@ -26,10 +27,14 @@ func cacheReceiveLoop(client *memcached.Client, out chan *processOut) {
 		po := processOut{cacheOpaque: res.Opaque}
 
 		if res.Opcode == gomemcached.GET && res.Status == gomemcached.SUCCESS {
-			rv := map[string][]interface{}{}
+			rv := struct {
+				V []interface{}            `json:"v"`
+				G map[string][]interface{} `json:"g"`
+			}{}
 			err = json.Unmarshal(res.Body, &rv)
 			if err == nil {
-				po.value = rv["v"]
+				po.value = rv.V
+				po.groups = rv.G
 			} else {
 				log.Printf("Decoding error:  %v\n%s", err, res.Body)
 				po.err = err
@@ -77,7 +82,7 @@ func cacheProcessor(ch <-chan *processIn, chset <-chan *processOut) {
 			case client == nil:
 				// No connection, pass through
 				processorInput <- pi
-			case time.Now().Before(pi.before):
+			case pi.ctx.Err() == nil:
 				newOpaque := opaque
 				opaque++
 				if opaque == math.MaxUint32 {
@@ -104,18 +109,22 @@ func cacheProcessor(ch <-chan *processIn, chset <-chan *processOut) {
 					omap = map[uint32]*processIn{}
 				}
 			default:
-				// Too old.
-				pi.out <- &processOut{"", pi.key, nil, errTimeout, 0}
+				// Too old, or nobody's waiting for it.
+				pi.out <- pi.failed(contextErr(pi.ctx))
 			}
 		case po := <-out:
 			pi, ok := omap[po.cacheOpaque]
 			if ok {
 				delete(omap, po.cacheOpaque)
 				po.key = pi.key
+				po.seq = pi.seq
+				po.part, po.parts = pi.part, pi.parts
 				if po.err == nil {
+					atomic.AddInt32(&pi.stats.cacheHits, 1)
 					po.cacheKey = pi.cacheKey
 					pi.out <- po
 				} else {
+					atomic.AddInt32(&pi.stats.cacheMisses, 1)
 					processorInput <- pi
 				}
 			} else {
@@ -154,6 +163,10 @@ func cacheProcessor(ch <-chan *processIn, chset <-chan *processOut) {
 	}
 }
 
+// cacheKey identifies the results of a chunk by the documents in it
+// and what's computed from them.  Chunks of partial aggregates don't
+// depend on the grouping of the query, so they're keyed only by
+// their documents.
 func cacheKey(p *processIn) string {
 	h := fnv.New64()
 	for _, i := range p.infos {
@@ -162,10 +175,16 @@ func cacheKey(p *processIn) string {
 	for i := range p.ptrs {
 		h.Write([]byte(p.ptrs[i]))
 		h.Write([]byte(p.reds[i]))
+		h.Write([]byte(userReducerExpr(p.reds[i])))
 	}
-	for i := range p.filters {
-		h.Write([]byte(p.filters[i]))
-		h.Write([]byte(p.filtervals[i]))
+	if p.filter != nil {
+		h.Write([]byte(p.filter.String()))
+	}
+	for _, g := range p.groupBy {
+		h.Write([]byte(g))
+	}
+	if p.parts > 0 {
+		return p.dbname + "#partial#" + strconv.FormatUint(h.Sum64(), 10)
 	}
 	return p.dbname + "#" + strconv.FormatInt(p.key, 10) +
 		"#" + strconv.FormatUint(h.Sum64(), 10)
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// A counterStep is the change in a value between two documents.
+type counterStep struct {
+	delta float64
+	secs  float64
+}
+
+// counterDelta is the amount a counter increased going from prev to
+// cur.  A drop is normally a reset, meaning the counter restarted
+// from zero and has counted up to cur since.  When the counter's
+// range (wrap) is known, a drop that is small relative to the range
+// is instead taken to have wrapped around.
+func counterDelta(prev, cur, wrap float64) float64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	if wrap > 0 && prev < wrap {
+		if d := wrap - prev + cur; d < wrap/2 {
+			return d
+		}
+	}
+	return cur
+}
+
+// convertToSteps emits the change between each pair of successive
+// numeric values along with the time between them.  Counters have
+// resets and wraparound accounted for (see counterDelta).
+//
+// The first value of the following chunk (which isn't included) is
+// used as well, so the steps of consecutive chunks cover all the
+// time between them.
+func convertToSteps(in chan ptrval, counter bool, wrap float64) chan counterStep {
+	ch := make(chan counterStep)
+	go func() {
+		defer close(ch)
+		var prevts int64
+		var preval float64
+		found := false
+
+		for v := range in {
+			if v.di == nil || v.val == nil {
+				continue
+			}
+			value, ok := v.val.(string)
+			if !ok {
+				continue
+			}
+			x, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			thists := parseKey(v.di.ID)
+			if found {
+				d := x - preval
+				if counter {
+					d = counterDelta(preval, x, wrap)
+				}
+				ch <- counterStep{d, float64(thists-prevts) / 1e9}
+			}
+			found = true
+			prevts = thists
+			preval = x
+		}
+	}()
+
+	return ch
+}
+
+// convertTofloat64Rate emits the per second rates of a counter.
+func convertTofloat64Rate(in chan ptrval, wrap float64) chan float64 {
+	ch := make(chan float64)
+	go func() {
+		defer close(ch)
+		for s := range convertToSteps(in, true, wrap) {
+			val := s.delta / s.secs
+			if !(math.IsNaN(val) || math.IsInf(val, 0)) {
+				ch <- val
+			}
+		}
+	}()
+
+	return ch
+}
+
+// parseCounterWidth reads the optional bit width of a counter given
+// as reducer arguments (e.g. "c_avg:32"), returning the range of
+// values the counter may hold, or 0 if it's unknown.
+func parseCounterWidth(args string) (float64, error) {
+	switch args {
+	case "":
+		return 0, nil
+	case "32":
+		return math.Exp2(32), nil
+	case "64":
+		return math.Exp2(64), nil
+	}
+	return 0, fmt.Errorf("counter width must be 32 or 64, not %q", args)
+}
+
+// rateSummaries reduce the per second rates of a counter.
+var rateSummaries = map[string]func(rates chan float64) interface{}{
+	"c": func(rates chan float64) interface{} {
+		sum := float64(0)
+		for v := range rates {
+			sum += v
+		}
+		return sum
+	},
+	"c_min": func(rates chan float64) interface{} {
+		rv := math.NaN()
+		for v := range rates {
+			if v < rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
+				rv = v
+			}
+		}
+		return rv
+	},
+	"c_avg": func(rates chan float64) interface{} {
+		nums := float64(0)
+		sum := float64(0)
+		for v := range rates {
+			nums++
+			sum += v
+		}
+		if nums > 0 {
+			return sum / nums
+		}
+		return math.NaN()
+	},
+	"c_max": func(rates chan float64) interface{} {
+		rv := math.NaN()
+		for v := range rates {
+			if v > rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
+				rv = v
+			}
+		}
+		return rv
+	},
+}
+
+func rateReducer(summary func(chan float64) interface{}, wrap float64) reducer {
+	return func(input chan ptrval) interface{} {
+		return summary(convertTofloat64Rate(input, wrap))
+	}
+}
+
+// totalReducer sums the changes in a value rather than their rates.
+func totalReducer(counter bool, wrap float64) reducer {
+	return func(input chan ptrval) interface{} {
+		sum := float64(0)
+		for s := range convertToSteps(input, counter, wrap) {
+			sum += s.delta
+		}
+		return sum
+	}
+}
+
+// rateDescriptions describe the rateSummaries.
+var rateDescriptions = map[string]string{
+	"c":     "The sum of the per second rates of a counter",
+	"c_min": "The lowest per second rate of a counter",
+	"c_avg": "The mean per second rate of a counter",
+	"c_max": "The highest per second rate of a counter",
+}
+
+// counterArgs describes the optional counter width argument.
+const counterArgs = "32 or 64: the width at which the counter wraps"
+
+func counterWidthMaker(mk func(wrap float64) reducer) func(string) (reducer, error) {
+	return func(args string) (reducer, error) {
+		wrap, err := parseCounterWidth(args)
+		if err != nil {
+			return nil, err
+		}
+		return mk(wrap), nil
+	}
+}
+
+func init() {
+	for name, summary := range rateSummaries {
+		summary := summary
+		mk := func(wrap float64) reducer { return rateReducer(summary, wrap) }
+		registerReducer(reducerInfo{
+			Name:        name,
+			Description: rateDescriptions[name],
+			Input:       inputCounter,
+			Mergeable:   name != "c_avg",
+			Args:        counterArgs,
+			reduce:      mk(0),
+			make:        counterWidthMaker(mk),
+		})
+	}
+
+	registerReducer(reducerInfo{
+		Name:        "increase",
+		Description: "The total a counter went up by",
+		Input:       inputCounter,
+		Mergeable:   true,
+		Args:        counterArgs,
+		reduce:      totalReducer(true, 0),
+		make: counterWidthMaker(func(wrap float64) reducer {
+			return totalReducer(true, wrap)
+		}),
+	})
+	registerReducer(reducerInfo{
+		Name:        "delta",
+		Description: "The net change in a value",
+		Input:       inputNumber,
+		Mergeable:   true,
+		reduce:      totalReducer(false, 0),
+	})
+}
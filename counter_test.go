@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCounterDelta(t *testing.T) {
+	wrap32 := math.Exp2(32)
+	tests := []struct {
+		prev, cur, wrap float64
+		exp             float64
+	}{
+		{10, 15, 0, 5},
+		{10, 10, 0, 0},
+		{100, 7, 0, 7},
+		{wrap32 - 10, 5, wrap32, 15},
+		{wrap32 - 10, 5, 0, 5},
+		{1000, 10, wrap32, 10},
+		{wrap32 * 2, 5, wrap32, 5},
+	}
+
+	for _, test := range tests {
+		got := counterDelta(test.prev, test.cur, test.wrap)
+		if got != test.exp {
+			t.Errorf("Expected %v for %v -> %v (wrap %v), got %v",
+				test.exp, test.prev, test.cur, test.wrap, got)
+		}
+	}
+}
+
+func TestCounterWidth(t *testing.T) {
+	for _, args := range []string{"", "32", "64"} {
+		if _, err := parseCounterWidth(args); err != nil {
+			t.Errorf("Error parsing %q: %v", args, err)
+		}
+	}
+	for _, args := range []string{"16", "x", "32,64"} {
+		if got, err := parseCounterWidth(args); err == nil {
+			t.Errorf("Expected error parsing %q, got %v", args, got)
+		}
+	}
+}
+
+func TestWrappingCounterReducers(t *testing.T) {
+	saved := nextValue
+	defer func() { nextValue = saved }()
+	nextValue = "4"
+	input := []interface{}{"4294967290", "4294967295", "2"}
+
+	tests := []struct {
+		reducer string
+		exp     float64
+	}{
+		{"increase", 5 + 2 + 2},
+		{"increase:32", 5 + 3 + 2},
+		{"c_max:32", 5},
+		{"c_min:32", 2},
+		{"c_min", 2},
+		{"delta", 4 - 4294967290.0},
+	}
+
+	for _, test := range tests {
+		red, err := findReducer(test.reducer)
+		if err != nil {
+			t.Fatalf("Error finding %v: %v", test.reducer, err)
+		}
+		got := red(streamCollection(input))
+		if got != test.exp {
+			t.Errorf("Expected %v for %v, got %v",
+				test.exp, test.reducer, got)
+		}
+	}
+
+	if _, err := findReducer("c:16"); err == nil {
+		t.Errorf("Expected error for a 16 bit counter")
+	}
+}
@@ -122,7 +122,9 @@ func dblist(root string) []string {
 	rv := []string{}
 	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
 		if err == nil {
-			if !info.IsDir() && strings.HasSuffix(p, dbExt) {
+			// The alert history is a system database.
+			if !info.IsDir() && strings.HasSuffix(p, dbExt) &&
+				dbBase(p) != alertHistoryDB {
 				rv = append(rv, dbBase(p))
 			}
 		} else {
@@ -188,6 +190,16 @@ func dbWriteLoop(dq *dbWriter) {
 	defer atomic.StoreUint32(&dbst.qlen, 0)
 	defer atomic.AddUint32(&dbst.closes, 1)
 
+	// touched holds the keys written since the last commit, so live
+	// queries can be told what changed.
+	var touched []string
+	committed := func() {
+		if len(touched) > 0 {
+			notifyCommit(dq.dbname, touched)
+			touched = nil
+		}
+	}
+
 	for {
 		atomic.StoreUint32(&dbst.qlen, uint32(queued))
 
@@ -195,6 +207,7 @@ func dbWriteLoop(dq *dbWriter) {
 		case <-dq.quit:
 			sdt := time.Now()
 			bulk.Commit()
+			committed()
 			bulk.Close()
 			closeDBConn(dq.db)
 			dbRemoveConn(dq.dbname)
@@ -214,12 +227,15 @@ func dbWriteLoop(dq *dbWriter) {
 				bulk.Set(gouchstore.NewDocumentInfo(qi.k),
 					gouchstore.NewDocument(qi.k, qi.data))
 				queued++
+				touched = append(touched, qi.k)
 			case opDeleteItem:
 				queued++
 				bulk.Delete(gouchstore.NewDocumentInfo(qi.k))
+				touched = append(touched, qi.k)
 			case opCompact:
 				var err error
 				bulk, err = dbCompact(dq, bulk, queued, qi)
+				committed()
 				qi.cherr <- err
 				atomic.AddUint64(&dbst.written, uint64(queued))
 				queued = 0
@@ -229,6 +245,7 @@ func dbWriteLoop(dq *dbWriter) {
 			if queued >= *maxOpQueue {
 				start := time.Now()
 				bulk.Commit()
+				committed()
 				if *verbose {
 					log.Printf("Flush of %d items took %v",
 						queued, time.Since(start))
@@ -241,6 +258,7 @@ func dbWriteLoop(dq *dbWriter) {
 			if queued > 0 {
 				start := time.Now()
 				bulk.Commit()
+				committed()
 				if *verbose {
 					log.Printf("Flush of %d items from timer took %v",
 						queued, time.Since(start))
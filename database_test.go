@@ -1,6 +1,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -30,6 +34,27 @@ func TestDBWClose(t *testing.T) {
 	}
 }
 
+func TestDBListHidesAlertHistory(t *testing.T) {
+	root, err := ioutil.TempDir("", "seriesly")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	defer func(r string) { *dbRoot = r }(*dbRoot)
+	*dbRoot = root
+
+	for _, n := range []string{"db1", alertHistoryDB} {
+		err := ioutil.WriteFile(filepath.Join(root, n+dbExt), nil, 0666)
+		if err != nil {
+			t.Fatalf("Error writing %v: %v", n, err)
+		}
+	}
+	exp := []string{"db1"}
+	if got := dblist(root); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
 func BenchmarkKeyParsing(b *testing.B) {
 	input := "2012-08-26T20:46:01.911627314Z"
 
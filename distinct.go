@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/dustin/gojson"
+)
+
+// maxExactDistinct is how many distinct values count_distinct
+// remembers before estimating the rest with a sketch.
+const maxExactDistinct = 1 << 16
+
+// The range and default of HyperLogLog precisions.  A sketch of
+// precision p has 2^p registers and a standard error of about
+// 1.04/sqrt(2^p), 0.8% at the default.
+const (
+	minHLLPrecision     = 4
+	maxHLLPrecision     = 16
+	defaultHLLPrecision = 14
+)
+
+func init() {
+	registerReducer(reducerInfo{
+		Name: "count_distinct",
+		Description: "The number of distinct scalar values, estimated " +
+			"beyond " + strconv.Itoa(maxExactDistinct),
+		Input:  inputAny,
+		reduce: countDistinct,
+	})
+	registerReducer(reducerInfo{
+		Name:        "approx_distinct",
+		Description: "The approximate number of distinct scalar values",
+		Input:       inputAny,
+		Mergeable:   true,
+		partial:     hllPartial,
+		Args: "HyperLogLog precision from " +
+			strconv.Itoa(minHLLPrecision) + " to " +
+			strconv.Itoa(maxHLLPrecision) + ", default " +
+			strconv.Itoa(defaultHLLPrecision),
+		reduce: approxDistinct(defaultHLLPrecision),
+		make: func(args string) (reducer, error) {
+			p, err := hllPrecision(args)
+			if err != nil {
+				return nil, err
+			}
+			return approxDistinct(p), nil
+		},
+	})
+}
+
+func hllPrecision(args string) (uint8, error) {
+	if args == "" {
+		return defaultHLLPrecision, nil
+	}
+	p, err := strconv.Atoi(args)
+	if err != nil || p < minHLLPrecision || p > maxHLLPrecision {
+		return 0, fmt.Errorf("invalid precision %q", args)
+	}
+	return uint8(p), nil
+}
+
+// distinctHash hashes a scalar value for distinct counting.  Objects,
+// arrays and nulls aren't counted.
+func distinctHash(v interface{}) (uint64, bool) {
+	h := fnv.New64a()
+	switch x := v.(type) {
+	case nil, map[string]interface{}, []interface{}:
+		return 0, false
+	case string:
+		h.Write([]byte{'s'})
+		h.Write([]byte(x))
+	default:
+		fmt.Fprintf(h, "%T:%v", x, x)
+	}
+
+	// FNV's high bits are poorly mixed for short inputs, and the
+	// sketch depends on them, so finish with murmur3's mixer.
+	k := h.Sum64()
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k, true
+}
+
+func countDistinct(input chan ptrval) interface{} {
+	seen := map[uint64]bool{}
+	var sketch *hll
+	for v := range input {
+		if !v.included {
+			continue
+		}
+		h, ok := distinctHash(v.val)
+		switch {
+		case !ok:
+		case sketch != nil:
+			sketch.add(h)
+		default:
+			seen[h] = true
+			if len(seen) > maxExactDistinct {
+				sketch = newHLL(defaultHLLPrecision)
+				for k := range seen {
+					sketch.add(k)
+				}
+				seen = nil
+			}
+		}
+	}
+	if sketch != nil {
+		return sketch.estimate()
+	}
+	return len(seen)
+}
+
+func approxDistinct(precision uint8) reducer {
+	return func(input chan ptrval) interface{} {
+		return hllOf(precision, input).estimate()
+	}
+}
+
+// hllOf sketches the included values.
+func hllOf(precision uint8, input chan ptrval) *hll {
+	sketch := newHLL(precision)
+	for v := range input {
+		if h, ok := distinctHash(v.val); ok && v.included {
+			sketch.add(h)
+		}
+	}
+	return sketch
+}
+
+// An hll is a HyperLogLog sketch estimating the number of distinct
+// hashes added to it.  Sketches of the same precision may be merged,
+// and they're encoded in JSON as a base64 string of the precision
+// followed by the registers.
+type hll struct {
+	p         uint8
+	registers []uint8
+}
+
+func newHLL(precision uint8) *hll {
+	return &hll{precision, make([]uint8, 1<<precision)}
+}
+
+func (s *hll) add(h uint64) {
+	i := h >> (64 - s.p)
+	// The rank is the position of the first set bit in the rest of
+	// the hash, bounded by the bits available.
+	rank := uint8(1)
+	for w := h << s.p; rank <= 64-s.p && w&(1<<63) == 0; w <<= 1 {
+		rank++
+	}
+	if rank > s.registers[i] {
+		s.registers[i] = rank
+	}
+}
+
+var errHLLPrecision = errors.New("can't merge sketches of different precision")
+
+// merge adds everything counted by another sketch to this one.
+func (s *hll) merge(o *hll) error {
+	if o.p != s.p {
+		return errHLLPrecision
+	}
+	for i, r := range o.registers {
+		if r > s.registers[i] {
+			s.registers[i] = r
+		}
+	}
+	return nil
+}
+
+func (s *hll) estimate() int64 {
+	m := float64(len(s.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range s.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(s.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(e + 0.5)
+}
+
+func (s *hll) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, len(s.registers)+1)
+	b = append(b, s.p)
+	b = append(b, s.registers...)
+	return json.Marshal(base64.StdEncoding.EncodeToString(b))
+}
+
+func (s *hll) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return err
+	}
+	if len(b) < 1 || b[0] < minHLLPrecision || b[0] > maxHLLPrecision ||
+		len(b)-1 != 1<<b[0] {
+		return errors.New("invalid sketch")
+	}
+	s.p, s.registers = b[0], b[1:]
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestCountDistinct(t *testing.T) {
+	input := []interface{}{"a", "b", "a", "1", nil,
+		map[string]interface{}{"x": "y"}, []interface{}{"a"}, "b", "c"}
+	for _, name := range []string{"count_distinct", "approx_distinct",
+		"approx_distinct:10"} {
+
+		r, err := findReducer(name)
+		if err != nil {
+			t.Fatalf("Error finding %v: %v", name, err)
+		}
+		got, _ := toFloat(r(streamCollection(input)))
+		if got != 4 {
+			t.Errorf("Expected 4 distinct values from %v, got %v", name, got)
+		}
+	}
+
+	for _, bad := range []string{"approx_distinct:3", "approx_distinct:17",
+		"approx_distinct:x", "count_distinct:5"} {
+		if _, err := findReducer(bad); err == nil {
+			t.Errorf("Expected error finding %v", bad)
+		}
+	}
+}
+
+func TestCountDistinctOverflow(t *testing.T) {
+	n := maxExactDistinct * 2
+	input := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		input = append(input, strconv.Itoa(i))
+	}
+	got, _ := toFloat(countDistinct(streamCollection(input)))
+	if e := math.Abs(got-float64(n)) / float64(n); e > 0.03 {
+		t.Errorf("Expected about %v, got %v (error %.3f)", n, got, e)
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	a, b := newHLL(12), newHLL(12)
+	for i := 0; i < 50000; i++ {
+		h, _ := distinctHash(strconv.Itoa(i))
+		if i < 30000 {
+			a.add(h)
+		}
+		if i >= 20000 {
+			b.add(h)
+		}
+	}
+	if err := a.merge(b); err != nil {
+		t.Fatalf("Error merging: %v", err)
+	}
+	if e := math.Abs(float64(a.estimate())-50000) / 50000; e > 0.05 {
+		t.Errorf("Expected about 50000, got %v", a.estimate())
+	}
+	if err := a.merge(newHLL(10)); err != errHLLPrecision {
+		t.Errorf("Expected precision error, got %v", err)
+	}
+}
+
+func TestHLLJSON(t *testing.T) {
+	s := newHLL(8)
+	for i := 0; i < 1000; i++ {
+		h, _ := distinctHash(float64(i))
+		s.add(h)
+	}
+	d, err := json.Marshal(s)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	var got hll
+	if err := json.Unmarshal(d, &got); err != nil {
+		t.Fatalf("Error decoding %s: %v", d, err)
+	}
+	if got.p != s.p || got.estimate() != s.estimate() {
+		t.Errorf("Expected %v/%v, got %v/%v", s.p, s.estimate(),
+			got.p, got.estimate())
+	}
+
+	for _, bad := range []string{`1`, `"!"`, `"AwA="`} {
+		if err := json.Unmarshal([]byte(bad), &got); err == nil {
+			t.Errorf("Expected error decoding %v", bad)
+		}
+	}
+}
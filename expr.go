@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// exprPrefix marks a query pointer as a computed field, e.g.
+// expr:/used*100/ /total
+const exprPrefix = "expr:"
+
+// An arithExpr computes a number from the values found in a document.
+type arithExpr interface {
+	// eval computes the expression, returning false if any value
+	// it needs is missing or not a number.
+	eval(fetched map[string]interface{}) (float64, bool)
+	// pointers appends the pointers the expression reads.
+	pointers(ptrs []string) []string
+	String() string
+}
+
+type numberExpr float64
+
+func (n numberExpr) eval(map[string]interface{}) (float64, bool) {
+	return float64(n), true
+}
+
+func (n numberExpr) pointers(ptrs []string) []string {
+	return ptrs
+}
+
+func (n numberExpr) String() string {
+	return strconv.FormatFloat(float64(n), 'g', -1, 64)
+}
+
+type pointerExpr string
+
+func (p pointerExpr) eval(fetched map[string]interface{}) (float64, bool) {
+	return filterNumber(fetched[string(p)])
+}
+
+func (p pointerExpr) pointers(ptrs []string) []string {
+	return append(ptrs, string(p))
+}
+
+func (p pointerExpr) String() string {
+	return string(p)
+}
+
+type negExpr struct {
+	e arithExpr
+}
+
+func (n negExpr) eval(fetched map[string]interface{}) (float64, bool) {
+	v, ok := n.e.eval(fetched)
+	return -v, ok
+}
+
+func (n negExpr) pointers(ptrs []string) []string {
+	return n.e.pointers(ptrs)
+}
+
+func (n negExpr) String() string {
+	return "-" + n.e.String()
+}
+
+type binaryExpr struct {
+	op   string
+	l, r arithExpr
+}
+
+func (b binaryExpr) eval(fetched map[string]interface{}) (float64, bool) {
+	l, lok := b.l.eval(fetched)
+	r, rok := b.r.eval(fetched)
+	if !(lok && rok) {
+		return 0, false
+	}
+	switch b.op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, r != 0
+	case "%":
+		if int64(r) == 0 {
+			return 0, false
+		}
+		return float64(int64(l) % int64(r)), true
+	}
+	panic("unhandled operator " + b.op)
+}
+
+func (b binaryExpr) pointers(ptrs []string) []string {
+	return b.r.pointers(b.l.pointers(ptrs))
+}
+
+func (b binaryExpr) String() string {
+	return "(" + b.l.String() + " " + b.op + " " + b.r.String() + ")"
+}
+
+// isExprPointer reports whether a query pointer is a computed field.
+func isExprPointer(ptr string) bool {
+	return strings.HasPrefix(ptr, exprPrefix)
+}
+
+// parseArith parses a complete arithmetic expression over pointers,
+// e.g. (/used / /total) * 100.
+func parseArith(in string) (arithExpr, error) {
+	s, err := newTokenStream(in)
+	if err != nil {
+		return nil, err
+	}
+	e, err := parseSum(s)
+	if err != nil {
+		return nil, err
+	}
+	if s.peek().typ != tokEOF {
+		return nil, s.errorf("unexpected input")
+	}
+	return e, nil
+}
+
+// parsePointerExprs parses the computed fields among a query's
+// pointers.  The result has a nil entry for each plain pointer.
+func parsePointerExprs(ptrs []string) ([]arithExpr, error) {
+	var rv []arithExpr
+	for i, p := range ptrs {
+		if !isExprPointer(p) {
+			continue
+		}
+		e, err := parseArith(p[len(exprPrefix):])
+		if err != nil {
+			return nil, paramError{"Bad expression",
+				fmt.Sprintf("%v: %v", p, err)}
+		}
+		if rv == nil {
+			rv = make([]arithExpr, len(ptrs))
+		}
+		rv[i] = e
+	}
+	return rv, nil
+}
+
+func parseSum(s *tokenStream) (arithExpr, error) {
+	l, err := parseProduct(s)
+	if err != nil {
+		return nil, err
+	}
+	for t := s.peek(); t.is("+") || t.is("-"); t = s.peek() {
+		s.next()
+		r, err := parseProduct(s)
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{t.val, l, r}
+	}
+	return l, nil
+}
+
+func parseProduct(s *tokenStream) (arithExpr, error) {
+	l, err := parseNegation(s)
+	if err != nil {
+		return nil, err
+	}
+	for t := s.peek(); t.is("*") || t.is("/") || t.is("%"); t = s.peek() {
+		s.next()
+		r, err := parseNegation(s)
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{t.val, l, r}
+	}
+	return l, nil
+}
+
+func parseNegation(s *tokenStream) (arithExpr, error) {
+	if s.accept("-") {
+		e, err := parseNegation(s)
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{e}, nil
+	}
+	return parseOperand(s)
+}
+
+func parseOperand(s *tokenStream) (arithExpr, error) {
+	t := s.peek()
+	switch t.typ {
+	case tokNumber:
+		s.next()
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %v at %v", t.val, t.pos)
+		}
+		return numberExpr(f), nil
+	case tokPointer:
+		s.next()
+		return pointerExpr(t.val), nil
+	}
+	if s.accept("(") {
+		e, err := parseSum(s)
+		if err != nil {
+			return nil, err
+		}
+		return e, s.expect(")")
+	}
+	return nil, s.errorf("expected number, pointer or (")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mschoch/gouchstore"
+)
+
+func TestArithExprs(t *testing.T) {
+	doc := map[string]interface{}{
+		"/used":  25.0,
+		"/total": 200.0,
+		"/zero":  0.0,
+		"/str":   "4",
+		"/name":  "x",
+	}
+	tests := []struct {
+		in  string
+		exp float64
+		ok  bool
+	}{
+		{"/used*100/ /total", 12.5, true},
+		{"(/used / /total) * 100", 12.5, true},
+		{"/total - /used - 5", 170, true},
+		{"/total - (/used - 5)", 180, true},
+		{"1 + 2 * 3", 7, true},
+		{"-/used + 1", -24, true},
+		{"/total % 7", 4, true},
+		{"/str * 2", 8, true},
+		{"/used / /zero", 0, false},
+		{"/used + /missing", 0, false},
+		{"/name * 2", 0, false},
+	}
+
+	for _, test := range tests {
+		e, err := parseArith(test.in)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.in, err)
+			continue
+		}
+		got, ok := e.eval(doc)
+		if ok != test.ok || (ok && got != test.exp) {
+			t.Errorf("Expected %v (%v) for %v, got %v (%v)",
+				test.exp, test.ok, e, got, ok)
+		}
+	}
+}
+
+func TestArithExprErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"/a +",
+		"(/a",
+		"/a /b",
+		"avg(/a)",
+		"/a = 1",
+	}
+	for _, test := range tests {
+		if e, err := parseArith(test); err == nil {
+			t.Errorf("Expected error parsing %q, got %v", test, e)
+		}
+	}
+}
+
+func TestComputedField(t *testing.T) {
+	di := gouchstore.NewDocumentInfo("2013-02-22T16:29:19.750264Z")
+	ptrs := []string{"/kind",
+		"expr:/data/children/0/data/ups - /data/children/0/data/downs"}
+	exprs, err := parsePointerExprs(ptrs)
+	if err != nil {
+		t.Fatalf("Error parsing expressions: %v", err)
+	}
+	chans := []chan ptrval{make(chan ptrval, 1), make(chan ptrval, 1)}
+	processDoc(di, func(string, bool) []chan ptrval {
+		return chans
+	}, bigInput, ptrs, exprs, nil, nil, true)
+	if got := (<-chans[0]).val; got != "Listing" {
+		t.Errorf("Expected Listing, got %v", got)
+	}
+	if got := (<-chans[1]).val; got != "2675" {
+		t.Errorf("Expected 2675, got %v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Gap filling modes for the fill query parameter.
+const (
+	fillNull     = "null"
+	fillZero     = "zero"
+	fillPrevious = "previous"
+	fillLinear   = "linear"
+)
+
+var fillModes = map[string]bool{
+	fillNull: true, fillZero: true, fillPrevious: true, fillLinear: true,
+}
+
+// maxFillGroups limits how many groups gap filling may produce.
+const maxFillGroups = 1000000
+
+// groupKeys lists the start of every group between the query's from
+// and to, or between the first and last results if the query range
+// is open.
+func (q *queryIn) groupKeys(results []*processOut) ([]int64, error) {
+	if len(results) == 0 && (q.from == "" || q.to == "") {
+		return nil, nil
+	}
+	from, to := parseKey(q.from), parseKey(q.to)
+	if q.from == "" {
+		from = results[0].key
+	}
+	if q.to == "" {
+		to = results[len(results)-1].key
+	}
+
+	rv := []int64{}
+	for k, _ := q.grouper.bucket(from); k <= to; {
+		if len(rv) >= maxFillGroups {
+			return nil, paramError{"Too many groups",
+				fmt.Sprintf("fill would produce more than %v groups",
+					maxFillGroups)}
+		}
+		rv = append(rv, k)
+		_, k = q.grouper.bucket(k)
+	}
+	return rv, nil
+}
+
+// fillGaps produces a result for every group key, filling in missing
+// groups and null values according to mode.  Grouped results are
+// filled separately for each series.
+func fillGaps(results []*processOut, keys []int64, mode string,
+	width int, grouped bool) []*processOut {
+
+	found := make(map[int64]*processOut, len(results))
+	names := map[string]bool{}
+	for _, po := range results {
+		found[po.key] = po
+		for n := range po.groups {
+			names[n] = true
+		}
+	}
+	if !grouped {
+		names[""] = true
+	}
+
+	rv := make([]*processOut, len(keys))
+	for i, k := range keys {
+		po, ok := found[k]
+		if !ok {
+			po = &processOut{key: k}
+			if grouped {
+				po.groups = map[string][]interface{}{}
+			}
+		}
+		rv[i] = po
+	}
+
+	rows := make([][]interface{}, len(rv))
+	for n := range names {
+		for i, po := range rv {
+			if grouped {
+				rows[i] = po.groups[n]
+			} else {
+				rows[i] = po.value
+			}
+			if rows[i] == nil {
+				rows[i] = make([]interface{}, width)
+			}
+		}
+		fillRows(rows, keys, mode)
+		for i, po := range rv {
+			if grouped {
+				po.groups[n] = rows[i]
+			} else {
+				po.value = rows[i]
+			}
+		}
+	}
+	return rv
+}
+
+// fillRows fills null values in each column of rows.
+func fillRows(rows [][]interface{}, keys []int64, mode string) {
+	if len(rows) == 0 {
+		return
+	}
+	for col := range rows[0] {
+		prev := -1
+		for i := range rows {
+			if rows[i][col] != nil {
+				if mode == fillLinear && prev >= 0 && prev < i-1 {
+					interpolate(rows, keys, col, prev, i)
+				}
+				prev = i
+				continue
+			}
+			switch mode {
+			case fillZero:
+				rows[i][col] = 0
+			case fillPrevious:
+				if prev >= 0 {
+					rows[i][col] = rows[prev][col]
+				}
+			}
+		}
+	}
+}
+
+// interpolate fills the numeric values in a column between rows lo
+// and hi proportionally to their group keys.
+func interpolate(rows [][]interface{}, keys []int64, col, lo, hi int) {
+	a, aok := toFloat(rows[lo][col])
+	b, bok := toFloat(rows[hi][col])
+	if !(aok && bok) {
+		return
+	}
+	span := float64(keys[hi] - keys[lo])
+	for i := lo + 1; i < hi; i++ {
+		rows[i][col] = a + (b-a)*float64(keys[i]-keys[lo])/span
+	}
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFillRows(t *testing.T) {
+	keys := []int64{0, 10, 20, 30, 40, 50}
+	mkrows := func() [][]interface{} {
+		return [][]interface{}{
+			{nil, "a"},
+			{1.0, nil},
+			{nil, nil},
+			{nil, "b"},
+			{4.0, nil},
+			{nil, nil},
+		}
+	}
+	tests := []struct {
+		mode string
+		exp  [][]interface{}
+	}{
+		{fillNull, mkrows()},
+		{fillZero, [][]interface{}{
+			{0, "a"}, {1.0, 0}, {0, 0}, {0, "b"}, {4.0, 0}, {0, 0},
+		}},
+		{fillPrevious, [][]interface{}{
+			{nil, "a"}, {1.0, "a"}, {1.0, "a"},
+			{1.0, "b"}, {4.0, "b"}, {4.0, "b"},
+		}},
+		{fillLinear, [][]interface{}{
+			{nil, "a"}, {1.0, nil}, {2.0, nil},
+			{3.0, "b"}, {4.0, nil}, {nil, nil},
+		}},
+	}
+
+	for _, test := range tests {
+		rows := mkrows()
+		fillRows(rows, keys, test.mode)
+		if !reflect.DeepEqual(rows, test.exp) {
+			t.Errorf("Expected %v fill to produce %v, got %v",
+				test.mode, test.exp, rows)
+		}
+	}
+}
+
+func TestPostProcessFill(t *testing.T) {
+	q := &queryIn{
+		from:    "1970-01-01T00:00:00Z",
+		to:      "1970-01-01T00:00:04Z",
+		grouper: fixedGrouper{int64(time.Second), time.UTC},
+		ptrs:    []string{"/x"},
+		groupBy: []string{"/h"},
+		fill:    fillPrevious,
+	}
+	results := []*processOut{
+		{key: 3e9, groups: map[string][]interface{}{"b": {3.0}}},
+		{key: 1e9, groups: map[string][]interface{}{"a": {1.0}}},
+	}
+
+	got, err := q.postProcess(results)
+	if err != nil {
+		t.Fatalf("Error post processing: %v", err)
+	}
+	exp := []map[string][]interface{}{
+		{"a": {nil}, "b": {nil}},
+		{"a": {1.0}, "b": {nil}},
+		{"a": {1.0}, "b": {nil}},
+		{"a": {1.0}, "b": {3.0}},
+		{"a": {1.0}, "b": {3.0}},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("Expected %v results, got %v", len(exp), len(got))
+	}
+	for i, po := range got {
+		if po.key != int64(i)*1e9 {
+			t.Errorf("Expected key %v at %v, got %v", i*1e9, i, po.key)
+		}
+		if !reflect.DeepEqual(po.groups, exp[i]) {
+			t.Errorf("Expected %v at %v, got %v", exp[i], i, po.groups)
+		}
+	}
+}
+
+func TestFillTooManyGroups(t *testing.T) {
+	q := &queryIn{
+		from:    "1970-01-01T00:00:00Z",
+		to:      "2013-01-01T00:00:00Z",
+		grouper: fixedGrouper{int64(time.Millisecond), time.UTC},
+		ptrs:    []string{"/x"},
+		fill:    fillNull,
+	}
+	if _, err := q.postProcess(nil); err == nil {
+		t.Errorf("Expected error filling too many groups")
+	}
+}
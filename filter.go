@@ -0,0 +1,736 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/seriesly/timelib"
+)
+
+// Canonical filter operators.  Aliases accepted by parseFilter are
+// listed in filterOpAliases.
+const (
+	filterEq      = "="
+	filterNe      = "!="
+	filterGt      = ">"
+	filterGe      = ">="
+	filterLt      = "<"
+	filterLe      = "<="
+	filterRange   = "range"
+	filterIn      = "in"
+	filterRegex   = "~"
+	filterExists  = "exists"
+	filterMissing = "missing"
+	filterPrefix  = "prefix"
+)
+
+var filterOpAliases = map[string]string{
+	"":        filterEq,
+	"=":       filterEq,
+	"==":      filterEq,
+	"eq":      filterEq,
+	"!=":      filterNe,
+	"ne":      filterNe,
+	">":       filterGt,
+	"gt":      filterGt,
+	">=":      filterGe,
+	"ge":      filterGe,
+	"<":       filterLt,
+	"lt":      filterLt,
+	"<=":      filterLe,
+	"le":      filterLe,
+	"range":   filterRange,
+	"in":      filterIn,
+	"~":       filterRegex,
+	"regex":   filterRegex,
+	"exists":  filterExists,
+	"missing": filterMissing,
+	"prefix":  filterPrefix,
+}
+
+// A filter restricts the documents considered by a query based on
+// the value found at a JSON pointer.
+type filter struct {
+	ptr string
+	op  string
+	val string
+
+	num  float64
+	nums []float64
+	strs []string
+	re   *regexp.Regexp
+	// isNum is true when val is numeric and comparisons should be
+	// done numerically.
+	isNum bool
+}
+
+// parseFilter builds a filter from a pointer, operator and value as
+// given in a query.
+//
+// The range operator takes "low,high" (both inclusive) and the in
+// operator takes a comma separated list of acceptable values.  The
+// value is ignored for exists and missing.
+func parseFilter(ptr, op, val string) (filter, error) {
+	canon, ok := filterOpAliases[op]
+	if !ok {
+		return filter{}, fmt.Errorf("unknown filter operator: %v", op)
+	}
+	rv := filter{ptr: ptr, op: canon, val: val}
+
+	var err error
+	switch canon {
+	case filterGt, filterGe, filterLt, filterLe:
+		rv.num, err = strconv.ParseFloat(val, 64)
+		rv.isNum = err == nil
+	case filterRange:
+		rv.nums, err = parseFloats(val)
+		if err == nil && len(rv.nums) != 2 {
+			err = fmt.Errorf("range requires low,high; got %q", val)
+		}
+		if err != nil {
+			return rv, fmt.Errorf("invalid range filter: %v", err)
+		}
+	case filterIn:
+		rv.strs = strings.Split(val, ",")
+	case filterRegex:
+		rv.re, err = regexp.Compile(val)
+		if err != nil {
+			return rv, err
+		}
+	}
+	return rv, nil
+}
+
+// String returns the filter in the form pointer, operator, value.
+func (f filter) String() string {
+	return f.ptr + " " + f.op + " " + strconv.Quote(f.val)
+}
+
+// filterString converts a scalar document value to the string form
+// filters compare against.
+func filterString(val interface{}) (string, bool) {
+	switch x := val.(type) {
+	case string:
+		return x, true
+	case int, uint, int64, float64, uint64, bool:
+		return fmt.Sprintf("%v", x), true
+	}
+	return "", false
+}
+
+// filterNumber converts a document value to a number for numeric
+// comparisons.  Numeric strings are accepted.
+func filterNumber(val interface{}) (float64, bool) {
+	switch x := val.(type) {
+	case float64:
+		return x, true
+	case string:
+		f, err := strconv.ParseFloat(x, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func (f *filter) matches(val interface{}) bool {
+	switch f.op {
+	case filterExists:
+		return val != nil
+	case filterMissing:
+		return val == nil
+	case filterGt, filterGe, filterLt, filterLe:
+		var c int
+		if f.isNum {
+			n, ok := filterNumber(val)
+			if !ok {
+				return false
+			}
+			c = compareFloats(n, f.num)
+		} else {
+			s, ok := val.(string)
+			if !ok {
+				return false
+			}
+			c = strings.Compare(s, f.val)
+		}
+		switch f.op {
+		case filterGt:
+			return c > 0
+		case filterGe:
+			return c >= 0
+		case filterLt:
+			return c < 0
+		}
+		return c <= 0
+	case filterRange:
+		n, ok := filterNumber(val)
+		return ok && n >= f.nums[0] && n <= f.nums[1]
+	}
+
+	s, ok := filterString(val)
+	if !ok {
+		return false
+	}
+	switch f.op {
+	case filterEq:
+		return s == f.val
+	case filterNe:
+		return s != f.val
+	case filterIn:
+		for _, x := range f.strs {
+			if s == x {
+				return true
+			}
+		}
+		return false
+	case filterRegex:
+		return f.re.MatchString(s)
+	case filterPrefix:
+		return strings.HasPrefix(s, f.val)
+	}
+	return false
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// A filterExpr is a boolean combination of filters evaluated against
+// the values fetched from a document.
+type filterExpr interface {
+	eval(vals map[string]interface{}) bool
+	// pointers appends the JSON pointers the expression examines.
+	pointers(into []string) []string
+	String() string
+}
+
+func (f *filter) eval(vals map[string]interface{}) bool {
+	return f.matches(vals[f.ptr])
+}
+
+func (f *filter) pointers(into []string) []string {
+	return append(into, f.ptr)
+}
+
+type andExpr []filterExpr
+type orExpr []filterExpr
+type notExpr struct{ e filterExpr }
+
+func (a andExpr) eval(vals map[string]interface{}) bool {
+	for _, e := range a {
+		if !e.eval(vals) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a andExpr) pointers(into []string) []string {
+	for _, e := range a {
+		into = e.pointers(into)
+	}
+	return into
+}
+
+func (a andExpr) String() string {
+	return joinExprs(a, " AND ")
+}
+
+func (o orExpr) eval(vals map[string]interface{}) bool {
+	for _, e := range o {
+		if e.eval(vals) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o orExpr) pointers(into []string) []string {
+	for _, e := range o {
+		into = e.pointers(into)
+	}
+	return into
+}
+
+func (o orExpr) String() string {
+	return joinExprs(o, " OR ")
+}
+
+func (n notExpr) eval(vals map[string]interface{}) bool {
+	return !n.e.eval(vals)
+}
+
+func (n notExpr) pointers(into []string) []string {
+	return n.e.pointers(into)
+}
+
+func (n notExpr) String() string {
+	return "NOT " + n.e.String()
+}
+
+func joinExprs(exprs []filterExpr, sep string) string {
+	parts := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		parts = append(parts, e.String())
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// andFilters combines expressions, skipping nils.  The result is nil
+// if there's nothing to filter on.
+func andFilters(exprs ...filterExpr) filterExpr {
+	rv := andExpr{}
+	for _, e := range exprs {
+		if e != nil {
+			rv = append(rv, e)
+		}
+	}
+	switch len(rv) {
+	case 0:
+		return nil
+	case 1:
+		return rv[0]
+	}
+	return rv
+}
+
+// parseFilterExpr parses a boolean filter expression such as
+//
+//	(/host = "a" OR /host = "b") AND NOT /status = "ok"
+//
+// Conditions compare a JSON pointer using any filter operator, or
+// take the forms "/p IN (v, ...)", "/p BETWEEN low AND high",
+// "/p EXISTS" and "/p MISSING".  Comparisons against "time" (e.g.
+// "time > now - 1h") produce timeConds, see splitTimeConds.
+func parseFilterExpr(in string) (filterExpr, error) {
+	s, err := newTokenStream(in)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := parseOrExpr(s)
+	if err == nil && s.peek().typ != tokEOF {
+		err = s.errorf("unexpected input")
+	}
+	return rv, err
+}
+
+func parseOrExpr(s *tokenStream) (filterExpr, error) {
+	rv := orExpr{}
+	for {
+		e, err := parseAndExpr(s)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, e)
+		if !s.accept("or") {
+			break
+		}
+	}
+	if len(rv) == 1 {
+		return rv[0], nil
+	}
+	return rv, nil
+}
+
+func parseAndExpr(s *tokenStream) (filterExpr, error) {
+	rv := andExpr{}
+	for {
+		e, err := parseUnaryFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, e)
+		if !s.accept("and") {
+			break
+		}
+	}
+	if len(rv) == 1 {
+		return rv[0], nil
+	}
+	return rv, nil
+}
+
+func parseUnaryFilter(s *tokenStream) (filterExpr, error) {
+	switch {
+	case s.accept("not"):
+		e, err := parseUnaryFilter(s)
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	case s.accept("("):
+		e, err := parseOrExpr(s)
+		if err != nil {
+			return nil, err
+		}
+		return e, s.expect(")")
+	}
+	return parseCondition(s)
+}
+
+func parseCondition(s *tokenStream) (filterExpr, error) {
+	if s.peek().is("time") {
+		return parseTimeCondition(s)
+	}
+
+	ptr := s.peek()
+	if ptr.typ != tokPointer {
+		return nil, s.errorf("expected JSON pointer")
+	}
+	s.next()
+
+	optok := s.peek()
+	op, isOp := filterOpAliases[strings.ToLower(optok.val)]
+	if optok.typ != tokSymbol && optok.typ != tokIdent {
+		isOp = false
+	}
+
+	var f filter
+	var err error
+	switch {
+	case optok.is("in"):
+		s.next()
+		var vals []string
+		vals, err = parseValueList(s)
+		if err == nil {
+			f, err = parseFilter(ptr.val, filterIn, strings.Join(vals, ","))
+			f.strs = vals
+		}
+	case optok.is("between"):
+		s.next()
+		var lo, hi string
+		lo, err = parseFilterValue(s)
+		if err == nil {
+			err = s.expect("and")
+		}
+		if err == nil {
+			hi, err = parseFilterValue(s)
+		}
+		if err == nil {
+			f, err = parseFilter(ptr.val, filterRange, lo+","+hi)
+		}
+	case isOp && (op == filterExists || op == filterMissing):
+		s.next()
+		f, err = parseFilter(ptr.val, op, "")
+	case isOp && op != filterRange:
+		s.next()
+		var val string
+		val, err = parseFilterValue(s)
+		if err == nil {
+			f, err = parseFilter(ptr.val, op, val)
+		}
+	default:
+		return nil, s.errorf("expected filter operator")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// parseFilterValue reads a literal value.  Numbers are normalized to
+// the form used when comparing numeric document values as strings.
+func parseFilterValue(s *tokenStream) (string, error) {
+	neg := s.accept("-")
+	t := s.peek()
+	switch {
+	case t.typ == tokNumber:
+		s.next()
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid number at %v: %v", t.pos, err)
+		}
+		if neg {
+			f = -f
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case neg:
+	case t.typ == tokString:
+		s.next()
+		return t.val, nil
+	case t.is("true"), t.is("false"):
+		s.next()
+		return strings.ToLower(t.val), nil
+	}
+	return "", s.errorf("expected value")
+}
+
+func parseValueList(s *tokenStream) ([]string, error) {
+	if err := s.expect("("); err != nil {
+		return nil, err
+	}
+	rv := []string{}
+	for {
+		v, err := parseFilterValue(s)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, v)
+		if !s.accept(",") {
+			break
+		}
+	}
+	return rv, s.expect(")")
+}
+
+// A timeCond restricts the time range of a query.  It's parsed from
+// expressions like "time > now - 1h" and applied to the query's key
+// range rather than evaluated against documents.
+type timeCond struct {
+	op string
+	t  time.Time
+}
+
+func (timeCond) eval(vals map[string]interface{}) bool {
+	return true
+}
+
+func (timeCond) pointers(into []string) []string {
+	return into
+}
+
+func (c timeCond) String() string {
+	return "time " + c.op + " " + c.t.UTC().Format(time.RFC3339Nano)
+}
+
+// durationUnits extends time.ParseDuration with days and weeks.
+var durationUnits = map[string]time.Duration{
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// parseDurationString reads a duration such as 5m, 1.5d or 1w2d12h:
+// anything time.ParseDuration understands, with days and weeks.
+func parseDurationString(in string) (time.Duration, error) {
+	s := in
+	neg := strings.HasPrefix(s, "-")
+	if neg || strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid duration %q", in)
+	}
+	var rv time.Duration
+	for s != "" {
+		i := strings.IndexFunc(s, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.'
+		})
+		switch {
+		case i == 0:
+			return 0, fmt.Errorf("invalid duration %q", in)
+		case i < 0:
+			i = len(s)
+		}
+		j := strings.IndexFunc(s[i:], func(r rune) bool {
+			return r >= '0' && r <= '9' || r == '.'
+		})
+		if j < 0 {
+			j = len(s)
+		} else {
+			j += i
+		}
+		num, unit := s[:i], s[i:j]
+		if u, ok := durationUnits[unit]; ok {
+			f, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", in)
+			}
+			rv += time.Duration(f * float64(u))
+		} else {
+			d, err := time.ParseDuration(num + unit)
+			if err != nil {
+				return 0, err
+			}
+			rv += d
+		}
+		s = s[j:]
+	}
+	if neg {
+		rv = -rv
+	}
+	return rv, nil
+}
+
+// parseDuration reads a duration literal such as 5m, 1h30m or 2d.  A
+// bare number is taken as milliseconds.
+func parseDuration(s *tokenStream) (time.Duration, error) {
+	num := s.peek()
+	if num.typ != tokNumber {
+		return 0, s.errorf("expected duration")
+	}
+	s.next()
+	// The lexer splits a literal like 1d12h or 1h0.5m into adjacent
+	// numbers and identifiers.
+	lit, end := num.val, num.pos+len(num.val)
+	for {
+		t := s.peek()
+		if t.typ != tokNumber && t.typ != tokIdent || t.pos != end {
+			break
+		}
+		s.next()
+		lit, end = lit+t.val, t.pos+len(t.val)
+	}
+	if lit == num.val {
+		f, err := strconv.ParseFloat(num.val, 64)
+		return time.Duration(f * float64(time.Millisecond)), err
+	}
+	return parseDurationString(lit)
+}
+
+// parseTimeValue reads "now", optionally offset by a duration, or a
+// timestamp in any format understood by timelib.ParseTime.
+func parseTimeValue(s *tokenStream) (time.Time, error) {
+	t := s.peek()
+	switch {
+	case t.is("now"):
+		s.next()
+		rv := time.Now()
+		for s.peek().is("-") || s.peek().is("+") {
+			neg := s.next().is("-")
+			d, err := parseDuration(s)
+			if err != nil {
+				return rv, err
+			}
+			if neg {
+				d = -d
+			}
+			rv = rv.Add(d)
+		}
+		return rv, nil
+	case t.typ == tokString, t.typ == tokNumber:
+		s.next()
+		rv, err := timelib.ParseTime(t.val)
+		if err != nil {
+			return rv, fmt.Errorf("invalid time at %v: %v", t.pos, err)
+		}
+		return rv, nil
+	}
+	return time.Time{}, s.errorf("expected time")
+}
+
+func parseTimeCondition(s *tokenStream) (filterExpr, error) {
+	s.next()
+	optok := s.peek()
+	switch {
+	case optok.is("between"):
+		s.next()
+		lo, err := parseTimeValue(s)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.expect("and"); err != nil {
+			return nil, err
+		}
+		hi, err := parseTimeValue(s)
+		if err != nil {
+			return nil, err
+		}
+		return andExpr{timeCond{filterGe, lo}, timeCond{filterLe, hi}}, nil
+	case optok.typ == tokSymbol:
+		op := filterOpAliases[optok.val]
+		switch op {
+		case filterEq, filterGt, filterGe, filterLt, filterLe:
+			s.next()
+			t, err := parseTimeValue(s)
+			return timeCond{op, t}, err
+		}
+	}
+	return nil, s.errorf("expected time comparison")
+}
+
+func containsTimeCond(e filterExpr) bool {
+	switch x := e.(type) {
+	case timeCond:
+		return true
+	case andExpr:
+		for _, c := range x {
+			if containsTimeCond(c) {
+				return true
+			}
+		}
+	case orExpr:
+		for _, c := range x {
+			if containsTimeCond(c) {
+				return true
+			}
+		}
+	case notExpr:
+		return containsTimeCond(x.e)
+	}
+	return false
+}
+
+// splitTimeConds separates the time conditions from a filter
+// expression.  Time conditions may only be combined with AND since
+// they restrict the range of keys scanned.
+func splitTimeConds(e filterExpr) (filterExpr, []timeCond, error) {
+	switch x := e.(type) {
+	case timeCond:
+		return nil, []timeCond{x}, nil
+	case andExpr:
+		rest := make([]filterExpr, 0, len(x))
+		var conds []timeCond
+		for _, c := range x {
+			r, tc, err := splitTimeConds(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			rest = append(rest, r)
+			conds = append(conds, tc...)
+		}
+		return andFilters(rest...), conds, nil
+	}
+	if containsTimeCond(e) {
+		return nil, nil, fmt.Errorf("time conditions may only be combined with AND")
+	}
+	return e, nil, nil
+}
+
+// narrowRange restricts a from/to key range by the given time
+// conditions.
+func narrowRange(from, to string, conds []timeCond) (string, string) {
+	// Zero times are unbounded.
+	lo, _ := timelib.ParseCanonicalTime(from)
+	hi, _ := timelib.ParseCanonicalTime(to)
+	raise := func(t time.Time) {
+		if lo.IsZero() || t.After(lo) {
+			lo = t
+		}
+	}
+	lower := func(t time.Time) {
+		if hi.IsZero() || t.Before(hi) {
+			hi = t
+		}
+	}
+	for _, c := range conds {
+		t := c.t.UTC()
+		switch c.op {
+		case filterGt:
+			raise(t.Add(time.Nanosecond))
+		case filterGe:
+			raise(t)
+		case filterLt:
+			lower(t.Add(-time.Nanosecond))
+		case filterLe:
+			lower(t)
+		case filterEq:
+			raise(t)
+			lower(t)
+		}
+	}
+	if !lo.IsZero() {
+		from = lo.Format(time.RFC3339Nano)
+	}
+	if !hi.IsZero() {
+		to = hi.Format(time.RFC3339Nano)
+	}
+	return from, to
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mschoch/gouchstore"
+)
+
+func TestFilterMatching(t *testing.T) {
+	tests := []struct {
+		op, val string
+		in      interface{}
+		exp     bool
+	}{
+		{"", "abc", "abc", true},
+		{"", "abc", "abd", false},
+		{"=", "3", 3.0, true},
+		{"=", "true", true, true},
+		{"=", "x", nil, false},
+		{"=", "x", map[string]interface{}{}, false},
+		{"!=", "abc", "abd", true},
+		{"!=", "abc", "abc", false},
+		{"!=", "abc", nil, false},
+		{">", "10", 11.0, true},
+		{">", "10", 10.0, false},
+		{">", "10", "11", true},
+		{">", "10", "x", false},
+		{">=", "10", 10.0, true},
+		{"<", "10", 9.5, true},
+		{"<", "10", 10.0, false},
+		{"<=", "10", 10.0, true},
+		{"lt", "b", "a", true},
+		{"gt", "b", "a", false},
+		{"gt", "b", 3.0, false},
+		{"range", "5,10", 5.0, true},
+		{"range", "5,10", 10.0, true},
+		{"range", "5,10", 10.5, false},
+		{"range", "5,10", "7", true},
+		{"in", "a,b,c", "b", true},
+		{"in", "a,b,c", "d", false},
+		{"in", "1,2", 2.0, true},
+		{"~", "^web[0-9]+$", "web12", true},
+		{"regex", "^web[0-9]+$", "db12", false},
+		{"exists", "", "x", true},
+		{"exists", "", nil, false},
+		{"missing", "", nil, true},
+		{"missing", "", 0.0, false},
+		{"prefix", "web", "web12", true},
+		{"prefix", "web", "db12", false},
+	}
+
+	for _, test := range tests {
+		f, err := parseFilter("/x", test.op, test.val)
+		if err != nil {
+			t.Fatalf("Error parsing %v %v: %v", test.op, test.val, err)
+		}
+		if got := f.matches(test.in); got != test.exp {
+			t.Errorf("Expected %v for %v %v %#v, got %v",
+				test.exp, test.op, test.val, test.in, got)
+		}
+	}
+}
+
+func TestFilterParseErrors(t *testing.T) {
+	tests := []struct{ op, val string }{
+		{"like", "x"},
+		{"range", "5"},
+		{"range", "a,b"},
+		{"~", "[unclosed"},
+	}
+
+	for _, test := range tests {
+		if _, err := parseFilter("/x", test.op, test.val); err == nil {
+			t.Errorf("Expected error parsing %v %v", test.op, test.val)
+		}
+	}
+}
+
+func TestFilteredProcessDoc(t *testing.T) {
+	di := gouchstore.NewDocumentInfo("2013-02-22T16:29:19.750264Z")
+	tests := []struct {
+		ptr, op, val string
+		exp          bool
+	}{
+		{"/kind", "", "Listing", true},
+		{"/kind", "!=", "Listing", false},
+		{"/kind", "prefix", "List", true},
+		{"/nothere", "missing", "", true},
+		{"/nothere", "exists", "", false},
+	}
+
+	for _, test := range tests {
+		f, err := parseFilter(test.ptr, test.op, test.val)
+		if err != nil {
+			t.Fatalf("Error parsing filter: %v", err)
+		}
+		ch := make(chan ptrval, 1)
+		processDoc(di, func(string, bool) []chan ptrval {
+			return []chan ptrval{ch}
+		}, bigInput, []string{"/kind"}, nil, nil, &f, true)
+		if got := len(ch) == 1; got != test.exp {
+			t.Errorf("Expected %v for %v %v %v, got %v",
+				test.exp, test.ptr, test.op, test.val, got)
+		}
+	}
+}
+
+func TestFilterExpressions(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"/host": "a", "/status": "ok", "/n": 1.0},
+		{"/host": "b", "/status": "bad", "/n": 5.0},
+		{"/host": "c", "/status": "bad", "/n": 10.0},
+		{"/host": "a", "/status": "bad"},
+	}
+	tests := []struct {
+		expr string
+		exp  []bool
+	}{
+		{`/host = "a"`, []bool{true, false, false, true}},
+		{`/host = 'a' or /host = "b"`, []bool{true, true, false, true}},
+		{`(/host = "a" OR /host = "b") AND NOT /status = "ok"`,
+			[]bool{false, true, false, true}},
+		{`NOT (/host = "a" OR /host = "b")`, []bool{false, false, true, false}},
+		{`/host = "a" or /host = "b" and /status = "ok"`,
+			[]bool{true, false, false, true}},
+		{`/n > 1`, []bool{false, true, true, false}},
+		{`/n >= 1 and /n < 10`, []bool{true, true, false, false}},
+		{`/n = 5.0`, []bool{false, true, false, false}},
+		{`/n > -1`, []bool{true, true, true, false}},
+		{`/n between 2 and 10`, []bool{false, true, true, false}},
+		{`/host in ("b", "c")`, []bool{false, true, true, false}},
+		{`/n exists`, []bool{true, true, true, false}},
+		{`/n missing and /host prefix "a"`, []bool{false, false, false, true}},
+		{`/status ~ "^b"`, []bool{false, true, true, true}},
+		{`/host != "a"`, []bool{false, true, true, false}},
+	}
+
+	for _, test := range tests {
+		e, err := parseFilterExpr(test.expr)
+		if err != nil {
+			t.Errorf("Error parsing %v: %v", test.expr, err)
+			continue
+		}
+		for i, d := range docs {
+			if got := e.eval(d); got != test.exp[i] {
+				t.Errorf("Expected %v for %v on %v, got %v",
+					test.exp[i], test.expr, d, got)
+			}
+		}
+	}
+}
+
+func TestFilterExpressionPointers(t *testing.T) {
+	e, err := parseFilterExpr(`/a = 1 or (/b exists and not /c/d < 3)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	got := e.pointers(nil)
+	exp := []string{"/a", "/b", "/c/d"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestFilterExpressionErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`/a`,
+		`/a =`,
+		`/a = "x" and`,
+		`(/a = "x"`,
+		`/a = "x")`,
+		`/a = "x" /b = "y"`,
+		`"x" = /a`,
+		`/a in "x"`,
+		`/a in ("x"`,
+		`/a between 1 or 2`,
+		`/a range "1,2"`,
+		`/a ~ "[bad"`,
+		`/a = "unterminated`,
+		`/a = 'unterminated`,
+		`/a = @`,
+	}
+
+	for _, test := range tests {
+		if _, err := parseFilterExpr(test); err == nil {
+			t.Errorf("Expected error parsing %q", test)
+		}
+	}
+}
+
+func TestParseDurationString(t *testing.T) {
+	tests := map[string]time.Duration{
+		"5m":      5 * time.Minute,
+		"1h30m":   90 * time.Minute,
+		"2d":      48 * time.Hour,
+		"1.5d":    36 * time.Hour,
+		"1d12h":   36 * time.Hour,
+		"1w1d1ms": 8*24*time.Hour + time.Millisecond,
+		"-1d":     -24 * time.Hour,
+	}
+	for in, exp := range tests {
+		got, err := parseDurationString(in)
+		if err != nil || got != exp {
+			t.Errorf("Expected %v for %v, got %v, %v", exp, in, got, err)
+		}
+	}
+	for _, bad := range []string{"", "-", "d", "5", "1d12", "1x"} {
+		if got, err := parseDurationString(bad); err == nil {
+			t.Errorf("Expected error for %q, got %v", bad, got)
+		}
+	}
+
+	// The filter syntax understands the same durations.
+	for in, exp := range tests {
+		if exp < 0 {
+			continue
+		}
+		s, err := newTokenStream(in)
+		if err != nil {
+			t.Fatalf("Error lexing %v: %v", in, err)
+		}
+		if got, err := parseDuration(s); err != nil || got != exp {
+			t.Errorf("Expected %v for %v, got %v, %v", exp, in, got, err)
+		}
+	}
+}
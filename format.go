@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// Query output formats.
+const (
+	formatJSON     = "json"
+	formatCSV      = "csv"
+	formatNDJSON   = "ndjson"
+	formatColumnar = "columnar"
+)
+
+// formatTypes maps the media types a client may ask for via Accept
+// to output formats.
+var formatTypes = map[string]string{
+	"application/json":     formatJSON,
+	"text/csv":             formatCSV,
+	"application/x-ndjson": formatNDJSON,
+	"application/ndjson":   formatNDJSON,
+}
+
+// A resultFormat encodes query results.
+type resultFormat interface {
+	contentType() string
+	begin(w io.Writer) error
+	write(w io.Writer, po *processOut) error
+	end(w io.Writer) error
+}
+
+// negotiateFormat picks the output format for a query from the
+// format parameter or, failing that, the Accept header.
+func negotiateFormat(req *http.Request) (string, error) {
+	if f := req.FormValue("format"); f != "" {
+		switch f {
+		case formatJSON, formatCSV, formatNDJSON, formatColumnar:
+			return f, nil
+		}
+		return "", paramError{"Bad format value", f}
+	}
+	for _, a := range strings.Split(req.Header.Get("Accept"), ",") {
+		if i := strings.IndexByte(a, ';'); i >= 0 {
+			a = a[:i]
+		}
+		if f, ok := formatTypes[strings.TrimSpace(a)]; ok {
+			return f, nil
+		}
+	}
+	return formatJSON, nil
+}
+
+func newResultFormat(format string, q *queryIn) resultFormat {
+	switch format {
+	case formatCSV:
+		return &csvFormat{q: q}
+	case formatNDJSON:
+		return ndjsonFormat{q.columnNames()}
+	case formatColumnar:
+		return &columnarFormat{q: q}
+	}
+	return &jsonFormat{names: q.columnNames()}
+}
+
+// queryOutput writes query results in the format the client asked
+// for.  Nothing is sent to the client until the first result is
+// written.
+type queryOutput struct {
+	w      http.ResponseWriter
+	req    *http.Request
+	format resultFormat
+	gz     *gzippingWriter
+	output io.Writer
+}
+
+func newQueryOutput(w http.ResponseWriter, req *http.Request,
+	q *queryIn) (*queryOutput, error) {
+
+	format, err := negotiateFormat(req)
+	if err != nil {
+		return nil, err
+	}
+	return &queryOutput{w: w, req: req, format: newResultFormat(format, q)}, nil
+}
+
+func (o *queryOutput) begin() {
+	if o.gz == nil {
+		if ct := o.format.contentType(); ct != "" {
+			o.w.Header().Set("Content-Type", ct)
+		}
+		o.gz = newGzippingWriter(o.w, o.req)
+		o.output = o.gz
+		o.w.WriteHeader(200)
+		o.format.begin(o.output)
+	}
+}
+
+func (o *queryOutput) write(po *processOut) error {
+	o.begin()
+	return o.format.write(o.output, po)
+}
+
+// writeAll writes a set of results, stopping at the first error.
+func (o *queryOutput) writeAll(results []*processOut) {
+	for _, po := range results {
+		if err := o.write(po); err != nil {
+			log.Printf("Error sending item: %v", err)
+			return
+		}
+	}
+}
+
+func (o *queryOutput) end() {
+	if o.gz != nil {
+		if err := o.format.end(o.output); err != nil {
+			log.Printf("Error finishing output: %v", err)
+		}
+		o.gz.Close()
+	}
+}
+
+// jsonFormat writes results as a JSON object keyed by the group
+// timestamp in milliseconds.
+type jsonFormat struct {
+	names   []string
+	written int
+}
+
+func (f *jsonFormat) contentType() string {
+	return ""
+}
+
+func (f *jsonFormat) begin(w io.Writer) error {
+	_, err := w.Write([]byte{'{'})
+	return err
+}
+
+func (f *jsonFormat) write(w io.Writer, po *processOut) error {
+	if f.written != 0 {
+		w.Write([]byte{',', '\n'})
+	}
+	f.written++
+
+	_, err := fmt.Fprintf(w, `"%d": `, po.key/1e6)
+	if err == nil {
+		var d []byte
+		d, err = json.Marshal(po.result(f.names))
+		if err == nil {
+			_, err = w.Write(d)
+		}
+	}
+	return err
+}
+
+func (f *jsonFormat) end(w io.Writer) error {
+	_, err := w.Write([]byte{'}'})
+	return err
+}
+
+// ndjsonFormat writes a JSON object per group on each line.
+type ndjsonFormat struct {
+	names []string
+}
+
+func (ndjsonFormat) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (ndjsonFormat) begin(w io.Writer) error {
+	return nil
+}
+
+func (f ndjsonFormat) write(w io.Writer, po *processOut) error {
+	field := "values"
+	if po.groups != nil {
+		field = "groups"
+	}
+	d, err := json.Marshal(po.result(f.names))
+	if err == nil {
+		_, err = fmt.Fprintf(w, "{\"time\":%d,\"%s\":%s}\n",
+			po.key/1e6, field, d)
+	}
+	return err
+}
+
+func (ndjsonFormat) end(w io.Writer) error {
+	return nil
+}
+
+// csvFormat writes a row per group with a header naming the columns.
+// Grouped results have a row per series within each group.
+type csvFormat struct {
+	q   *queryIn
+	csv *csv.Writer
+	// dest is where csv writes, which changes if the output is
+	// discarded after an error.
+	dest io.Writer
+}
+
+func (f *csvFormat) contentType() string {
+	return "text/csv"
+}
+
+// writer returns a CSV writer writing to w.  Rows are flushed as
+// they're written, so nothing is lost moving to a new writer.
+func (f *csvFormat) writer(w io.Writer) *csv.Writer {
+	if f.csv == nil || f.dest != w {
+		f.csv, f.dest = csv.NewWriter(w), w
+	}
+	return f.csv
+}
+
+func (f *csvFormat) begin(w io.Writer) error {
+	header := []string{"time"}
+	if f.q.grouped() {
+		header = append(header, "group")
+	}
+	for _, c := range f.q.columns() {
+		header = append(header, c.String())
+	}
+	f.writer(w).Write(header)
+	return nil
+}
+
+func (f *csvFormat) write(w io.Writer, po *processOut) error {
+	cw := f.writer(w)
+	t := strconv.FormatInt(po.key/1e6, 10)
+	if po.groups == nil {
+		cw.Write(csvRow([]string{t}, po.value))
+	} else {
+		for _, g := range sortedGroups(po.groups) {
+			cw.Write(csvRow([]string{t, g}, po.groups[g]))
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (f *csvFormat) end(w io.Writer) error {
+	cw := f.writer(w)
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvRow(row []string, vals []interface{}) []string {
+	for _, v := range vals {
+		switch x := v.(type) {
+		case nil:
+			row = append(row, "")
+		case string:
+			row = append(row, x)
+		default:
+			d, err := json.Marshal(x)
+			if err != nil {
+				d = nil
+			}
+			row = append(row, string(d))
+		}
+	}
+	return row
+}
+
+func sortedGroups(groups map[string][]interface{}) []string {
+	rv := make([]string, 0, len(groups))
+	for g := range groups {
+		rv = append(rv, g)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// columnarFormat collects results into an array of timestamps and
+// an array of values for each series.  Nothing is written until all
+// results have arrived.
+type columnarFormat struct {
+	q       *queryIn
+	results []*processOut
+}
+
+type columnarSeries struct {
+	Group   *string       `json:"group,omitempty"`
+	Alias   string        `json:"alias,omitempty"`
+	Ptr     string        `json:"ptr"`
+	Reducer string        `json:"reducer"`
+	Window  string        `json:"window,omitempty"`
+	Values  []interface{} `json:"values"`
+}
+
+func (f *columnarFormat) contentType() string {
+	return "application/json"
+}
+
+func (f *columnarFormat) begin(w io.Writer) error {
+	return nil
+}
+
+func (f *columnarFormat) write(w io.Writer, po *processOut) error {
+	f.results = append(f.results, po)
+	return nil
+}
+
+func (f *columnarFormat) end(w io.Writer) error {
+	if f.q.order == "" {
+		sortResults(f.results)
+	}
+	times := make([]int64, len(f.results))
+	for i, po := range f.results {
+		times[i] = po.key / 1e6
+	}
+
+	series := []columnarSeries{}
+	addSeries := func(group *string, rows func(*processOut) []interface{}) {
+		for col, c := range f.q.columns() {
+			vals := make([]interface{}, len(f.results))
+			for i, po := range f.results {
+				if row := rows(po); col < len(row) {
+					vals[i] = row[col]
+				}
+			}
+			series = append(series, columnarSeries{group,
+				c.alias, c.ptr, c.reducer, c.window, vals})
+		}
+	}
+
+	if f.q.grouped() {
+		names := map[string][]interface{}{}
+		for _, po := range f.results {
+			for g := range po.groups {
+				names[g] = nil
+			}
+		}
+		for _, g := range sortedGroups(names) {
+			g := g
+			addSeries(&g, func(po *processOut) []interface{} {
+				return po.groups[g]
+			})
+		}
+	} else {
+		addSeries(nil, func(po *processOut) []interface{} {
+			return po.value
+		})
+	}
+
+	d, err := json.Marshal(struct {
+		Timestamps []int64          `json:"timestamps"`
+		Series     []columnarSeries `json:"series"`
+	}{times, series})
+	if err == nil {
+		_, err = w.Write(d)
+	}
+	return err
+}
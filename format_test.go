@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		u      string
+		accept string
+		exp    string
+	}{
+		{"/db/_query", "", formatJSON},
+		{"/db/_query", "*/*", formatJSON},
+		{"/db/_query", "text/csv", formatCSV},
+		{"/db/_query", "text/html, application/x-ndjson;q=0.9", formatNDJSON},
+		{"/db/_query?format=columnar", "text/csv", formatColumnar},
+		{"/db/_query?format=csv", "", formatCSV},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", test.u, nil)
+		if err != nil {
+			t.Fatalf("Error creating request: %v", err)
+		}
+		req.Header.Set("Accept", test.accept)
+		got, err := negotiateFormat(req)
+		if err != nil || got != test.exp {
+			t.Errorf("Expected %v for %v with %q, got %v/%v",
+				test.exp, test.u, test.accept, got, err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/db/_query?format=xml", nil)
+	if got, err := negotiateFormat(req); err == nil {
+		t.Errorf("Expected error for xml format, got %v", got)
+	}
+}
+
+func TestResultFormats(t *testing.T) {
+	q := &queryIn{ptrs: []string{"/a", "/b"}, reds: []string{"avg", "any"}}
+	gq := &queryIn{ptrs: []string{"/a"}, reds: []string{"max"},
+		groupBy: []string{"/h"}}
+	results := []*processOut{
+		{key: 2e6, value: []interface{}{2.5, "x,y"}},
+		{key: 1e6, value: []interface{}{nil, map[string]int{"1": 2}}},
+	}
+	grouped := []*processOut{
+		{key: 1e6, groups: map[string][]interface{}{
+			"b": {1.0}, "a": {2.0}}},
+		{key: 2e6, groups: map[string][]interface{}{"b": {3.0}}},
+	}
+
+	tests := []struct {
+		format  string
+		q       *queryIn
+		results []*processOut
+		exp     string
+	}{
+		{formatJSON, q, results,
+			`{"2": [2.5,"x,y"],` + "\n" + `"1": [null,{"1":2}]}`},
+		{formatNDJSON, q, results,
+			`{"time":2,"values":[2.5,"x,y"]}` + "\n" +
+				`{"time":1,"values":[null,{"1":2}]}` + "\n"},
+		{formatNDJSON, gq, grouped[1:],
+			`{"time":2,"groups":{"b":[3]}}` + "\n"},
+		{formatCSV, q, results,
+			"time,avg(/a),any(/b)\n2,2.5,\"x,y\"\n1,,\"{\"\"1\"\":2}\"\n"},
+		{formatCSV, gq, grouped,
+			"time,group,max(/a)\n1,a,2\n1,b,1\n2,b,3\n"},
+		{formatColumnar, q, results,
+			`{"timestamps":[1,2],"series":[` +
+				`{"ptr":"/a","reducer":"avg","values":[null,2.5]},` +
+				`{"ptr":"/b","reducer":"any","values":[{"1":2},"x,y"]}]}`},
+		{formatColumnar, gq, grouped,
+			`{"timestamps":[1,2],"series":[` +
+				`{"group":"a","ptr":"/a","reducer":"max","values":[2,null]},` +
+				`{"group":"b","ptr":"/a","reducer":"max","values":[1,3]}]}`},
+	}
+
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		f := newResultFormat(test.format, test.q)
+		f.begin(buf)
+		for _, po := range append([]*processOut{}, test.results...) {
+			if err := f.write(buf, po); err != nil {
+				t.Fatalf("Error writing %v: %v", test.format, err)
+			}
+		}
+		if err := f.end(buf); err != nil {
+			t.Fatalf("Error ending %v: %v", test.format, err)
+		}
+		if buf.String() != test.exp {
+			t.Errorf("Expected %v output:\n%s\ngot:\n%s",
+				test.format, test.exp, buf.String())
+		}
+	}
+}
+
+type failingWriter struct{ n int }
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	f.n++
+	return 0, errors.New("broken connection")
+}
+
+func TestCSVFormatSwitchesWriter(t *testing.T) {
+	q := &queryIn{ptrs: []string{"/v"}, reds: []string{"sum"}}
+	f := &csvFormat{q: q}
+	broken := &failingWriter{}
+	f.begin(broken)
+	if err := f.write(broken, &processOut{key: 1e6,
+		value: []interface{}{1.0}}); err == nil {
+		t.Fatalf("Expected an error writing to a broken connection")
+	}
+
+	// Once the output is discarded, nothing more goes to the broken
+	// connection.
+	writes := broken.n
+	discard := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		if err := f.write(discard, &processOut{key: 2e6,
+			value: []interface{}{2.0}}); err != nil {
+			t.Errorf("Error writing after switching: %v", err)
+		}
+	}
+	if err := f.end(discard); err != nil {
+		t.Errorf("Error ending: %v", err)
+	}
+	if broken.n != writes {
+		t.Errorf("Expected no more writes to the broken connection, "+
+			"got %v more", broken.n-writes)
+	}
+	if exp := "2,2\n2,2\n2,2\n"; discard.String() != exp {
+		t.Errorf("Expected %q, got %q", exp, discard)
+	}
+}
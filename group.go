@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A grouper assigns timestamps (nanoseconds since the epoch) to the
+// time groups of a query.
+type grouper interface {
+	// bucket returns the start of the group containing t and the
+	// start of the following group.
+	bucket(t int64) (int64, int64)
+}
+
+// fixedGrouper groups into fixed size intervals, aligned to the
+// epoch in the grouper's location.  Intervals of an hour or more are
+// aligned to the local clock, like calendar groups, so they begin at
+// the same local times on both sides of a DST transition (and the
+// groups spanning one are an hour shorter or longer).
+type fixedGrouper struct {
+	size int64
+	loc  *time.Location
+}
+
+func (f fixedGrouper) bucket(t int64) (int64, int64) {
+	if f.loc == time.UTC {
+		g := (t / f.size) * f.size
+		return g, g + f.size
+	}
+	_, o := time.Unix(0, t).In(f.loc).Zone()
+	off := int64(o) * int64(time.Second)
+	k := (t + off) / f.size
+	if f.size < int64(time.Hour) {
+		g := k*f.size - off
+		return g, g + f.size
+	}
+
+	// The offset at t may not be the offset at the start or end of
+	// its group, so step to the group really containing t.
+	start, next := f.localStart(k), f.localStart(k+1)
+	for t < start {
+		k--
+		start, next = f.localStart(k), start
+	}
+	for t >= next {
+		k++
+		start, next = next, f.localStart(k+1)
+	}
+	return start, next
+}
+
+// localStart finds when the k'th interval since the local epoch
+// begins.
+func (f fixedGrouper) localStart(k int64) int64 {
+	w := time.Unix(0, k*f.size).UTC()
+	return time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(),
+		w.Second(), w.Nanosecond(), f.loc).UnixNano()
+}
+
+// calendarGrouper groups into calendar days, weeks (starting Monday),
+// months, quarters or years in the grouper's location, so groups
+// begin at local midnight regardless of DST transitions.
+type calendarGrouper struct {
+	unit string
+	loc  *time.Location
+}
+
+var calendarUnits = map[string]bool{
+	"day": true, "week": true, "month": true, "quarter": true, "year": true,
+}
+
+func (c calendarGrouper) bucket(t int64) (int64, int64) {
+	tm := time.Unix(0, t).In(c.loc)
+	y, m, d := tm.Date()
+	var start, next time.Time
+	switch c.unit {
+	case "day":
+		start = time.Date(y, m, d, 0, 0, 0, 0, c.loc)
+		next = time.Date(y, m, d+1, 0, 0, 0, 0, c.loc)
+	case "week":
+		d -= (int(tm.Weekday()) + 6) % 7
+		start = time.Date(y, m, d, 0, 0, 0, 0, c.loc)
+		next = time.Date(y, m, d+7, 0, 0, 0, 0, c.loc)
+	case "month":
+		start = time.Date(y, m, 1, 0, 0, 0, 0, c.loc)
+		next = time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc)
+	case "quarter":
+		m = ((m-1)/3)*3 + 1
+		start = time.Date(y, m, 1, 0, 0, 0, 0, c.loc)
+		next = time.Date(y, m+3, 1, 0, 0, 0, 0, c.loc)
+	case "year":
+		start = time.Date(y, 1, 1, 0, 0, 0, 0, c.loc)
+		next = time.Date(y+1, 1, 1, 0, 0, 0, 0, c.loc)
+	default:
+		panic("unhandled calendar unit: " + c.unit)
+	}
+	return start.UnixNano(), next.UnixNano()
+}
+
+// parseGrouper interprets the group and tz query parameters.  group
+// is either a number of milliseconds or a calendar unit (day, week,
+// month, quarter or year).  tz is an IANA time zone name and defaults
+// to UTC.
+func parseGrouper(group, tz string) (grouper, error) {
+	loc, err := loadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+
+	if calendarUnits[group] {
+		return calendarGrouper{group, loc}, nil
+	}
+	ms, err := strconv.Atoi(group)
+	if err != nil {
+		return nil, paramError{"Bad group value", err.Error()}
+	}
+	return newFixedGrouper(time.Duration(ms)*time.Millisecond, loc)
+}
+
+func loadLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, paramError{"Bad tz value", err.Error()}
+	}
+	return loc, nil
+}
+
+func newFixedGrouper(d time.Duration, loc *time.Location) (grouper, error) {
+	if d < time.Millisecond {
+		return nil, paramError{"Bad group value",
+			fmt.Sprintf("group must be at least one millisecond, was %v", d)}
+	}
+	return fixedGrouper{int64(d), loc}, nil
+}
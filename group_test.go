@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupers(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+
+	ts := func(s string) time.Time {
+		rv, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", s, err)
+		}
+		return rv
+	}
+
+	tests := []struct {
+		g           grouper
+		in          string
+		start, next string
+	}{
+		{fixedGrouper{int64(time.Hour), time.UTC},
+			"2020-03-08T12:34:56Z", "2020-03-08T12:00:00Z", "2020-03-08T13:00:00Z"},
+		{fixedGrouper{int64(time.Hour), kolkata},
+			"2020-03-08T12:34:56Z", "2020-03-08T12:30:00Z", "2020-03-08T13:30:00Z"},
+		// Fixed intervals of an hour or more keep to the local
+		// clock across DST transitions.
+		{fixedGrouper{int64(6 * time.Hour), ny},
+			"2020-03-08T12:34:56Z", "2020-03-08T10:00:00Z", "2020-03-08T16:00:00Z"},
+		{fixedGrouper{int64(6 * time.Hour), ny},
+			"2020-03-08T06:30:00Z", "2020-03-08T05:00:00Z", "2020-03-08T10:00:00Z"},
+		{fixedGrouper{int64(6 * time.Hour), ny},
+			"2020-03-08T04:59:59Z", "2020-03-07T23:00:00Z", "2020-03-08T05:00:00Z"},
+		{fixedGrouper{int64(24 * time.Hour), ny},
+			"2020-03-08T12:34:56Z", "2020-03-08T05:00:00Z", "2020-03-09T04:00:00Z"},
+		// DST ends on 2020-11-01, repeating 1am.
+		{fixedGrouper{int64(time.Hour), ny},
+			"2020-11-01T06:30:00Z", "2020-11-01T05:00:00Z", "2020-11-01T07:00:00Z"},
+		{fixedGrouper{int64(time.Hour), ny},
+			"2020-11-01T07:30:00Z", "2020-11-01T07:00:00Z", "2020-11-01T08:00:00Z"},
+		{fixedGrouper{int64(30 * time.Minute), ny},
+			"2020-11-01T06:40:00Z", "2020-11-01T06:30:00Z", "2020-11-01T07:00:00Z"},
+		{calendarGrouper{"day", time.UTC},
+			"2020-03-08T12:34:56Z", "2020-03-08T00:00:00Z", "2020-03-09T00:00:00Z"},
+		// DST starts in New York on 2020-03-08, making it 23 hours long.
+		{calendarGrouper{"day", ny},
+			"2020-03-08T12:34:56Z", "2020-03-08T05:00:00Z", "2020-03-09T04:00:00Z"},
+		{calendarGrouper{"day", ny},
+			"2020-03-08T03:00:00Z", "2020-03-07T05:00:00Z", "2020-03-08T05:00:00Z"},
+		{calendarGrouper{"week", time.UTC},
+			"2020-03-08T12:34:56Z", "2020-03-02T00:00:00Z", "2020-03-09T00:00:00Z"},
+		{calendarGrouper{"week", time.UTC},
+			"2020-03-09T00:00:00Z", "2020-03-09T00:00:00Z", "2020-03-16T00:00:00Z"},
+		{calendarGrouper{"month", ny},
+			"2020-03-01T03:00:00Z", "2020-02-01T05:00:00Z", "2020-03-01T05:00:00Z"},
+		{calendarGrouper{"month", time.UTC},
+			"2020-12-31T23:59:59Z", "2020-12-01T00:00:00Z", "2021-01-01T00:00:00Z"},
+		{calendarGrouper{"quarter", time.UTC},
+			"2020-08-15T00:00:00Z", "2020-07-01T00:00:00Z", "2020-10-01T00:00:00Z"},
+		{calendarGrouper{"year", time.UTC},
+			"2020-08-15T00:00:00Z", "2020-01-01T00:00:00Z", "2021-01-01T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		start, next := test.g.bucket(ts(test.in).UnixNano())
+		if start != ts(test.start).UnixNano() || next != ts(test.next).UnixNano() {
+			t.Errorf("Expected %v-%v for %v in %v, got %v-%v",
+				test.start, test.next, test.in, test.g,
+				time.Unix(0, start).UTC(), time.Unix(0, next).UTC())
+		}
+	}
+}
+
+// Consecutive groups must tile time without gaps or overlaps, even
+// across DST transitions.
+func TestFixedGrouperDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("No time zone data: %v", err)
+	}
+	for _, size := range []time.Duration{30 * time.Minute, time.Hour,
+		90 * time.Minute, 6 * time.Hour, 24 * time.Hour} {
+
+		g := fixedGrouper{int64(size), ny}
+		for _, day := range []string{"2020-03-08", "2020-11-01"} {
+			d, _ := time.Parse("2006-01-02", day)
+			from, to := d.Add(-48*time.Hour), d.Add(48*time.Hour)
+			prev, prevEnd := g.bucket(from.UnixNano())
+			for tm := from; tm.Before(to); tm = tm.Add(10 * time.Minute) {
+				start, end := g.bucket(tm.UnixNano())
+				if start > tm.UnixNano() || end <= tm.UnixNano() {
+					t.Fatalf("%v group %v-%v doesn't contain %v", size,
+						time.Unix(0, start).UTC(), time.Unix(0, end).UTC(), tm)
+				}
+				if start != prev && start != prevEnd {
+					t.Fatalf("%v group %v doesn't follow %v-%v", size,
+						time.Unix(0, start).UTC(), time.Unix(0, prev).UTC(),
+						time.Unix(0, prevEnd).UTC())
+				}
+				prev, prevEnd = start, end
+			}
+		}
+	}
+}
+
+func TestParseGrouper(t *testing.T) {
+	g, err := parseGrouper("60000", "")
+	if err != nil || g != (fixedGrouper{int64(time.Minute), time.UTC}) {
+		t.Errorf("Expected one minute grouping, got %v/%v", g, err)
+	}
+	g, err = parseGrouper("month", "UTC")
+	if err != nil || g != (calendarGrouper{"month", time.UTC}) {
+		t.Errorf("Expected monthly grouping, got %v/%v", g, err)
+	}
+
+	for _, bad := range [][2]string{
+		{"", ""},
+		{"0", ""},
+		{"-5", ""},
+		{"fortnight", ""},
+		{"day", "Not/AZone"},
+	} {
+		if g, err := parseGrouper(bad[0], bad[1]); err == nil {
+			t.Errorf("Expected error for %v, got %v", bad, g)
+		}
+	}
+}
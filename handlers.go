@@ -110,115 +110,326 @@ func cleanupRangeParam(in, def string) (string, error) {
 	return t.UTC().Format(time.RFC3339Nano), nil
 }
 
-func query(args []string, w http.ResponseWriter, req *http.Request) {
-	// Parse the params
+// A paramError reports a bad query parameter.  It's emitted as a 400
+// with the title as the error and the reason as the reason.
+type paramError struct {
+	title, reason string
+}
 
-	req.ParseForm()
+func (p paramError) Error() string {
+	return p.title + ": " + p.reason
+}
+
+func emitQueryError(w http.ResponseWriter, err error) {
+	if pe, ok := err.(paramError); ok {
+		emitError(400, w, pe.title, pe.reason)
+	} else {
+		emitError(500, w, "Error building query", err.Error())
+	}
+}
+
+// validateReducers checks that every reducer named in a query exists
+// and has valid arguments.
+func validateReducers(reds []string) error {
+	for _, r := range reds {
+		_, err := findReducer(r)
+		if err == errNoSuchReducer {
+			return paramError{"No such reducer", r}
+		} else if err != nil {
+			return paramError{"Bad reducer arguments", err.Error()}
+		}
+	}
+	return nil
+}
 
-	group, err := strconv.Atoi(req.FormValue("group"))
+func parseQueryParams(dbname string, req *http.Request) (*queryIn, error) {
+	grouper, err := parseGrouper(req.FormValue("group"), req.FormValue("tz"))
 	if err != nil {
-		emitError(400, w, "Bad group value", err.Error())
-		return
+		return nil, err
 	}
 
 	from, err := cleanupRangeParam(req.FormValue("from"), "")
 	if err != nil {
-		emitError(400, w, "Bad from value", err.Error())
-		return
+		return nil, paramError{"Bad from value", err.Error()}
 	}
 	to, err := cleanupRangeParam(req.FormValue("to"), "")
 	if err != nil {
-		emitError(400, w, "Bad to value", err.Error())
-		return
+		return nil, paramError{"Bad to value", err.Error()}
 	}
 
 	ptrs := req.Form["ptr"]
-	reds := make([]string, 0, len(ptrs))
-	for _, r := range req.Form["reducer"] {
-		_, ok := reducers[r]
-		if !ok {
-			emitError(400, w, "No such reducer", r)
-			return
-		}
-		reds = append(reds, r)
+	reds := req.Form["reducer"]
+	if err := validateReducers(reds); err != nil {
+		return nil, err
 	}
 
 	if len(ptrs) < 1 {
-		emitError(400, w, "Pointer required",
-			"At least one ptr argument is required")
-		return
+		return nil, paramError{"Pointer required",
+			"At least one ptr argument is required"}
 	}
 
 	if len(ptrs) != len(reds) {
-		emitError(400, w, "Parameter mismatch",
-			"Must supply the same number of pointers and reducers")
-		return
+		return nil, paramError{"Parameter mismatch",
+			"Must supply the same number of pointers and reducers"}
+	}
+
+	if _, err := parsePointerExprs(ptrs); err != nil {
+		return nil, err
 	}
 
-	filters := req.Form["f"]
+	filterptrs := req.Form["f"]
 	filtervals := req.Form["fv"]
-	if len(filters) != len(filtervals) {
-		emitError(400, w, "Parameter mismatch",
-			"Must supply the same number of filters and filter values")
+	filterops := req.Form["fo"]
+	if len(filterptrs) != len(filtervals) {
+		return nil, paramError{"Parameter mismatch",
+			"Must supply the same number of filters and filter values"}
+	}
+	if len(filterops) > 0 && len(filterops) != len(filterptrs) {
+		return nil, paramError{"Parameter mismatch",
+			"Must supply the same number of filters and filter operators"}
+	}
+
+	filters := make([]filterExpr, 0, len(filterptrs)+1)
+	for i, p := range filterptrs {
+		op := ""
+		if len(filterops) > 0 {
+			op = filterops[i]
+		}
+		f, err := parseFilter(p, op, filtervals[i])
+		if err != nil {
+			return nil, paramError{"Bad filter", err.Error()}
+		}
+		filters = append(filters, &f)
+	}
+
+	if where := req.FormValue("where"); where != "" {
+		f, err := parseFilterExpr(where)
+		if err == nil {
+			var conds []timeCond
+			f, conds, err = splitTimeConds(f)
+			if err == nil {
+				from, to = narrowRange(from, to, conds)
+			}
+		}
+		if err != nil {
+			return nil, paramError{"Bad filter expression", err.Error()}
+		}
+		filters = append(filters, f)
+	}
+
+	fill := req.FormValue("fill")
+	if fill != "" && !fillModes[fill] {
+		return nil, paramError{"Bad fill value", fill}
+	}
+
+	order, limit, err := parseOrder(req.FormValue("order"),
+		req.FormValue("limit"))
+	if err != nil {
+		return nil, err
+	}
+
+	windows, err := parseWindows(req.Form["window"], len(ptrs))
+	if err != nil {
+		return nil, err
+	}
+
+	aliases, err := parseAliases(req.Form["alias"], len(ptrs)+len(windows))
+	if err != nil {
+		return nil, err
+	}
+
+	offsets, err := parseOffsets(req.Form["offset"])
+	if err != nil {
+		return nil, err
+	}
+
+	rank, err := parseRanking(req.FormValue("top"), req.FormValue("bottom"),
+		req.FormValue("rank_by"), len(ptrs)+len(windows))
+	if err != nil {
+		return nil, err
+	}
+
+	q := &queryIn{
+		dbname:  dbname,
+		from:    from,
+		to:      to,
+		grouper: grouper,
+		ptrs:    ptrs,
+		reds:    reds,
+		filter:  andFilters(filters...),
+		groupBy: req.Form["group_by"],
+		fill:    fill,
+		order:   order,
+		limit:   limit,
+		windows: windows,
+		aliases: aliases,
+		offsets: offsets,
+		rank:    rank,
+		explain: req.FormValue("explain") == "true",
+	}
+	if err := q.checkColumnNames(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func query(args []string, w http.ResponseWriter, req *http.Request) {
+	// Parse the params
+
+	req.ParseForm()
+
+	q, err := parseQueryParams(args[0], req)
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	out, err := newQueryOutput(w, req, q)
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+
+	if len(q.offsets) > 0 {
+		offsetQuery(out, q, req)
+		return
+	}
+	streamQuery(out, executeQuery(req.Context(), q))
+}
+
+func sqlQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	text := req.FormValue("q")
+	if text == "" && req.Method == "POST" {
+		defer req.Body.Close()
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			emitError(400, w, "Bad Request",
+				fmt.Sprintf("Error reading body: %v", err))
+			return
+		}
+		text = string(body)
+	}
+
+	q, err := parseSQL(text)
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	if req.FormValue("explain") == "true" {
+		q.explain = true
+	}
+	out, err := newQueryOutput(w, req, q)
+	if err != nil {
+		emitQueryError(w, err)
 		return
 	}
 
-	q := executeQuery(args[0], from, to, group, ptrs, reds, filters, filtervals)
+	streamQuery(out, executeQuery(req.Context(), q))
+}
+
+// awaitQuery passes each result of an executing query to f as it
+// arrives and returns the traversal error, if any, once every
+// result has been received.
+func awaitQuery(q *queryIn, f func(*processOut)) error {
+	defer q.cancel()
 	defer close(q.out)
 	defer close(q.cherr)
 
-	output := io.Writer(newGzippingWriter(w, req))
-	defer output.(io.Closer).Close()
+	var assembler *partialAssembler
+	if q.partial != nil {
+		assembler = newPartialAssembler(q.partial)
+	}
 
+	var walkErr error
 	going := true
 	finished := int32(0)
-	started := false
 	walkComplete := false
 	for going {
 		select {
 		case po := <-q.out:
-			if !started {
-				started = true
-				w.WriteHeader(200)
-				output.Write([]byte{'{'})
-			}
-			if finished != 0 {
-				output.Write([]byte{',', '\n'})
-			}
 			finished++
-
-			_, err := fmt.Fprintf(output, `"%d": `, po.key/1e6)
-			if err == nil {
-				var d []byte
-				d, err = json.Marshal(po.value)
-				if err == nil {
-					_, err = output.Write(d)
-				}
+			if po.parts > 0 {
+				po = assembler.add(po)
 			}
-			if err != nil {
-				log.Printf("Error sending item: %v", err)
-				output = ioutil.Discard
-				q.before = time.Time{}
+			if po != nil {
+				f(po)
 			}
-		case err = <-q.cherr:
+		case err := <-q.cherr:
 			if err != nil {
-				if !started {
-					w.WriteHeader(500)
-					w.Header().Set("Content-Type", "text/plain")
-					fmt.Fprintf(output, "Error beginning traversal: %v", err)
-				}
 				log.Printf("Walk completed with err: %v", err)
-				going = false
+				walkErr = err
 			}
 			walkComplete = true
 		}
 		going = (q.started-finished > 0) || !walkComplete
 	}
+	return walkErr
+}
+
+// streamQuery writes the results of an executing query as they
+// arrive, or once they've all arrived if the query needs its results
+// post-processed.  An explained query reports its statistics instead.
+func streamQuery(out *queryOutput, q *queryIn) {
+	w := out.w
+	buffered := q.needsPostProcessing() || q.explain
+	var results []*processOut
+
+	emit := func(po *processOut) {
+		if err := out.write(po); err != nil {
+			log.Printf("Error sending item: %v", err)
+			out.output = ioutil.Discard
+			q.cancel()
+		}
+	}
+	var seq *resultSequencer
+	if q.order == orderAsc {
+		seq = newResultSequencer()
+	}
 
-	if started {
-		output.Write([]byte{'}'})
+	walkErr := awaitQuery(q, func(po *processOut) {
+		switch {
+		case buffered:
+			results = append(results, po)
+		case seq != nil:
+			seq.add(po, emit)
+		default:
+			emit(po)
+		}
+	})
+
+	if walkErr != nil && out.gz == nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Error beginning traversal: %v", walkErr)
+	}
+
+	if buffered && walkErr == nil {
+		var err error
+		results, err = q.postProcess(results)
+		if err != nil {
+			emitQueryError(w, err)
+			return
+		}
+		if q.explain {
+			mustEncode(200, w, q.explanation(len(results)))
+			q.logCompletion()
+			return
+		}
+		out.writeAll(results)
 	}
 
+	if walkErr == nil {
+		// Empty results are still a complete response.
+		out.begin()
+	}
+	out.end()
+
+	q.logCompletion()
+}
+
+// logCompletion logs the statistics of a slow query.
+func (q *queryIn) logCompletion() {
 	duration := time.Since(q.start)
 	if duration > *minQueryLogDuration {
 		log.Printf("Completed query processing in %v, %v keys, %v chunks",
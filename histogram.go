@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerReducer(reducerInfo{
+		Name:        "histogram",
+		Description: "The number of values in each of a set of buckets",
+		Input:       inputNumber,
+		Mergeable:   true,
+		partial:     histogramPartial,
+		Args: "bucket boundaries: b1,b2,... or linear:start,width,count " +
+			"or exp:start,factor,count",
+		make: makeHistogram,
+	})
+}
+
+// makeHistogram builds a reducer counting values into buckets.
+//
+// Buckets are described by the reducer arguments in one of three
+// forms:
+//
+//	histogram:1,5,10,50              - explicit bucket boundaries
+//	histogram:linear:0,10,20         - start, width, count
+//	histogram:exp:1,2,16             - start, factor, count
+//
+// The result maps each bucket's lower boundary to the number of
+// values that fell into it.  Values below the first boundary are
+// counted under "-Inf".
+func makeHistogram(args string) (reducer, error) {
+	bounds, err := parseHistogramBounds(args)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(input chan ptrval) interface{} {
+		counts := make([]int, len(bounds)+1)
+		for v := range convertTofloat64(input) {
+			counts[sort.Search(len(bounds), func(i int) bool {
+				return bounds[i] > v
+			})]++
+		}
+		rv := make(map[string]int, len(counts))
+		rv["-Inf"] = counts[0]
+		for i, b := range bounds {
+			rv[strconv.FormatFloat(b, 'g', -1, 64)] = counts[i+1]
+		}
+		return rv
+	}, nil
+}
+
+func parseFloats(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	rv := make([]float64, 0, len(parts))
+	for _, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		rv = append(rv, f)
+	}
+	return rv, nil
+}
+
+func parseHistogramBounds(args string) ([]float64, error) {
+	kind := "explicit"
+	if i := strings.Index(args, ":"); i >= 0 {
+		kind, args = args[:i], args[i+1:]
+	}
+
+	nums, err := parseFloats(args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid histogram argument: %v", err)
+	}
+
+	var bounds []float64
+	switch kind {
+	case "explicit":
+		bounds = nums
+	case "linear", "exp":
+		if len(nums) != 3 {
+			return nil, fmt.Errorf("%v histogram requires start, step and count",
+				kind)
+		}
+		n := int(nums[2])
+		if n < 1 || float64(n) != nums[2] {
+			return nil, fmt.Errorf("invalid histogram bucket count: %v",
+				nums[2])
+		}
+		if kind == "exp" && (nums[0] <= 0 || nums[1] <= 1) {
+			return nil, fmt.Errorf("exp histogram requires start > 0 and factor > 1")
+		}
+		bounds = make([]float64, n)
+		for i := range bounds {
+			if kind == "linear" {
+				bounds[i] = nums[0] + float64(i)*nums[1]
+			} else {
+				bounds[i] = nums[0] * math.Pow(nums[1], float64(i))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown histogram kind: %v", kind)
+	}
+
+	for i := range bounds {
+		if math.IsNaN(bounds[i]) || math.IsInf(bounds[i], 0) ||
+			(i > 0 && bounds[i] <= bounds[i-1]) {
+			return nil, fmt.Errorf("histogram boundaries must be finite and increasing")
+		}
+	}
+	return bounds, nil
+}
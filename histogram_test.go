@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHistogramReducer(t *testing.T) {
+	tests := []struct {
+		reducer string
+		exp     map[string]int
+	}{
+		{"histogram:20,40,60", map[string]int{
+			"-Inf": 1, "20": 1, "40": 0, "60": 1}},
+		{"histogram:linear:0,25,3", map[string]int{
+			"-Inf": 0, "0": 1, "25": 1, "50": 1}},
+		{"histogram:exp:1,4,3", map[string]int{
+			"-Inf": 0, "1": 0, "4": 0, "16": 3}},
+	}
+
+	for _, test := range tests {
+		r, err := findReducer(test.reducer)
+		if err != nil {
+			t.Fatalf("Error finding %v: %v", test.reducer, err)
+		}
+		got := r(streamCollection(testInput))
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %v, got %v",
+				test.exp, test.reducer, got)
+		}
+	}
+}
+
+func TestHistogramBadArgs(t *testing.T) {
+	tests := []string{
+		"histogram",
+		"histogram:",
+		"histogram:10,5",
+		"histogram:a,b",
+		"histogram:linear:0,10",
+		"histogram:linear:0,0,5",
+		"histogram:linear:0,10,2.5",
+		"histogram:exp:0,2,5",
+		"histogram:exp:1,1,5",
+		"histogram:log:1,2,3",
+	}
+
+	for _, test := range tests {
+		if _, err := findReducer(test); err == nil {
+			t.Errorf("Expected error for %v", test)
+		}
+	}
+	if _, err := findReducer("nonexistent:1"); err != errNoSuchReducer {
+		t.Errorf("Expected no such reducer, got %v", err)
+	}
+}
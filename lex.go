@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokEOF = tokenType(iota)
+	tokPointer
+	tokString
+	tokNumber
+	tokIdent
+	tokSymbol
+)
+
+type token struct {
+	typ tokenType
+	val string
+	pos int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return strconv.Quote(t.val)
+	}
+	return t.val
+}
+
+// is reports whether the token is the given symbol or the given
+// keyword (case insensitive).
+func (t token) is(s string) bool {
+	switch t.typ {
+	case tokSymbol:
+		return t.val == s
+	case tokIdent:
+		return strings.EqualFold(t.val, s)
+	}
+	return false
+}
+
+// pointerEnd reports whether in[i] terminates a JSON pointer in an
+// expression.  Pointers otherwise run until whitespace, so arithmetic
+// on pointers needs surrounding spaces when the operator could be
+// part of a key (e.g. "/a - /b").  A ~ followed by 0 or 1 is an
+// escape within the pointer (e.g. "/a~1b") rather than a regular
+// expression match.
+func pointerEnd(in string, i int) bool {
+	if in[i] == '~' && i+1 < len(in) && (in[i+1] == '0' || in[i+1] == '1') {
+		return false
+	}
+	return strings.IndexByte(" \t\r\n()[],=!<>~*\"'", in[i]) >= 0
+}
+
+// wildcardAt reports whether a * in a pointer is a whole segment,
+// making it a wildcard rather than multiplication.
+func wildcardAt(in string, i int) bool {
+	return in[i] == '*' && in[i-1] == '/' &&
+		(i+1 == len(in) || in[i+1] == '/' || pointerEnd(in, i+1))
+}
+
+// lex splits an expression into tokens.
+//
+// A / followed by anything that can't end a pointer begins a JSON
+// pointer, otherwise it's the division symbol.
+func lex(in string) ([]token, error) {
+	rv := []token{}
+	for i := 0; i < len(in); {
+		c := in[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+			continue
+		case c == '/' && i+1 < len(in) && !pointerEnd(in, i+1) &&
+			in[i+1] != '/':
+			i++
+			for i < len(in) && (!pointerEnd(in, i) || wildcardAt(in, i)) {
+				i++
+			}
+			rv = append(rv, token{tokPointer, in[start:i], start})
+		case c == '"':
+			i++
+			for i < len(in) && in[i] != '"' {
+				if in[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(in) {
+				return nil, fmt.Errorf("unterminated string at %v", start)
+			}
+			i++
+			s, err := strconv.Unquote(in[start:i])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %v: %v", start, err)
+			}
+			rv = append(rv, token{tokString, s, start})
+		case c == '\'':
+			i++
+			for i < len(in) && in[i] != '\'' {
+				i++
+			}
+			if i >= len(in) {
+				return nil, fmt.Errorf("unterminated string at %v", start)
+			}
+			i++
+			rv = append(rv, token{tokString, in[start+1 : i-1], start})
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(in) &&
+			in[i+1] >= '0' && in[i+1] <= '9':
+			i++
+			for i < len(in) && (in[i] >= '0' && in[i] <= '9' ||
+				in[i] == '.' || in[i] == 'e' || in[i] == 'E' ||
+				(in[i] == '-' || in[i] == '+') &&
+					(in[i-1] == 'e' || in[i-1] == 'E')) {
+				i++
+			}
+			rv = append(rv, token{tokNumber, in[start:i], start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			i++
+			for i < len(in) && (in[i] == '_' ||
+				unicode.IsLetter(rune(in[i])) ||
+				unicode.IsDigit(rune(in[i]))) {
+				i++
+			}
+			rv = append(rv, token{tokIdent, in[start:i], start})
+		default:
+			i++
+			if i < len(in) && in[i] == '=' &&
+				strings.IndexByte("=!<>", c) >= 0 {
+				i++
+			}
+			if strings.IndexByte("()[],=!<>~*+-/%", c) < 0 {
+				return nil, fmt.Errorf("unexpected %q at %v", c, start)
+			}
+			rv = append(rv, token{tokSymbol, in[start:i], start})
+		}
+	}
+	return append(rv, token{tokEOF, "", len(in)}), nil
+}
+
+// tokenStream provides the lookahead needed by the hand written
+// parsers built on lex.
+type tokenStream struct {
+	toks []token
+	pos  int
+}
+
+func newTokenStream(in string) (*tokenStream, error) {
+	toks, err := lex(in)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenStream{toks: toks}, nil
+}
+
+func (s *tokenStream) peek() token {
+	return s.toks[s.pos]
+}
+
+func (s *tokenStream) next() token {
+	t := s.toks[s.pos]
+	if t.typ != tokEOF {
+		s.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is the given symbol or keyword.
+func (s *tokenStream) accept(sym string) bool {
+	if s.peek().is(sym) {
+		s.next()
+		return true
+	}
+	return false
+}
+
+func (s *tokenStream) expect(sym string) error {
+	if !s.accept(sym) {
+		return s.errorf("expected %v", sym)
+	}
+	return nil
+}
+
+func (s *tokenStream) errorf(f string, args ...interface{}) error {
+	t := s.peek()
+	return fmt.Errorf("%v at %v, found %v", fmt.Sprintf(f, args...),
+		t.pos, t)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp []string
+	}{
+		{`/a/b = "x y"`, []string{"/a/b", "=", `"x y"`, ""}},
+		{`/used*100/ /total`, []string{"/used", "*", "100", "/", "/total", ""}},
+		{`/a/0 >= -1.5e3`, []string{"/a/0", ">=", "-", "1.5e3", ""}},
+		{`(/x-y != 'q')`, []string{"(", "/x-y", "!=", `"q"`, ")", ""}},
+		{`NOT /a in (1,2)`, []string{"NOT", "/a", "in", "(", "1", ",", "2", ")", ""}},
+		{`/cpu/*/user * 2`, []string{"/cpu/*/user", "*", "2", ""}},
+		{`/a/*/*`, []string{"/a/*/*", ""}},
+		{`/a/*2`, []string{"/a/", "*", "2", ""}},
+		{`/a~1b = 1`, []string{"/a~1b", "=", "1", ""}},
+		{`/x~0y/z`, []string{"/x~0y/z", ""}},
+		{`/~1a`, []string{"/~1a", ""}},
+		{`/a ~ "x"`, []string{"/a", "~", `"x"`, ""}},
+		{`/a~"x"`, []string{"/a", "~", `"x"`, ""}},
+	}
+
+	for _, test := range tests {
+		toks, err := lex(test.in)
+		if err != nil {
+			t.Errorf("Error lexing %v: %v", test.in, err)
+			continue
+		}
+		got := []string{}
+		for _, tok := range toks {
+			if tok.typ == tokEOF {
+				got = append(got, "")
+			} else {
+				got = append(got, tok.String())
+			}
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %q for %v, got %q", test.exp, test.in, got)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxWatchedKeys limits how many distinct committed keys a commit
+// watcher remembers.  Beyond that it only tracks their range.
+const maxWatchedKeys = 10000
+
+// liveKeepalive is how often an idle live query sends a comment to
+// keep the connection open through proxies.
+const liveKeepalive = 30 * time.Second
+
+// A commitWatcher collects the keys of documents committed to a
+// database until they're taken.  notify is signaled when there are
+// keys to take.
+type commitWatcher struct {
+	dbname string
+	notify chan struct{}
+
+	mu   sync.Mutex
+	keys map[string]bool
+	// lo and hi bound every key seen since the last take.
+	lo, hi string
+}
+
+var commitWatchers = struct {
+	sync.Mutex
+	m map[string]map[*commitWatcher]bool
+}{m: map[string]map[*commitWatcher]bool{}}
+
+func watchCommits(dbname string) *commitWatcher {
+	w := &commitWatcher{
+		dbname: dbname,
+		notify: make(chan struct{}, 1),
+		keys:   map[string]bool{},
+	}
+	commitWatchers.Lock()
+	defer commitWatchers.Unlock()
+	if commitWatchers.m[dbname] == nil {
+		commitWatchers.m[dbname] = map[*commitWatcher]bool{}
+	}
+	commitWatchers.m[dbname][w] = true
+	return w
+}
+
+func (w *commitWatcher) stop() {
+	commitWatchers.Lock()
+	defer commitWatchers.Unlock()
+	delete(commitWatchers.m[w.dbname], w)
+	if len(commitWatchers.m[w.dbname]) == 0 {
+		delete(commitWatchers.m, w.dbname)
+	}
+}
+
+func (w *commitWatcher) add(keys []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, k := range keys {
+		if w.lo == "" || k < w.lo {
+			w.lo = k
+		}
+		if k > w.hi {
+			w.hi = k
+		}
+		if w.keys != nil {
+			w.keys[k] = true
+			if len(w.keys) > maxWatchedKeys {
+				w.keys = nil
+			}
+		}
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the keys committed since the last take.  If there
+// were too many to remember, keys is nil and only their range is
+// known.
+func (w *commitWatcher) take() (keys []string, lo, hi string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys != nil {
+		keys = make([]string, 0, len(w.keys))
+		for k := range w.keys {
+			keys = append(keys, k)
+		}
+	}
+	lo, hi = w.lo, w.hi
+	w.keys, w.lo, w.hi = map[string]bool{}, "", ""
+	return keys, lo, hi
+}
+
+// notifyCommit tells everything watching a database which keys were
+// just committed to it.
+func notifyCommit(dbname string, keys []string) {
+	commitWatchers.Lock()
+	defer commitWatchers.Unlock()
+	for w := range commitWatchers.m[dbname] {
+		w.add(keys)
+	}
+}
+
+// keyString formats a group boundary in nanoseconds as a key.
+func keyString(ns int64) string {
+	return time.Unix(ns/1e9, ns%1e9).UTC().Format(time.RFC3339Nano)
+}
+
+// A keyRange is a span of whole groups, [from, to) in nanoseconds.
+type keyRange struct {
+	from, to int64
+}
+
+// liveRanges finds the groups of a query touched by committed keys,
+// coalescing adjacent groups.  touched lists each group's start, or
+// is nil if only the range of keys is known.
+func liveRanges(q *queryIn, keys []string, lo, hi string) (ranges []keyRange, touched []int64) {
+	inRange := func(k int64) bool {
+		return (q.from == "" || k >= parseKey(q.from)) &&
+			(q.to == "" || k <= parseKey(q.to))
+	}
+
+	if keys == nil {
+		if lo == "" {
+			return nil, nil
+		}
+		from, _ := q.grouper.bucket(parseKey(lo))
+		_, to := q.grouper.bucket(parseKey(hi))
+		return []keyRange{{from, to}}, nil
+	}
+
+	ends := map[int64]int64{}
+	for _, k := range keys {
+		if t := parseKey(k); inRange(t) {
+			start, next := q.grouper.bucket(t)
+			if _, seen := ends[start]; !seen {
+				ends[start] = next
+				touched = append(touched, start)
+			}
+		}
+	}
+	sort.Sort(int64s(touched))
+	for _, start := range touched {
+		if n := len(ranges); n > 0 && ranges[n-1].to == start {
+			ranges[n-1].to = ends[start]
+		} else {
+			ranges = append(ranges, keyRange{start, ends[start]})
+		}
+	}
+	return ranges, touched
+}
+
+type int64s []int64
+
+func (a int64s) Len() int           { return len(a) }
+func (a int64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a int64s) Less(i, j int) bool { return a[i] < a[j] }
+
+// lookaheadKey finds the key of the first document of a query at or
+// after t, or "" if there's none.  Re-querying groups ending at t up
+// to it gives the last of them the same lookahead as when they were
+// part of the whole query.
+func lookaheadKey(q *queryIn, t int64) (string, error) {
+	rv := ""
+	err := dbwalkKeys(q.dbname, keyString(t), q.to, func(k string) error {
+		rv = k
+		return errLimitReached
+	})
+	if err == errLimitReached {
+		err = nil
+	}
+	return rv, err
+}
+
+// collectQuery runs a copy of a query over [from, to] and returns its
+// results in ascending order.
+func collectQuery(ctx context.Context, tmpl queryIn, from, to string) ([]*processOut, error) {
+	q := tmpl
+	q.from, q.to = from, to
+	var results []*processOut
+	err := awaitQuery(executeQuery(ctx, &q), func(po *processOut) {
+		results = append(results, po)
+	})
+	sortResults(results)
+	return results, err
+}
+
+// sseWriter sends query results as server-sent events.
+type sseWriter struct {
+	w      http.ResponseWriter
+	format ndjsonFormat
+	buf    bytes.Buffer
+}
+
+func (s *sseWriter) event(name string, po *processOut) {
+	fmt.Fprintf(&s.buf, "event: %s\ndata: ", name)
+	s.format.write(&s.buf, po)
+	s.buf.WriteByte('\n')
+}
+
+func (s *sseWriter) removed(key int64) {
+	fmt.Fprintf(&s.buf, "event: remove\ndata: {\"time\":%d}\n\n", key/1e6)
+}
+
+func (s *sseWriter) flush() error {
+	_, err := s.buf.WriteTo(s.w)
+	if f, ok := s.w.(http.Flusher); ok && err == nil {
+		f.Flush()
+	}
+	return err
+}
+
+// liveQuery sends a query's results as server-sent events and then
+// keeps sending the new results of any groups changed by documents
+// committed to the database, until the client goes away.
+//
+// The initial results are "bucket" events followed by a "ready"
+// event.  Changed groups are sent as "update" events, and groups left
+// without any documents as "remove" events.
+func liveQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	q, err := parseQueryParams(args[0], req)
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	if q.needsPostProcessing() || q.limit > 0 || q.explain ||
+		len(q.offsets) > 0 {
+		emitQueryError(w, paramError{"Unsupported live query",
+			"live queries can't fill, order, limit, rank, offset, " +
+				"explain or use window functions"})
+		return
+	}
+
+	// Watch before the initial query so nothing committed while
+	// it runs is missed.
+	watcher := watchCommits(q.dbname)
+	defer watcher.stop()
+
+	ctx := req.Context()
+	tmpl := *q
+	results, err := collectQuery(ctx, tmpl, q.from, q.to)
+	if err != nil {
+		emitError(500, w, "Error running query", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	out := &sseWriter{w: w, format: ndjsonFormat{q.columnNames()}}
+	for _, po := range results {
+		out.event("bucket", po)
+	}
+	out.buf.WriteString("event: ready\ndata: {}\n\n")
+	if out.flush() != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(liveKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			out.buf.WriteString(": keepalive\n\n")
+		case <-watcher.notify:
+			keys, lo, hi := watcher.take()
+			ranges, touched := liveRanges(q, keys, lo, hi)
+			found := map[int64]bool{}
+			for _, r := range ranges {
+				from, to := r.from, r.to-1
+				if q.from != "" && parseKey(q.from) > from {
+					from = parseKey(q.from)
+				}
+				if q.to != "" && parseKey(q.to) < to {
+					to = parseKey(q.to)
+				}
+				if from > to {
+					continue
+				}
+				last := keyString(to)
+				if to == r.to-1 {
+					last, err = lookaheadKey(q, r.to)
+					if err != nil {
+						return
+					}
+					if last == "" {
+						last = keyString(to)
+					}
+				}
+				results, err := collectQuery(ctx, tmpl,
+					keyString(from), last)
+				if err != nil {
+					return
+				}
+				for _, po := range results {
+					// Skip the group of the lookahead.
+					if po.key >= r.to {
+						continue
+					}
+					found[po.key] = true
+					out.event("update", po)
+				}
+			}
+			for _, k := range touched {
+				if !found[k] {
+					out.removed(k)
+				}
+			}
+		}
+		if out.flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mschoch/gouchstore"
+)
+
+func TestCommitWatcher(t *testing.T) {
+	w := watchCommits("livetest")
+	notifyCommit("livetest", []string{"b", "a", "b"})
+	notifyCommit("other", []string{"z"})
+
+	select {
+	case <-w.notify:
+	default:
+		t.Fatalf("Expected a notification")
+	}
+	keys, lo, hi := w.take()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) || lo != "a" || hi != "b" {
+		t.Errorf("Expected keys a and b, got %v (%v-%v)", keys, lo, hi)
+	}
+
+	many := make([]string, maxWatchedKeys+1)
+	for i := range many {
+		many[i] = keyString(int64(i) * 1e9)
+	}
+	notifyCommit("livetest", many)
+	keys, lo, hi = w.take()
+	if keys != nil || lo != many[0] || hi != many[len(many)-1] {
+		t.Errorf("Expected only the range of too many keys, got %v keys, %v-%v",
+			len(keys), lo, hi)
+	}
+
+	w.stop()
+	notifyCommit("livetest", []string{"c"})
+	if keys, _, _ := w.take(); len(keys) != 0 {
+		t.Errorf("Expected nothing after stopping, got %v", keys)
+	}
+}
+
+func TestLiveRanges(t *testing.T) {
+	g, err := parseGrouper("60000", "")
+	if err != nil {
+		t.Fatalf("Error parsing grouper: %v", err)
+	}
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := func(d time.Duration) string {
+		return base.Add(d).Format(time.RFC3339Nano)
+	}
+	ns := func(d time.Duration) int64 { return base.Add(d).UnixNano() }
+
+	q := &queryIn{grouper: g, from: key(time.Minute)}
+	keys := []string{
+		key(5*time.Minute + time.Second),
+		key(time.Minute + 30*time.Second),
+		key(2*time.Minute + 10*time.Second),
+		key(2 * time.Minute),
+		key(0),
+	}
+	ranges, touched := liveRanges(q, keys, "", "")
+	expRanges := []keyRange{
+		{ns(time.Minute), ns(3 * time.Minute)},
+		{ns(5 * time.Minute), ns(6 * time.Minute)},
+	}
+	if !reflect.DeepEqual(ranges, expRanges) {
+		t.Errorf("Expected ranges %v, got %v", expRanges, ranges)
+	}
+	expTouched := []int64{ns(time.Minute), ns(2 * time.Minute), ns(5 * time.Minute)}
+	if !reflect.DeepEqual(touched, expTouched) {
+		t.Errorf("Expected touched %v, got %v", expTouched, touched)
+	}
+
+	ranges, touched = liveRanges(q, nil, key(90*time.Second), key(10*time.Minute))
+	expRanges = []keyRange{{ns(time.Minute), ns(11 * time.Minute)}}
+	if !reflect.DeepEqual(ranges, expRanges) || touched != nil {
+		t.Errorf("Expected ranges %v, got %v (%v)", expRanges, ranges, touched)
+	}
+}
+
+var testPipeline sync.Once
+
+// startTestPipeline starts the workers running queries, without a
+// cache.
+func startTestPipeline() {
+	testPipeline.Do(func() {
+		processorInput = make(chan *processIn)
+		cacheInput = processorInput
+		for i := 0; i < 4; i++ {
+			go docProcessor(processorInput)
+		}
+		queryInput = make(chan *queryIn)
+		for i := 0; i < 2; i++ {
+			go queryExecutor()
+		}
+	})
+}
+
+func TestLiveRateUpdate(t *testing.T) {
+	root, err := ioutil.TempDir("", "seriesly")
+	if err != nil {
+		t.Fatalf("Error making temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	defer func(r string, f time.Duration) {
+		*dbRoot, *flushTime = r, f
+	}(*dbRoot, *flushTime)
+	*dbRoot, *flushTime = root, 10*time.Millisecond
+	startTestPipeline()
+	// Stop the writer dbstore starts before the flags it reads are
+	// restored.
+	defer func() {
+		dbRemoveConn("live")
+		dbWg.Wait()
+	}()
+
+	// A counter every 30s, grouped by minute.
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := func(d time.Duration) string {
+		return base.Add(d).Format(time.RFC3339Nano)
+	}
+	if err := dbcreate(dbPath("live")); err != nil {
+		t.Fatalf("Error creating db: %v", err)
+	}
+	db, err := dbopen("live")
+	if err != nil {
+		t.Fatalf("Error opening db: %v", err)
+	}
+	bulk := db.Bulk()
+	for i := 0; i < 6; i++ {
+		k := key(time.Duration(i) * 30 * time.Second)
+		bulk.Set(gouchstore.NewDocumentInfo(k), gouchstore.NewDocument(k,
+			[]byte(fmt.Sprintf(`{"v": %d}`, i*10))))
+	}
+	bulk.Commit()
+	bulk.Close()
+	closeDBConn(db)
+
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			liveQuery([]string{"live"}, w, req)
+		}))
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/live/_live?ptr=/v&reducer=c&group=60000")
+	if err != nil {
+		t.Fatalf("Error starting live query: %v", err)
+	}
+	defer res.Body.Close()
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		r := bufio.NewReader(res.Body)
+		event := ""
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			l = strings.TrimSpace(l)
+			switch {
+			case l == "event: ready":
+				events <- "ready"
+			case strings.HasPrefix(l, "event: "):
+				event = l[len("event: "):]
+			case strings.HasPrefix(l, "data: ") && event == "update":
+				events <- l[len("data: "):]
+			}
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	next := func() string {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("Live query ended")
+			}
+			return e
+		case <-timeout:
+			t.Fatalf("Timed out waiting for live query")
+		}
+		return ""
+	}
+	if e := next(); e != "ready" {
+		t.Fatalf("Expected ready, got %v", e)
+	}
+
+	// The updated group's rate runs up to the next group's first
+	// document, just as in the whole query.
+	if err := dbstore("live", key(75*time.Second), []byte(`{"v": 25}`)); err != nil {
+		t.Fatalf("Error storing: %v", err)
+	}
+	got := next()
+
+	q, err := parseQueryParams("live", httptest.NewRequest("GET",
+		"/live/_query?ptr=/v&reducer=c&group=60000", nil))
+	if err != nil {
+		t.Fatalf("Error parsing query: %v", err)
+	}
+	results, err := collectQuery(context.Background(), *q, "", "")
+	if err != nil {
+		t.Fatalf("Error querying: %v", err)
+	}
+	exp := &bytes.Buffer{}
+	for _, po := range results {
+		if po.key == base.Add(time.Minute).UnixNano() {
+			ndjsonFormat{}.write(exp, po)
+		}
+	}
+	if want := strings.TrimSpace(exp.String()); got != want {
+		t.Errorf("Expected update %v, got %v", want, got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"log/syslog"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -38,6 +39,15 @@ var cacheWorkers = flag.Int("cacheWorkers", 4, "Number of cache workers")
 var verbose = flag.Bool("v", false, "Verbose logging")
 var logAccess = flag.Bool("logAccess", false, "Log HTTP Requests")
 var useSyslog = flag.Bool("syslog", false, "Log to syslog")
+var udrMaxSteps = flag.Int("udrMaxSteps", 10000000,
+	"Maximum evaluation steps for a user defined reducer per group")
+var partialChunk = flag.Duration("partialChunk", 0,
+	"Span of the chunks of partial aggregates groups are assembled "+
+		"from (e.g. 1m), or 0 to reduce whole groups")
+var alertInterval = flag.Duration("alertInterval", time.Minute,
+	"How often to evaluate alert rules")
+var alertWebhook = flag.String("alertWebhook", "",
+	"URL to POST alert notifications to")
 var minQueryLogDuration = flag.Duration("minQueryLogDuration",
 	time.Millisecond*100, "minimum query duration to log")
 
@@ -61,6 +71,10 @@ const dbMatch = "[-%+()$_a-zA-Z0-9]+"
 
 var defaultDeadline = time.Millisecond * 50
 
+// liveDeadline is effectively no deadline, as live queries run until
+// their clients go away.
+var liveDeadline = time.Duration(math.MaxInt64)
+
 var routingTable []routingEntry
 
 func init() {
@@ -76,6 +90,32 @@ func init() {
 		// Database stuff
 		routingEntry{"GET", regexp.MustCompile("^/_all_dbs$"),
 			listDatabases, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_reducers$"),
+			listReducers, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_reducers/([^/]+)$"),
+			getReducer, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/_reducers/([^/]+)$"),
+			putReducer, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/_reducers/([^/]+)$"),
+			deleteReducer, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_alerts$"),
+			listAlerts, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_alerts/([^/]+)$"),
+			getAlert, defaultDeadline},
+		routingEntry{"PUT", regexp.MustCompile("^/_alerts/([^/]+)$"),
+			putAlert, defaultDeadline},
+		routingEntry{"DELETE", regexp.MustCompile("^/_alerts/([^/]+)$"),
+			deleteAlert, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_alerts/([^/]+)/history$"),
+			alertHistory, *queryTimeout},
+		routingEntry{"GET", regexp.MustCompile("^/_query$"),
+			multiQuery, *queryTimeout},
+		routingEntry{"POST", regexp.MustCompile("^/_query$"),
+			postMultiQuery, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/_sql$"),
+			sqlQuery, *queryTimeout},
+		routingEntry{"POST", regexp.MustCompile("^/_sql$"),
+			sqlQuery, *queryTimeout},
 		routingEntry{"GET", regexp.MustCompile("^/_(.*)"),
 			reservedHandler, defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/?$"),
@@ -86,6 +126,10 @@ func init() {
 			dbChanges, defaultDeadline},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_query$"),
 			query, *queryTimeout},
+		routingEntry{"POST", regexp.MustCompile("^/(" + dbMatch + ")/_query$"),
+			postQuery, defaultDeadline},
+		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_live$"),
+			liveQuery, liveDeadline},
 		routingEntry{"DELETE", regexp.MustCompile("^/(" + dbMatch + ")/_bulk$"),
 			deleteBulk, *queryTimeout},
 		routingEntry{"GET", regexp.MustCompile("^/(" + dbMatch + ")/_all"),
@@ -258,19 +302,38 @@ func main() {
 	if err := os.MkdirAll(*dbRoot, 0777); err != nil {
 		log.Fatalf("Could not create %v: %v", *dbRoot, err)
 	}
+	if err := loadUserReducers(); err != nil {
+		log.Fatalf("Could not load user defined reducers: %v", err)
+	}
+	if err := loadAlertRules(); err != nil {
+		log.Fatalf("Could not load alert rules: %v", err)
+	}
 
-	// Update the query handler deadline to the query timeout
-	found := false
-	for i := range routingTable {
-		matches := routingTable[i].Path.FindAllStringSubmatch("/x/_query", 1)
-		if len(matches) > 0 {
-			routingTable[i].Deadline = *queryTimeout
-			found = true
-			break
+	// Update the query handler deadlines to the query timeout
+	for _, qh := range []struct{ method, path string }{
+		{"GET", "/x/_query"},
+		{"GET", "/_query"},
+		{"POST", "/x/_query"},
+		{"POST", "/_query"},
+		{"GET", "/_sql"},
+		{"POST", "/_sql"},
+	} {
+		found := false
+		for i := range routingTable {
+			if routingTable[i].Method != qh.method {
+				continue
+			}
+			matches := routingTable[i].Path.FindAllStringSubmatch(qh.path, 1)
+			if len(matches) > 0 {
+				routingTable[i].Deadline = *queryTimeout
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Fatalf("Programming error:  Could not find %v handler",
+				qh.path)
 		}
-	}
-	if !found {
-		log.Fatalf("Programming error:  Could not find query handler")
 	}
 
 	processorInput = make(chan *processIn, *docBacklog)
@@ -293,6 +356,7 @@ func main() {
 	for i := 0; i < *queryWorkers; i++ {
 		go queryExecutor()
 	}
+	go alertScheduler()
 
 	if *pprofFile != "" {
 		go startProfiler()
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Ways of combining the values of several databases.
+const (
+	combineSum = "sum"
+	combineAvg = "avg"
+)
+
+// expandDBNames resolves the db parameters of a multi-database query.
+// Each may be a database name or a glob over the known databases.
+func expandDBNames(patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, paramError{"Database required",
+			"At least one db argument is required"}
+	}
+
+	seen := map[string]bool{}
+	var all []string
+	for _, p := range patterns {
+		if !strings.ContainsAny(p, `*?[\`) {
+			if !validDBName.MatchString(p) {
+				return nil, paramError{"Bad db value", p}
+			}
+			seen[p] = true
+			continue
+		}
+		if all == nil {
+			all = dblist(*dbRoot)
+		}
+		found := false
+		for _, n := range all {
+			m, err := path.Match(p, n)
+			if err != nil {
+				return nil, paramError{"Bad db value", err.Error()}
+			}
+			if m {
+				seen[n] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, paramError{"No matching databases", p}
+		}
+	}
+
+	rv := make([]string, 0, len(seen))
+	for n := range seen {
+		rv = append(rv, n)
+	}
+	sort.Strings(rv)
+	return rv, nil
+}
+
+// multiQuery runs the same query over several databases and reports
+// the results aligned by group.  Each database's values appear as a
+// separate series named after it unless they're combined.
+func multiQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	dbnames, err := expandDBNames(req.Form["db"])
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	combine := req.FormValue("combine")
+	if combine != "" && combine != combineSum && combine != combineAvg {
+		emitQueryError(w, paramError{"Bad combine value", combine})
+		return
+	}
+
+	queries := make([]*queryIn, 0, len(dbnames))
+	for _, n := range dbnames {
+		q, err := parseQueryParams(n, req)
+		if err == nil && len(q.offsets) > 0 {
+			err = paramError{"Unsupported offset",
+				"offsets can't be combined with multiple databases"}
+		}
+		if err != nil {
+			emitQueryError(w, err)
+			return
+		}
+		queries = append(queries, q)
+	}
+
+	results := make([][]*processOut, len(queries))
+	errs := make([]error, len(queries))
+	wg := sync.WaitGroup{}
+	for i, q := range queries {
+		wg.Add(1)
+		go func(i int, q *queryIn) {
+			defer wg.Done()
+			errs[i] = awaitQuery(executeQuery(req.Context(), q), func(po *processOut) {
+				results[i] = append(results[i], po)
+			})
+		}(i, q)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			emitError(500, w, "Error querying "+dbnames[i], err.Error())
+			return
+		}
+	}
+
+	if queries[0].explain {
+		stats := map[string]*queryExplanation{}
+		for i, q := range queries {
+			stats[dbnames[i]] = q.explanation(len(results[i]))
+			q.logCompletion()
+		}
+		mustEncode(200, w, stats)
+		return
+	}
+
+	mq := *queries[0]
+	mq.dbname = ""
+	mq.dbnames = dbnames
+	mq.combine = combine
+	merged, err := mq.postProcess(mergeDBResults(&mq, results))
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+
+	out, err := newQueryOutput(w, req, &mq)
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	out.begin()
+	out.writeAll(merged)
+	out.end()
+
+	for _, q := range queries {
+		q.logCompletion()
+	}
+}
+
+// mergeDBResults aligns the results of a query over each of
+// q.dbnames by group key.
+func mergeDBResults(q *queryIn, results [][]*processOut) []*processOut {
+	byKey := map[int64][]*processOut{}
+	for i, rs := range results {
+		for _, po := range rs {
+			if byKey[po.key] == nil {
+				byKey[po.key] = make([]*processOut, len(results))
+			}
+			byKey[po.key][i] = po
+		}
+	}
+
+	rv := make([]*processOut, 0, len(byKey))
+	for k, pos := range byKey {
+		merged := &processOut{key: k}
+		if q.grouped() {
+			merged.groups = map[string][]interface{}{}
+		}
+		// Gather every database's values for each series.
+		series := map[string][][]interface{}{}
+		for i, po := range pos {
+			if po == nil {
+				continue
+			}
+			if po.groups == nil {
+				series[""] = append(series[""], po.value)
+				if q.combine == "" {
+					merged.groups[groupName(q.dbnames[i])] = po.value
+				}
+			}
+			for g, v := range po.groups {
+				series[g] = append(series[g], v)
+				if q.combine == "" {
+					merged.groups[groupName(q.dbnames[i])+","+g] = v
+				}
+			}
+		}
+		if q.combine != "" {
+			for g, vals := range series {
+				c := combineValues(vals, len(q.ptrs), q.combine)
+				if q.grouped() {
+					merged.groups[g] = c
+				} else {
+					merged.value = c
+				}
+			}
+		}
+		rv = append(rv, merged)
+	}
+	return rv
+}
+
+// combineValues sums or averages each column of numeric values.
+// Columns without any numbers are null.
+func combineValues(vals [][]interface{}, width int, combine string) []interface{} {
+	rv := make([]interface{}, width)
+	for col := range rv {
+		sum, n := 0.0, 0
+		for _, row := range vals {
+			if col >= len(row) {
+				continue
+			}
+			if f, ok := toFloat(row[col]); ok {
+				sum += f
+				n++
+			}
+		}
+		switch {
+		case n == 0:
+		case combine == combineAvg:
+			rv[col] = sum / float64(n)
+		default:
+			rv[col] = sum
+		}
+	}
+	return rv
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandDBNames(t *testing.T) {
+	got, err := expandDBNames([]string{"b", "a", "b"})
+	if err != nil {
+		t.Fatalf("Error expanding names: %v", err)
+	}
+	if exp := []string{"a", "b"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	for _, bad := range [][]string{nil, {"../x"}, {"[x"}} {
+		if got, err := expandDBNames(bad); err == nil {
+			t.Errorf("Expected error expanding %v, got %v", bad, got)
+		}
+	}
+}
+
+func TestMergeDBResults(t *testing.T) {
+	results := [][]*processOut{
+		{{key: 1, value: []interface{}{1.0, "x"}},
+			{key: 2, value: []interface{}{2.0, nil}}},
+		{{key: 2, value: []interface{}{5.0, nil}}},
+	}
+	q := &queryIn{ptrs: []string{"/a", "/b"}, dbnames: []string{"d1", "d2"}}
+
+	got := mergeDBResults(q, results)
+	sortResults(got)
+	exp := []map[string][]interface{}{
+		{"d1": {1.0, "x"}},
+		{"d1": {2.0, nil}, "d2": {5.0, nil}},
+	}
+	if len(got) != len(exp) {
+		t.Fatalf("Expected %v results, got %v", len(exp), len(got))
+	}
+	for i := range exp {
+		if !reflect.DeepEqual(got[i].groups, exp[i]) {
+			t.Errorf("Expected %v at %v, got %v", exp[i], i, got[i].groups)
+		}
+	}
+
+	q.combine = combineAvg
+	got = mergeDBResults(q, results)
+	sortResults(got)
+	for i, exp := range [][]interface{}{{1.0, nil}, {3.5, nil}} {
+		if !reflect.DeepEqual(got[i].value, exp) {
+			t.Errorf("Expected %v at %v, got %v", exp, i, got[i].value)
+		}
+	}
+}
+
+func TestMergeGroupedDBResults(t *testing.T) {
+	results := [][]*processOut{
+		{{key: 1, groups: map[string][]interface{}{
+			"a": {1.0}, "b": {2.0}}}},
+		{{key: 1, groups: map[string][]interface{}{
+			"a": {3}}}},
+	}
+	q := &queryIn{ptrs: []string{"/v"}, groupBy: []string{"/h"},
+		dbnames: []string{"d1", "d2"}}
+
+	got := mergeDBResults(q, results)
+	exp := map[string][]interface{}{
+		"d1,a": {1.0}, "d1,b": {2.0}, "d2,a": {3},
+	}
+	if !reflect.DeepEqual(got[0].groups, exp) {
+		t.Errorf("Expected %v, got %v", exp, got[0].groups)
+	}
+
+	q.combine = combineSum
+	got = mergeDBResults(q, results)
+	exp = map[string][]interface{}{"a": {4.0}, "b": {2.0}}
+	if !reflect.DeepEqual(got[0].groups, exp) {
+		t.Errorf("Expected %v, got %v", exp, got[0].groups)
+	}
+}
+
+func TestMergeWildcardDBResults(t *testing.T) {
+	results := [][]*processOut{
+		{{key: 1, groups: map[string][]interface{}{
+			"cpu0": {1.0}, "cpu1": {2.0}}}},
+		{{key: 1, groups: map[string][]interface{}{
+			"cpu0": {3.0}}}},
+	}
+	q := &queryIn{ptrs: []string{"/cpu/*/user"},
+		dbnames: []string{"d1", "d2"}, combine: combineSum}
+
+	got := mergeDBResults(q, results)
+	exp := map[string][]interface{}{"cpu0": {4.0}, "cpu1": {2.0}}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].groups, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
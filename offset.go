@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A queryOffset shifts a query back in time for comparison with the
+// unshifted results.
+type queryOffset struct {
+	name string
+	d    time.Duration
+}
+
+// parseOffsets reads the offset parameters of a query, such as 1w,
+// 1d or 90m.  The unshifted query is always included first, named 0.
+func parseOffsets(specs []string) ([]queryOffset, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	rv := []queryOffset{{"0", 0}}
+	seen := map[time.Duration]bool{0: true}
+	for _, s := range specs {
+		d, err := parseDurationString(s)
+		if err != nil || d < 0 {
+			return nil, paramError{"Bad offset value", s}
+		}
+		if !seen[d] {
+			seen[d] = true
+			rv = append(rv, queryOffset{s, d})
+		}
+	}
+	return rv, nil
+}
+
+// shifted copies a query to run over its range moved back by an
+// offset.  Everything that depends on the merged results is left to
+// the original query.
+func (q *queryIn) shifted(off time.Duration) *queryIn {
+	rv := *q
+	rv.offsets = nil
+	rv.fill, rv.order, rv.limit = "", "", 0
+	rv.windows, rv.rank = nil, nil
+
+	shift := func(k string) string {
+		return keyString(parseKey(k) - int64(off))
+	}
+	if q.from != "" {
+		rv.from = shift(q.from)
+	}
+	if q.to != "" {
+		rv.to = shift(q.to)
+	} else if off > 0 {
+		// Nothing after now is shifted into the comparison.
+		rv.to = keyString(time.Now().UnixNano() - int64(off))
+	}
+	return &rv
+}
+
+// offsetQuery runs a query at each of its offsets and reports the
+// results of each as separate series named after the offset, keyed
+// by the unshifted groups.
+func offsetQuery(out *queryOutput, q *queryIn, req *http.Request) {
+	w := out.w
+	queries := make([]*queryIn, len(q.offsets))
+	results := make([][]*processOut, len(q.offsets))
+	errs := make([]error, len(q.offsets))
+	wg := sync.WaitGroup{}
+	for i, off := range q.offsets {
+		queries[i] = q.shifted(off.d)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = awaitQuery(executeQuery(req.Context(), queries[i]),
+				func(po *processOut) {
+					results[i] = append(results[i], po)
+				})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			emitError(500, w, "Error querying offset "+q.offsets[i].name,
+				err.Error())
+			return
+		}
+	}
+
+	if q.explain {
+		stats := map[string]*queryExplanation{}
+		for i, sq := range queries {
+			stats[q.offsets[i].name] = sq.explanation(len(results[i]))
+			sq.logCompletion()
+		}
+		mustEncode(200, w, stats)
+		return
+	}
+
+	merged, err := q.postProcess(mergeOffsetResults(q, results))
+	if err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	out.begin()
+	out.writeAll(merged)
+	out.end()
+
+	for _, sq := range queries {
+		sq.logCompletion()
+	}
+}
+
+// mergeOffsetResults aligns the results of a query at each of
+// q.offsets with the unshifted groups.  The series of each offset
+// are named after it, followed by the group for queries grouped by
+// pointers.
+func mergeOffsetResults(q *queryIn, results [][]*processOut) []*processOut {
+	byKey := map[int64]*processOut{}
+	for i, rs := range results {
+		off := q.offsets[i]
+		for _, po := range rs {
+			key := po.key
+			if off.d != 0 {
+				key, _ = q.grouper.bucket(po.key + int64(off.d))
+			}
+			merged := byKey[key]
+			if merged == nil {
+				merged = &processOut{key: key,
+					groups: map[string][]interface{}{}}
+				byKey[key] = merged
+			}
+			if po.groups == nil {
+				merged.groups[groupName(off.name)] = po.value
+			}
+			for g, v := range po.groups {
+				merged.groups[groupName(off.name)+","+g] = v
+			}
+		}
+	}
+
+	rv := make([]*processOut, 0, len(byKey))
+	for _, po := range byKey {
+		rv = append(rv, po)
+	}
+	return rv
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseOffsets(t *testing.T) {
+	got, err := parseOffsets([]string{"1w", "90m", "7d", "0"})
+	if err != nil {
+		t.Fatalf("Error parsing offsets: %v", err)
+	}
+	exp := []queryOffset{
+		{"0", 0},
+		{"1w", 7 * 24 * time.Hour},
+		{"90m", 90 * time.Minute},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	if got, err := parseOffsets(nil); got != nil || err != nil {
+		t.Errorf("Expected no offsets, got %v, %v", got, err)
+	}
+	got, err = parseOffsets([]string{"1d12h", "1.5d", "1w2d", "0.5w"})
+	if err != nil {
+		t.Fatalf("Error parsing compound offsets: %v", err)
+	}
+	exp = []queryOffset{
+		{"0", 0},
+		{"1d12h", 36 * time.Hour},
+		{"1w2d", 9 * 24 * time.Hour},
+		{"0.5w", 84 * time.Hour},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	for _, bad := range []string{"x", "1x", "-1h", "d", "1d12", "1..5d"} {
+		if got, err := parseOffsets([]string{bad}); err == nil {
+			t.Errorf("Expected error for %v, got %v", bad, got)
+		}
+	}
+}
+
+func TestShiftedQuery(t *testing.T) {
+	q := &queryIn{
+		from:    "2020-01-08T00:00:00Z",
+		to:      "2020-01-08T01:00:00Z",
+		fill:    "zero",
+		limit:   3,
+		offsets: []queryOffset{{"0", 0}, {"1w", 7 * 24 * time.Hour}},
+	}
+	s := q.shifted(7 * 24 * time.Hour)
+	if s.from != "2020-01-01T00:00:00Z" || s.to != "2020-01-01T01:00:00Z" {
+		t.Errorf("Expected the previous week, got %v - %v", s.from, s.to)
+	}
+	if s.offsets != nil || s.fill != "" || s.limit != 0 {
+		t.Errorf("Expected no post processing, got %+v", s)
+	}
+
+	q.from, q.to = "", ""
+	s = q.shifted(time.Hour)
+	if s.from != "" || parseKey(s.to) > time.Now().Add(-time.Hour).UnixNano() {
+		t.Errorf("Expected up to an hour ago, got %v - %v", s.from, s.to)
+	}
+}
+
+func TestMergeOffsetResults(t *testing.T) {
+	m := int64(time.Minute)
+	q := &queryIn{
+		grouper: fixedGrouper{m, time.UTC},
+		offsets: []queryOffset{{"0", 0}, {"2m", 2 * time.Minute}},
+	}
+	results := [][]*processOut{
+		{
+			{key: 2 * m, value: []interface{}{1.0}},
+			{key: 3 * m, value: []interface{}{2.0}},
+		},
+		{
+			{key: 0, value: []interface{}{3.0}},
+			{key: m, value: []interface{}{4.0}},
+		},
+	}
+	got := mergeOffsetResults(q, results)
+	sortResults(got)
+	exp := []*processOut{
+		{key: 2 * m, groups: map[string][]interface{}{
+			"0": {1.0}, "2m": {3.0}}},
+		{key: 3 * m, groups: map[string][]interface{}{
+			"0": {2.0}, "2m": {4.0}}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	q.groupBy = []string{"/h"}
+	results = [][]*processOut{
+		{{key: 2 * m, groups: map[string][]interface{}{"a": {1.0}}}},
+		{{key: 0, groups: map[string][]interface{}{"a": {3.0}}}},
+	}
+	got = mergeOffsetResults(q, results)
+	gexp := map[string][]interface{}{"0,a": {1.0}, "2m,a": {3.0}}
+	if len(got) != 1 || !reflect.DeepEqual(got[0].groups, gexp) {
+		t.Errorf("Expected %v, got %v", gexp, got)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+)
+
+var errNoPartial = errors.New("reducer has no partial aggregates")
+
+// A partialAgg lets a reducer's results over consecutive runs of
+// values be combined into its result over all of them.
+//
+// make builds a reducer producing partial aggregates; if it's nil
+// the reducer's own result is its partial aggregate.  merge combines
+// the partial aggregates of a run and of the run following it, and
+// final finds the reducer's result from a partial aggregate (the
+// aggregate itself if final is nil).  Partial aggregates must
+// survive a trip through JSON, since they're cached.
+type partialAgg struct {
+	make  func(args string) (reducer, error)
+	merge func(a, b interface{}) interface{}
+	final func(p interface{}) interface{}
+}
+
+func (p *partialAgg) finish(v interface{}) interface{} {
+	if p.final == nil || v == nil {
+		return v
+	}
+	return p.final(v)
+}
+
+// findPartial resolves a reducer name as given in a query to a
+// reducer producing partial aggregates, and how to combine them.
+func findPartial(name string) (reducer, *partialAgg, error) {
+	reducerLock.RLock()
+	defer reducerLock.RUnlock()
+	base, args := name, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		base, args = name[:i], name[i+1:]
+	}
+	info, ok := reducerRegistry[base]
+	switch {
+	case !ok:
+		return nil, nil, errNoSuchReducer
+	case info.partial == nil:
+		return nil, nil, errNoPartial
+	case info.partial.make != nil:
+		r, err := info.partial.make(args)
+		return r, info.partial, err
+	case args == "" && info.reduce != nil:
+		return info.reduce, info.partial, nil
+	case info.make != nil:
+		r, err := info.make(args)
+		return r, info.partial, err
+	}
+	return nil, nil, errNoPartial
+}
+
+// partialAggs finds how to combine the partial aggregates of each of
+// a query's reducers, or returns nil if any of them can't.
+func partialAggs(reds []string) []*partialAgg {
+	rv := make([]*partialAgg, 0, len(reds))
+	for _, r := range reds {
+		_, p, err := findPartial(r)
+		if err != nil {
+			return nil
+		}
+		rv = append(rv, p)
+	}
+	return rv
+}
+
+// queryPartials finds how a query's groups are assembled from chunks
+// of partial aggregates, or returns nil if they're reduced whole,
+// either because partialChunk is off or a reducer has no partials.
+func queryPartials(reds []string) []*partialAgg {
+	if *partialChunk <= 0 {
+		return nil
+	}
+	return partialAggs(reds)
+}
+
+// Partial aggregates of the built in reducers.
+
+// addNumbers sums counts, keeping them integers until they've been
+// through JSON.
+func addNumbers(a, b interface{}) interface{} {
+	if x, ok := a.(int); ok {
+		if y, ok := b.(int); ok {
+			return x + y
+		}
+	}
+	x, xok := toFloat(a)
+	y, yok := toFloat(b)
+	switch {
+	case !xok:
+		return b
+	case !yok:
+		return a
+	}
+	return x + y
+}
+
+var sumPartial = &partialAgg{merge: addNumbers}
+
+// finiteFloat converts a partial aggregate to a number, treating the
+// NaN or infinity reduced from a run without any numbers as no value.
+func finiteFloat(v interface{}) (float64, bool) {
+	f, ok := toFloat(v)
+	return f, ok && !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+func extremePartial(better func(x, y float64) bool) *partialAgg {
+	return &partialAgg{merge: func(a, b interface{}) interface{} {
+		x, xok := finiteFloat(a)
+		y, yok := finiteFloat(b)
+		if !xok || yok && better(y, x) {
+			return b
+		}
+		return a
+	}}
+}
+
+var maxPartial = extremePartial(func(x, y float64) bool { return x > y })
+var minPartial = extremePartial(func(x, y float64) bool { return x < y })
+
+// avgPartial keeps the sum and number of values.
+var avgPartial = &partialAgg{
+	make: func(args string) (reducer, error) {
+		return func(input chan ptrval) interface{} {
+			sum, n := 0.0, 0
+			for v := range convertTofloat64(input) {
+				sum += v
+				n++
+			}
+			return []interface{}{sum, n}
+		}, nil
+	},
+	merge: func(a, b interface{}) interface{} {
+		x, y := toList(a), toList(b)
+		if len(x) != 2 || len(y) != 2 {
+			return nil
+		}
+		return []interface{}{addNumbers(x[0], y[0]), addNumbers(x[1], y[1])}
+	},
+	final: func(p interface{}) interface{} {
+		x := toList(p)
+		if len(x) != 2 {
+			return nil
+		}
+		sum, _ := toFloat(x[0])
+		n, _ := toFloat(x[1])
+		if n == 0 {
+			return nil
+		}
+		return sum / n
+	},
+}
+
+var anyPartial = &partialAgg{merge: func(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+	return a
+}}
+
+// toList converts the lists reducers produce, as is or after a trip
+// through JSON.
+func toList(v interface{}) []interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		return x
+	case []string:
+		rv := make([]interface{}, len(x))
+		for i, s := range x {
+			rv[i] = s
+		}
+		return rv
+	}
+	return nil
+}
+
+var concatPartial = &partialAgg{merge: func(a, b interface{}) interface{} {
+	return append(append([]interface{}{}, toList(a)...), toList(b)...)
+}}
+
+var unionPartial = &partialAgg{merge: func(a, b interface{}) interface{} {
+	seen := map[interface{}]bool{}
+	rv := []interface{}{}
+	for _, l := range [][]interface{}{toList(a), toList(b)} {
+		for _, v := range l {
+			if !seen[v] {
+				seen[v] = true
+				rv = append(rv, v)
+			}
+		}
+	}
+	return rv
+}}
+
+// histogramPartial adds the counts in each bucket.
+var histogramPartial = &partialAgg{merge: func(a, b interface{}) interface{} {
+	rv := map[string]interface{}{}
+	for _, m := range []interface{}{a, b} {
+		switch x := m.(type) {
+		case map[string]int:
+			for k, n := range x {
+				rv[k] = addNumbers(rv[k], n)
+			}
+		case map[string]interface{}:
+			for k, n := range x {
+				rv[k] = addNumbers(rv[k], n)
+			}
+		}
+	}
+	return rv
+}}
+
+// toHLL converts a sketch as produced, or after a trip through JSON.
+func toHLL(v interface{}) *hll {
+	switch x := v.(type) {
+	case *hll:
+		return x
+	case string:
+		s := &hll{}
+		if s.UnmarshalJSON([]byte(`"`+x+`"`)) == nil {
+			return s
+		}
+	}
+	return nil
+}
+
+var hllPartial = &partialAgg{
+	make: func(args string) (reducer, error) {
+		p, err := hllPrecision(args)
+		if err != nil {
+			return nil, err
+		}
+		return func(input chan ptrval) interface{} {
+			return hllOf(p, input)
+		}, nil
+	},
+	merge: func(a, b interface{}) interface{} {
+		x, y := toHLL(a), toHLL(b)
+		switch {
+		case x == nil:
+			return y
+		case y == nil:
+			return x
+		}
+		rv := newHLL(x.p)
+		if rv.merge(x) != nil || rv.merge(y) != nil {
+			return nil
+		}
+		return rv
+	},
+	final: func(p interface{}) interface{} {
+		if s := toHLL(p); s != nil {
+			return s.estimate()
+		}
+		return nil
+	},
+}
+
+// mergeRows combines rows of partial aggregates.
+func mergeRows(aggs []*partialAgg, a, b []interface{}) []interface{} {
+	if a == nil {
+		return b
+	}
+	for i := range a {
+		if i < len(b) {
+			a[i] = aggs[i].merge(a[i], b[i])
+		}
+	}
+	return a
+}
+
+// finishRow replaces a row's partial aggregates with final results.
+func finishRow(aggs []*partialAgg, row []interface{}) {
+	for i := range row {
+		row[i] = aggs[i].finish(row[i])
+		if f, ok := row[i].(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			row[i] = nil
+		}
+	}
+}
+
+// A partialAssembler collects the results of a query's chunks of
+// partial aggregates, producing each group's result once all of its
+// chunks have arrived.
+type partialAssembler struct {
+	aggs    []*partialAgg
+	pending map[int32][]*processOut
+}
+
+func newPartialAssembler(aggs []*partialAgg) *partialAssembler {
+	return &partialAssembler{aggs, map[int32][]*processOut{}}
+}
+
+type byPart []*processOut
+
+func (b byPart) Len() int           { return len(b) }
+func (b byPart) Less(i, j int) bool { return b[i].part < b[j].part }
+func (b byPart) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// add records the result of a chunk, returning its group's result if
+// this was the group's last chunk, or nil.
+func (a *partialAssembler) add(po *processOut) *processOut {
+	parts := append(a.pending[po.seq], po)
+	if len(parts) < po.parts {
+		a.pending[po.seq] = parts
+		return nil
+	}
+	delete(a.pending, po.seq)
+	sort.Sort(byPart(parts))
+
+	rv := &processOut{key: po.key, seq: po.seq}
+	for _, p := range parts {
+		if p.err != nil {
+			rv.err = p.err
+			return rv
+		}
+		if p.groups == nil {
+			rv.value = mergeRows(a.aggs, rv.value, p.value)
+			continue
+		}
+		if rv.groups == nil {
+			rv.groups = map[string][]interface{}{}
+		}
+		for g, row := range p.groups {
+			rv.groups[g] = mergeRows(a.aggs, rv.groups[g], row)
+		}
+	}
+	if rv.groups == nil {
+		finishRow(a.aggs, rv.value)
+	}
+	for _, row := range rv.groups {
+		finishRow(a.aggs, row)
+	}
+	return rv
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mschoch/gouchstore"
+)
+
+func TestPartialReducers(t *testing.T) {
+	half := len(testInput) / 2
+	for _, name := range []string{"identity", "any", "count", "sum",
+		"sumsq", "max", "min", "avg", "histogram:20,40,60",
+		"approx_distinct", "approx_distinct:8"} {
+
+		r, err := findReducer(name)
+		if err != nil {
+			t.Fatalf("Error finding %v: %v", name, err)
+		}
+		exp := r(streamCollection(testInput))
+
+		pr, agg, err := findPartial(name)
+		if err != nil {
+			t.Fatalf("Error finding partial %v: %v", name, err)
+		}
+		a := pr(streamCollection(testInput[:half]))
+		b := pr(streamCollection(testInput[half:]))
+
+		// Cached partial aggregates come back through JSON.
+		d, _ := json.Marshal(b)
+		json.Unmarshal(d, &b)
+
+		got := agg.finish(agg.merge(a, b))
+		ej, _ := json.Marshal(exp)
+		gj, _ := json.Marshal(got)
+		if string(ej) != string(gj) {
+			t.Errorf("Expected %s for %v, got %s", ej, name, gj)
+		}
+	}
+
+	for _, name := range []string{"c_min", "count_distinct"} {
+		if _, _, err := findPartial(name); err != errNoPartial {
+			t.Errorf("Expected no partial for %v, got %v", name, err)
+		}
+	}
+	if _, _, err := findPartial("nope"); err != errNoSuchReducer {
+		t.Errorf("Expected no such reducer, got %v", err)
+	}
+	if aggs := partialAggs([]string{"avg", "c_min"}); aggs != nil {
+		t.Errorf("Expected no partials with c_min, got %v", aggs)
+	}
+}
+
+func TestPartialEmptyChunks(t *testing.T) {
+	for _, name := range []string{"max", "min"} {
+		pr, agg, err := findPartial(name)
+		if err != nil {
+			t.Fatalf("Error finding partial %v: %v", name, err)
+		}
+		empty := pr(streamCollection(nil))
+		full := pr(streamCollection(testInput))
+		exp := agg.finish(full)
+		for _, p := range [][2]interface{}{{empty, full}, {full, empty}} {
+			row := []interface{}{agg.merge(p[0], p[1])}
+			finishRow([]*partialAgg{agg}, row)
+			if row[0] != exp {
+				t.Errorf("Expected %v merging %v with %v for %v, got %v",
+					exp, p[0], p[1], name, row[0])
+			}
+		}
+		row := []interface{}{agg.merge(empty, empty)}
+		finishRow([]*partialAgg{agg}, row)
+		if row[0] != nil {
+			t.Errorf("Expected nil for empty %v, got %v", name, row[0])
+		}
+	}
+}
+
+func TestPartialAssembler(t *testing.T) {
+	aggs := partialAggs([]string{"sum", "avg"})
+	a := newPartialAssembler(aggs)
+
+	parts := []*processOut{
+		{key: 5, seq: 1, part: 2, parts: 3,
+			value: []interface{}{2.0, []interface{}{2.0, 1.0}}},
+		{key: 5, seq: 1, part: 0, parts: 3,
+			value: []interface{}{1.0, []interface{}{1.0, 1.0}}},
+		{key: 9, seq: 2, part: 0, parts: 1,
+			value: []interface{}{0.0, []interface{}{0.0, 0}}},
+		{key: 5, seq: 1, part: 1, parts: 3,
+			value: []interface{}{6.0, []interface{}{6.0, 2}}},
+	}
+	var got []*processOut
+	for _, po := range parts {
+		if rv := a.add(po); rv != nil {
+			got = append(got, rv)
+		}
+	}
+	exp := []*processOut{
+		{key: 9, seq: 2, value: []interface{}{0.0, nil}},
+		{key: 5, seq: 1, value: []interface{}{9.0, 2.25}},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	grouped := []*processOut{
+		{key: 1, seq: 1, part: 0, parts: 2, groups: map[string][]interface{}{
+			"a": {1.0, []interface{}{1.0, 1}}}},
+		{key: 1, seq: 1, part: 1, parts: 2, groups: map[string][]interface{}{
+			"a": {3.0, []interface{}{3.0, 1}},
+			"b": {4.0, []interface{}{4.0, 1}}}},
+	}
+	a.add(grouped[0])
+	rv := a.add(grouped[1])
+	gexp := map[string][]interface{}{"a": {4.0, 2.0}, "b": {4.0, 4.0}}
+	if rv == nil || !reflect.DeepEqual(rv.groups, gexp) {
+		t.Errorf("Expected groups %v, got %v", gexp, rv)
+	}
+
+	errFailed := errors.New("failed")
+	a.add(&processOut{key: 2, seq: 3, part: 0, parts: 2, err: errFailed})
+	rv = a.add(&processOut{key: 2, seq: 3, part: 1, parts: 2,
+		value: []interface{}{1.0, []interface{}{1.0, 1}}})
+	if rv == nil || rv.err != errFailed {
+		t.Errorf("Expected failed result, got %v", rv)
+	}
+	if len(a.pending) != 0 {
+		t.Errorf("Expected nothing pending, got %v", a.pending)
+	}
+}
+
+func TestPartEnd(t *testing.T) {
+	defer func(d time.Duration) { *partialChunk = d }(*partialChunk)
+	*partialChunk = time.Minute
+	m := int64(time.Minute)
+
+	q := &queryIn{partial: partialAggs([]string{"sum"})}
+	tests := []struct{ t, groupEnd, exp int64 }{
+		{0, 5 * m, m},
+		{m + 5, 5 * m, 2 * m},
+		{4*m + 1, 5 * m, 5 * m},
+		{30, m / 2, m / 2},
+	}
+	for _, test := range tests {
+		if got := q.partEnd(test.t, test.groupEnd); got != test.exp {
+			t.Errorf("Expected %v for %v/%v, got %v",
+				test.exp, test.t, test.groupEnd, got)
+		}
+	}
+
+	q.partial = nil
+	if got := q.partEnd(0, 5*m); got != 5*m {
+		t.Errorf("Expected whole group without partials, got %v", got)
+	}
+}
+
+func TestPartialCacheKey(t *testing.T) {
+	infos := []*gouchstore.DocumentInfo{
+		gouchstore.NewDocumentInfo("2020-01-01T00:00:00Z"),
+	}
+	mk := func(key int64, parts int) *processIn {
+		return &processIn{dbname: "db", key: key, infos: infos,
+			ptrs: []string{"/v"}, reds: []string{"sum"}, parts: parts}
+	}
+	if a, b := cacheKey(mk(0, 3)), cacheKey(mk(60, 1)); a != b {
+		t.Errorf("Expected partial keys independent of the group, "+
+			"got %v and %v", a, b)
+	}
+	if a, b := cacheKey(mk(0, 0)), cacheKey(mk(0, 1)); a == b {
+		t.Errorf("Expected partial and final keys to differ, got %v", a)
+	}
+}
+
+func TestUnsplitQuery(t *testing.T) {
+	if d := flag.Lookup("partialChunk").DefValue; d != "0s" {
+		t.Fatalf("Expected partial aggregates off by default, got %v", d)
+	}
+	q := &queryIn{dbname: "db", ptrs: []string{"/v"},
+		reds: []string{"sum"}, partial: queryPartials([]string{"sum"})}
+	if q.partial != nil {
+		t.Fatalf("Expected no partials by default, got %v", q.partial)
+	}
+	m := int64(time.Minute)
+	if got := q.partEnd(0, 1440*m); got != 1440*m {
+		t.Errorf("Expected the whole group, got %v", got)
+	}
+
+	defer func(ch chan *processIn) { cacheInput = ch }(cacheInput)
+	cacheInput = make(chan *processIn, 1)
+	infos := []*gouchstore.DocumentInfo{
+		gouchstore.NewDocumentInfo("2020-01-01T00:00:00Z"),
+	}
+	next := gouchstore.NewDocumentInfo("2020-01-02T00:00:00Z")
+	fetchDocs(q, 0, [][]*gouchstore.DocumentInfo{infos}, next)
+	pi := <-cacheInput
+	if pi.parts != 0 || pi.nextInfo != next {
+		t.Errorf("Expected a whole group with lookahead, got %+v", pi)
+	}
+	if k := cacheKey(pi); !strings.HasPrefix(k, "db#0#") {
+		t.Errorf("Expected a per group cache key, got %v", k)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Result orderings for the order query parameter.
+const (
+	orderAsc  = "asc"
+	orderDesc = "desc"
+)
+
+// parseOrder validates the order and limit of a query.  A limit
+// implies ascending order unless descending order is requested.
+func parseOrder(order, limit string) (string, int, error) {
+	if order != "" && order != orderAsc && order != orderDesc {
+		return "", 0, paramError{"Bad order value", order}
+	}
+	n := 0
+	if limit != "" {
+		var err error
+		n, err = strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return "", 0, paramError{"Bad limit value", limit}
+		}
+		if order == "" {
+			order = orderAsc
+		}
+	}
+	return order, n, nil
+}
+
+// needsPostProcessing is true if a query's results must all be
+// collected before any can be emitted.
+func (q *queryIn) needsPostProcessing() bool {
+	return q.fill != "" || q.order == orderDesc || len(q.windows) > 0 ||
+		q.rank != nil
+}
+
+// postProcess orders the collected results of a query and applies
+// any transformations requested.
+func (q *queryIn) postProcess(results []*processOut) ([]*processOut, error) {
+	sortResults(results)
+
+	if q.fill != "" {
+		keys, err := q.groupKeys(results)
+		if err != nil {
+			return nil, err
+		}
+		results = fillGaps(results, keys, q.fill, len(q.ptrs),
+			q.grouped())
+	}
+
+	if len(q.windows) > 0 {
+		applyWindows(results, q.windows)
+	}
+
+	if q.rank != nil {
+		results = q.rank.apply(results, q.grouped())
+	}
+
+	if q.order == orderDesc {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	if q.limit > 0 && len(results) > q.limit {
+		results = results[:q.limit]
+	}
+	return results, nil
+}
+
+// chunkLimit is the number of chunks at the start (or the end, for
+// descending queries) of the range that can produce a query's
+// results, or 0 if every chunk is needed.
+func (q *queryIn) chunkLimit() int {
+	if q.rank != nil {
+		return 0
+	}
+	if len(q.windows) > 0 && q.order == orderDesc {
+		// Window functions need the groups before the last few.
+		return 0
+	}
+	if q.fill == fillPrevious || q.fill == fillLinear {
+		// Filling needs the groups either side of those reported.
+		return 0
+	}
+	return q.limit
+}
+
+// A column describes one of the values in each row of a query's
+// results.
+type column struct {
+	ptr, reducer, window string
+	alias                string
+}
+
+func (c column) String() string {
+	if c.alias != "" {
+		return c.alias
+	}
+	rv := c.reducer + "(" + c.ptr + ")"
+	if c.window != "" {
+		rv = c.window + "(" + rv + ")"
+	}
+	return rv
+}
+
+// columns describes the query's fields followed by its window
+// functions.
+func (q *queryIn) columns() []column {
+	rv := make([]column, 0, len(q.ptrs)+len(q.windows))
+	for i := range q.ptrs {
+		rv = append(rv, column{q.ptrs[i], q.reds[i], "", ""})
+	}
+	for _, w := range q.windows {
+		rv = append(rv, column{q.ptrs[w.field], q.reds[w.field], w.spec, ""})
+	}
+	for i, a := range q.aliases {
+		rv[i].alias = a
+	}
+	return rv
+}
+
+type byKey []*processOut
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Less(i, j int) bool { return b[i].key < b[j].key }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// sortResults orders results by their group key.
+func sortResults(results []*processOut) {
+	sort.Sort(byKey(results))
+}
+
+// A resultSequencer releases results in the order their chunks were
+// started, holding back any that arrive early.
+type resultSequencer struct {
+	next    int32
+	pending map[int32]*processOut
+}
+
+func newResultSequencer() *resultSequencer {
+	return &resultSequencer{next: 1, pending: map[int32]*processOut{}}
+}
+
+// add records the arrival of a result and passes any results that
+// are now in sequence to f.
+func (s *resultSequencer) add(po *processOut, f func(*processOut)) {
+	s.pending[po.seq] = po
+	for {
+		p, ok := s.pending[s.next]
+		if !ok {
+			return
+		}
+		delete(s.pending, s.next)
+		s.next++
+		f(p)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseOrder(t *testing.T) {
+	tests := []struct {
+		order, limit string
+		exporder     string
+		explimit     int
+		ok           bool
+	}{
+		{"", "", "", 0, true},
+		{"asc", "", orderAsc, 0, true},
+		{"desc", "10", orderDesc, 10, true},
+		{"", "3", orderAsc, 3, true},
+		{"sideways", "", "", 0, false},
+		{"", "0", "", 0, false},
+		{"", "-1", "", 0, false},
+		{"", "x", "", 0, false},
+	}
+
+	for _, test := range tests {
+		order, limit, err := parseOrder(test.order, test.limit)
+		if (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %q/%q, got %v",
+				test.ok, test.order, test.limit, err)
+			continue
+		}
+		if order != test.exporder || limit != test.explimit {
+			t.Errorf("Expected %v/%v for %q/%q, got %v/%v",
+				test.exporder, test.explimit, test.order, test.limit,
+				order, limit)
+		}
+	}
+}
+
+func TestPostProcessOrder(t *testing.T) {
+	mkresults := func() []*processOut {
+		return []*processOut{{key: 3}, {key: 1}, {key: 4}, {key: 2}}
+	}
+	tests := []struct {
+		order string
+		limit int
+		exp   []int64
+	}{
+		{"", 0, []int64{1, 2, 3, 4}},
+		{orderAsc, 2, []int64{1, 2}},
+		{orderDesc, 0, []int64{4, 3, 2, 1}},
+		{orderDesc, 3, []int64{4, 3, 2}},
+		{orderDesc, 10, []int64{4, 3, 2, 1}},
+	}
+
+	for _, test := range tests {
+		q := &queryIn{order: test.order, limit: test.limit}
+		got, err := q.postProcess(mkresults())
+		if err != nil {
+			t.Fatalf("Error post processing: %v", err)
+		}
+		keys := make([]int64, len(got))
+		for i, po := range got {
+			keys[i] = po.key
+		}
+		if len(keys) != len(test.exp) {
+			t.Errorf("Expected %v for %v/%v, got %v",
+				test.exp, test.order, test.limit, keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != test.exp[i] {
+				t.Errorf("Expected %v for %v/%v, got %v",
+					test.exp, test.order, test.limit, keys)
+				break
+			}
+		}
+	}
+}
+
+func TestChunkLimit(t *testing.T) {
+	tests := []struct {
+		q   queryIn
+		exp int
+	}{
+		{queryIn{limit: 3}, 3},
+		{queryIn{limit: 3, order: orderDesc}, 3},
+		{queryIn{limit: 3, order: orderDesc, fill: fillZero}, 3},
+		{queryIn{limit: 3, order: orderDesc, fill: fillPrevious}, 0},
+		{queryIn{limit: 3, order: orderDesc, fill: fillLinear}, 0},
+		{queryIn{limit: 3, fill: fillLinear}, 0},
+		{queryIn{limit: 3, order: orderDesc,
+			windows: []windowFunc{{field: 0, spec: "cumsum"}}}, 0},
+		{queryIn{limit: 3, rank: &ranking{n: 2}}, 0},
+	}
+	for _, test := range tests {
+		if got := test.q.chunkLimit(); got != test.exp {
+			t.Errorf("Expected limit %v for %+v, got %v",
+				test.exp, test.q, got)
+		}
+	}
+}
+
+func TestResultSequencer(t *testing.T) {
+	s := newResultSequencer()
+	var got []int32
+	record := func(po *processOut) {
+		got = append(got, po.seq)
+	}
+
+	for _, seq := range []int32{3, 2, 1, 5, 4} {
+		s.add(&processOut{seq: seq}, record)
+		if seq == 3 && len(got) != 0 {
+			t.Fatalf("Expected nothing released before 1, got %v", got)
+		}
+	}
+	for i, seq := range got {
+		if seq != int32(i+1) {
+			t.Fatalf("Expected results in sequence, got %v", got)
+		}
+	}
+	if len(got) != 5 || len(s.pending) != 0 {
+		t.Errorf("Expected all 5 released, got %v with %v pending",
+			got, len(s.pending))
+	}
+}
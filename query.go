@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"math"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +17,9 @@ import (
 )
 
 var errTimeout = errors.New("query timed out")
+var errCanceled = errors.New("query canceled")
+var errNoSuchReducer = errors.New("no such reducer")
+var errLimitReached = errors.New("chunk limit reached")
 
 type ptrval struct {
 	di       *gouchstore.DocumentInfo
@@ -25,46 +30,123 @@ type ptrval struct {
 type reducer func(input chan ptrval) interface{}
 
 type processOut struct {
-	cacheKey    string
-	key         int64
-	value       []interface{}
+	cacheKey string
+	key      int64
+	// seq is the position of this chunk in the order the query
+	// started them.
+	seq   int32
+	value []interface{}
+	// groups holds the values for each distinct group when the
+	// query is grouped by pointers.  value is unused in that case.
+	groups      map[string][]interface{}
 	err         error
 	cacheOpaque uint32
+	// A chunk of partial aggregates is part of parts making up its
+	// group.  parts is zero for a chunk of final results.
+	part, parts int
 }
 
 func (p processOut) MarshalJSON() ([]byte, error) {
+	if p.groups != nil {
+		return json.Marshal(map[string]interface{}{"g": p.groups})
+	}
 	return json.Marshal(map[string]interface{}{"v": p.value})
 }
 
+// result is the value emitted for this chunk in query output.  Rows
+// are keyed by column name if names are given.
+func (p *processOut) result(names []string) interface{} {
+	switch {
+	case names == nil && p.groups != nil:
+		return p.groups
+	case names == nil:
+		return p.value
+	case p.groups != nil:
+		rv := make(map[string]interface{}, len(p.groups))
+		for g, row := range p.groups {
+			rv[g] = namedRow(names, row)
+		}
+		return rv
+	}
+	return namedRow(names, p.value)
+}
+
 type processIn struct {
-	cacheKey   string
-	dbname     string
-	key        int64
-	infos      []*gouchstore.DocumentInfo
-	nextInfo   *gouchstore.DocumentInfo
-	ptrs       []string
-	reds       []string
-	before     time.Time
-	filters    []string
-	filtervals []string
-	out        chan<- *processOut
+	cacheKey string
+	dbname   string
+	key      int64
+	seq      int32
+	infos    []*gouchstore.DocumentInfo
+	nextInfo *gouchstore.DocumentInfo
+	ptrs     []string
+	reds     []string
+	ctx      context.Context
+	filter   filterExpr
+	groupBy  []string
+	out      chan<- *processOut
+	stats    *queryStats
+	queued   time.Time
+	// part and parts place a chunk of partial aggregates within its
+	// group, as in processOut.
+	part, parts int
+}
+
+// output starts the result of processing a chunk.
+func (pi *processIn) output() *processOut {
+	return &processOut{key: pi.key, seq: pi.seq, part: pi.part,
+		parts: pi.parts}
+}
+
+// failed is the result of a chunk that couldn't be processed.
+func (pi *processIn) failed(err error) *processOut {
+	po := pi.output()
+	po.err = err
+	return po
 }
 
 type queryIn struct {
-	dbname     string
-	from       string
-	to         string
-	group      int
-	ptrs       []string
-	reds       []string
-	start      time.Time
-	before     time.Time
-	filters    []string
-	filtervals []string
-	started    int32
-	totalKeys  int32
-	out        chan *processOut
-	cherr      chan error
+	dbname  string
+	from    string
+	to      string
+	grouper grouper
+	ptrs    []string
+	reds    []string
+	start   time.Time
+	// ctx is canceled when the query times out or its client goes
+	// away, at which point all work on the query stops.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	filter  filterExpr
+	groupBy []string
+	fill    string
+	order   string
+	limit   int
+	windows []windowFunc
+	aliases []string
+	offsets []queryOffset
+	rank    *ranking
+	explain bool
+	// partial combines the partial aggregates of each reducer, if
+	// the query's groups are assembled from chunks of them.
+	partial []*partialAgg
+	// dbnames and combine describe the merged results of a query
+	// across several databases.
+	dbnames   []string
+	combine   string
+	groups    int32
+	started   int32
+	totalKeys int32
+	stats     queryStats
+	out       chan *processOut
+	cherr     chan error
+}
+
+// grouped reports whether a query's results are split into separate
+// series, by pointer values, by database, by time offset or by the
+// matches of wildcard pointers.
+func (q *queryIn) grouped() bool {
+	return len(q.groupBy) > 0 || len(q.dbnames) > 0 && q.combine == "" ||
+		len(q.offsets) > 0 || hasWildcards(q.ptrs)
 }
 
 func resolveFetch(j []byte, keys []string) map[string]interface{} {
@@ -83,70 +165,191 @@ func resolveFetch(j []byte, keys []string) map[string]interface{} {
 	return rv
 }
 
-func processDoc(di *gouchstore.DocumentInfo, chs []chan ptrval,
-	doc []byte, ptrs []string,
-	filters []string, filtervals []string,
-	included bool) {
+// groupEscaper escapes the separators within the parts of a group's
+// name, so values containing commas can't be confused for several.
+var groupEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`)
+
+// groupName joins the parts naming a group, escaping each.
+func groupName(parts ...string) string {
+	escaped := make([]string, len(parts))
+	for i, p := range parts {
+		escaped[i] = groupEscaper.Replace(p)
+	}
+	return strings.Join(escaped, ",")
+}
+
+// groupKey identifies the group a document belongs to by the values
+// of the query's group_by pointers.
+func groupKey(fetched map[string]interface{}, groupBy []string) []string {
+	parts := make([]string, 0, len(groupBy))
+	for _, g := range groupBy {
+		v, _ := filterString(fetched[g])
+		parts = append(parts, v)
+	}
+	return parts
+}
+
+// processDoc sends the values found in a document to the reducer
+// channels for the document's group.  chs returns the channels for a
+// group, or nil if the document should be dropped.  exprs holds the
+// parsed computed fields among ptrs, if any.  It reports whether the
+// document passed the filter.
+//
+// The values found by wildcard pointers go to a group for each match,
+// named after the match (following the group by values, if any).
+func processDoc(di *gouchstore.DocumentInfo,
+	chs func(group string, included bool) []chan ptrval,
+	doc []byte, ptrs []string, exprs []arithExpr, groupBy []string,
+	filter filterExpr, included bool) bool {
 
 	pv := ptrval{di, nil, included}
 
 	// Find all keys for filters and comparisons so we can do a
 	// single pass through the document.
-	keys := make([]string, 0, len(filters)+len(ptrs))
-	seen := map[string]bool{}
-	for _, f := range filters {
-		if !seen[f] {
-			keys = append(keys, f)
-			seen[f] = true
+	var filterPtrs []string
+	if filter != nil {
+		filterPtrs = filter.pointers(nil)
+	}
+	valuePtrs := valuePointers(ptrs, exprs)
+	var wild []string
+	for _, p := range valuePtrs {
+		if isWildcard(p) {
+			wild = append(wild, p)
 		}
 	}
-	for _, f := range ptrs {
-		if !seen[f] {
-			keys = append(keys, f)
-			seen[f] = true
+	if wild != nil {
+		// Wildcards are matched below the value at their prefix.
+		fetchPtrs := make([]string, 0, len(valuePtrs))
+		for _, p := range valuePtrs {
+			if isWildcard(p) {
+				p, _ = splitWildcard(p)
+			}
+			fetchPtrs = append(fetchPtrs, p)
+		}
+		valuePtrs = fetchPtrs
+	}
+	keys := make([]string, 0, len(filterPtrs)+len(valuePtrs)+len(groupBy))
+	seen := map[string]bool{}
+	for _, l := range [][]string{filterPtrs, valuePtrs, groupBy} {
+		for _, f := range l {
+			if !seen[f] {
+				keys = append(keys, f)
+				seen[f] = true
+			}
 		}
 	}
 
 	fetched := resolveFetch(doc, keys)
 
-	for i, p := range filters {
-		val := fetched[p]
-		checkVal := filtervals[i]
-		switch val.(type) {
-		case string:
-			if val != checkVal {
-				return
+	if filter != nil && !filter.eval(fetched) {
+		return false
+	}
+
+	send := func(group string, fetched map[string]interface{}) {
+		out := chs(group, included)
+		if out == nil {
+			return
+		}
+
+		for i, p := range ptrs {
+			val := fetched[p]
+			if p == "_id" {
+				val = di.ID
+			} else if exprs != nil && exprs[i] != nil {
+				val = nil
+				if f, ok := exprs[i].eval(fetched); ok {
+					val = f
+				}
 			}
-		case int, uint, int64, float64, uint64, bool:
-			v := fmt.Sprintf("%v", val)
-			if v != checkVal {
-				return
+			switch x := val.(type) {
+			case int, uint, int64, float64, uint64, bool:
+				v := fmt.Sprintf("%v", val)
+				pv.val = v
+				out[i] <- pv
+			default:
+				pv.val = x
+				out[i] <- pv
 			}
-		default:
-			return
 		}
 	}
 
-	for i, p := range ptrs {
-		val := fetched[p]
-		if p == "_id" {
-			val = di.ID
-		}
-		switch x := val.(type) {
-		case int, uint, int64, float64, uint64, bool:
-			v := fmt.Sprintf("%v", val)
-			pv.val = v
-			chs[i] <- pv
-		default:
-			pv.val = x
-			chs[i] <- pv
+	group := groupKey(fetched, groupBy)
+	if wild == nil {
+		send(groupName(group...), fetched)
+		return true
+	}
+	names, values := wildcardMatches(fetched, wild)
+	for i, name := range names {
+		send(groupName(append(group, name)...), values[i])
+	}
+	return true
+}
+
+// A seriesSet runs a copy of a query's reducers for each group of
+// documents within a chunk.
+type seriesSet struct {
+	reds    []reducer
+	chans   map[string][]chan ptrval
+	results map[string][]chan interface{}
+}
+
+func newSeriesSet(reds []reducer) *seriesSet {
+	return &seriesSet{
+		reds:    reds,
+		chans:   map[string][]chan ptrval{},
+		results: map[string][]chan interface{}{},
+	}
+}
+
+// channels returns the reducer inputs for a group, starting the
+// reducers if create is set and the group hasn't been seen.
+func (s *seriesSet) channels(group string, create bool) []chan ptrval {
+	if chs, ok := s.chans[group]; ok || !create {
+		return chs
+	}
+	chs := make([]chan ptrval, len(s.reds))
+	resultchs := make([]chan interface{}, len(s.reds))
+	for i := range s.reds {
+		chs[i] = make(chan ptrval)
+		resultchs[i] = make(chan interface{})
+
+		go func(fi int) {
+			resultchs[fi] <- s.reds[fi](chs[fi])
+		}(i)
+	}
+	s.chans[group] = chs
+	s.results[group] = resultchs
+	return chs
+}
+
+func (s *seriesSet) close() {
+	for _, chs := range s.chans {
+		closeAll(chs)
+	}
+}
+
+// collect gathers the reduced values for a group once the inputs
+// have been closed.
+func (s *seriesSet) collect(group string) []interface{} {
+	resultchs := s.results[group]
+	results := make([]interface{}, len(resultchs))
+	for i := range resultchs {
+		results[i] = <-resultchs[i]
+		if f, fok := results[i].(float64); fok &&
+			(math.IsNaN(f) || math.IsInf(f, 0)) {
+			results[i] = nil
 		}
 	}
+	return results
 }
 
 func processDocs(pi *processIn) {
+	started := pi.stats.chunkStarted(pi.queued)
+	matched := int64(0)
+	defer func() { pi.stats.chunkDone(started, matched) }()
 
-	result := processOut{pi.cacheKey, pi.key, nil, nil, 0}
+	result := pi.output()
+	result.cacheKey = pi.cacheKey
 
 	if len(pi.ptrs) == 0 {
 		log.Panicf("No pointers specified in query: %#v", *pi)
@@ -154,87 +357,163 @@ func processDocs(pi *processIn) {
 
 	db, err := dbopen(pi.dbname)
 	if err != nil {
-		result.err = err
-		pi.out <- &result
+		pi.out <- pi.failed(err)
 		return
 	}
 	defer closeDBConn(db)
 
-	chans := make([]chan ptrval, 0, len(pi.ptrs))
-	resultchs := make([]chan interface{}, 0, len(pi.ptrs))
-	for i, r := range pi.reds {
-		chans = append(chans, make(chan ptrval))
-		resultchs = append(resultchs, make(chan interface{}))
+	reds := make([]reducer, 0, len(pi.reds))
+	for _, r := range pi.reds {
+		var red reducer
+		if pi.parts > 0 {
+			red, _, err = findPartial(r)
+		} else {
+			red, err = findReducer(r)
+		}
+		if err != nil {
+			pi.out <- pi.failed(err)
+			return
+		}
+		reds = append(reds, red)
+	}
 
-		go func(fi int, fr string) {
-			resultchs[fi] <- reducers[fr](chans[fi])
-		}(i, r)
+	exprs, err := parsePointerExprs(pi.ptrs)
+	if err != nil {
+		pi.out <- pi.failed(err)
+		return
 	}
 
-	go func() {
-		defer closeAll(chans)
-
-		dodoc := func(di *gouchstore.DocumentInfo, included bool) {
-			doc, err := db.DocumentByDocumentInfo(di)
-			if err == nil {
-				processDoc(di, chans, doc.Body, pi.ptrs,
-					pi.filters, pi.filtervals, included)
-			} else {
-				for i := range pi.ptrs {
-					chans[i] <- ptrval{di, nil, included}
-				}
+	grouped := len(pi.groupBy) > 0 || hasWildcards(pi.ptrs)
+	series := newSeriesSet(reds)
+	if !grouped {
+		// Ungrouped queries always produce a result, even if
+		// nothing in the chunk matched.
+		series.channels("", true)
+	}
+
+	dodoc := func(di *gouchstore.DocumentInfo, included bool) {
+		doc, err := db.DocumentByDocumentInfo(di)
+		if err == nil {
+			if processDoc(di, series.channels, doc.Body, pi.ptrs,
+				exprs, pi.groupBy, pi.filter, included) && included {
+				matched++
+			}
+		} else if !grouped {
+			chans := series.channels("", true)
+			for i := range pi.ptrs {
+				chans[i] <- ptrval{di, nil, included}
 			}
 		}
+	}
 
-		for _, di := range pi.infos {
-			dodoc(di, true)
+	for _, di := range pi.infos {
+		if pi.ctx.Err() != nil {
+			break
 		}
-		if pi.nextInfo != nil {
-			dodoc(pi.nextInfo, false)
-		}
-	}()
+		dodoc(di, true)
+	}
+	if pi.nextInfo != nil && pi.ctx.Err() == nil {
+		dodoc(pi.nextInfo, false)
+	}
+	series.close()
 
-	results := make([]interface{}, len(pi.ptrs))
-	for i := 0; i < len(pi.ptrs); i++ {
-		results[i] = <-resultchs[i]
-		if f, fok := results[i].(float64); fok &&
-			(math.IsNaN(f) || math.IsInf(f, 0)) {
-			results[i] = nil
+	if !grouped {
+		result.value = series.collect("")
+	} else {
+		result.groups = make(map[string][]interface{}, len(series.chans))
+		for g := range series.chans {
+			result.groups[g] = series.collect(g)
 		}
 	}
-	result.value = results
+
+	if err := contextErr(pi.ctx); err != nil {
+		// The reducers have seen only part of the chunk.
+		pi.out <- pi.failed(err)
+		return
+	}
 
 	if result.cacheOpaque == 0 && result.cacheKey != "" {
 		// It's OK if we can't store our newly pulled item in
 		// the cache, but it's most definitely not OK to stop
 		// here because of this.
 		select {
-		case cacheInputSet <- &result:
+		case cacheInputSet <- result:
 		default:
 		}
 	}
-	pi.out <- &result
+	pi.out <- result
+}
+
+// contextErr reports why a query's context was canceled, if it was.
+func contextErr(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return errTimeout
+	}
+	return errCanceled
 }
 
 func docProcessor(ch <-chan *processIn) {
 	for pi := range ch {
-		if time.Now().Before(pi.before) {
-			processDocs(pi)
+		if err := contextErr(pi.ctx); err != nil {
+			pi.out <- pi.failed(err)
 		} else {
-			pi.out <- &processOut{"", pi.key, nil, errTimeout, 0}
+			processDocs(pi)
 		}
 	}
 }
 
-func fetchDocs(dbname string, key int64, infos []*gouchstore.DocumentInfo,
-	nextInfo *gouchstore.DocumentInfo, ptrs []string, reds []string,
-	filters []string, filtervals []string,
-	before time.Time, out chan<- *processOut) {
+// fetchDocs starts processing the documents of a group.  Each of
+// parts is processed as a separate chunk of partial aggregates if
+// the query assembles its groups from them; otherwise there's a
+// single part.
+func fetchDocs(q *queryIn, key int64, parts [][]*gouchstore.DocumentInfo,
+	nextInfo *gouchstore.DocumentInfo) {
+
+	seq := atomic.AddInt32(&q.groups, 1)
+	for n, infos := range parts {
+		i := processIn{
+			dbname:   q.dbname,
+			key:      key,
+			seq:      seq,
+			infos:    infos,
+			nextInfo: nextInfo,
+			ptrs:     q.ptrs,
+			reds:     q.reds,
+			ctx:      q.ctx,
+			filter:   q.filter,
+			groupBy:  q.groupBy,
+			out:      q.out,
+			stats:    &q.stats,
+			queued:   time.Now(),
+		}
+		if q.partial != nil {
+			// Partial aggregates never look past their
+			// chunk.
+			i.nextInfo = nil
+			i.part, i.parts = n, len(parts)
+		}
 
-	i := processIn{"", dbname, key, infos, nextInfo,
-		ptrs, reds, before, filters, filtervals, out}
+		atomic.AddInt32(&q.started, 1)
+		cacheInput <- &i
+	}
+}
 
-	cacheInput <- &i
+// partEnd finds the end of the chunk of partial aggregates starting
+// at t within a group ending at groupEnd.  Chunks are aligned to the
+// epoch so they're the same whatever the grouping, and so can be
+// shared through the cache by queries grouping differently.
+func (q *queryIn) partEnd(t, groupEnd int64) int64 {
+	if q.partial == nil {
+		return groupEnd
+	}
+	size := int64(*partialChunk)
+	if end := (t/size + 1) * size; end < groupEnd {
+		return end
+	}
+	return groupEnd
 }
 
 func runQuery(q *queryIn) {
@@ -242,8 +521,8 @@ func runQuery(q *queryIn) {
 		q.cherr <- fmt.Errorf("at least one pointer is required")
 		return
 	}
-	if q.group == 0 {
-		q.cherr <- fmt.Errorf("group level cannot be zero")
+	if q.grouper == nil {
+		q.cherr <- fmt.Errorf("no grouping specified")
 		return
 	}
 
@@ -255,33 +534,68 @@ func runQuery(q *queryIn) {
 	}
 	defer closeDBConn(db)
 
-	chunk := int64(time.Duration(q.group) * time.Millisecond)
-
+	scanStart := time.Now()
 	infos := []*gouchstore.DocumentInfo{}
-	g := int64(0)
-	nextg := ""
+	var parts [][]*gouchstore.DocumentInfo
+	g, nextgi := int64(0), int64(0)
+	nextg, nextp := "", ""
+
+	// When only the first or last few chunks can appear in the
+	// results, there's no need to process the rest.
+	limit := q.chunkLimit()
+	type chunk struct {
+		key      int64
+		parts    [][]*gouchstore.DocumentInfo
+		nextInfo *gouchstore.DocumentInfo
+	}
+	var tail []chunk
+	startChunk := func(key int64, parts [][]*gouchstore.DocumentInfo,
+		nextInfo *gouchstore.DocumentInfo) error {
+		switch {
+		case limit == 0:
+			fetchDocs(q, key, parts, nextInfo)
+		case q.order == orderDesc:
+			if len(tail) == limit {
+				tail = append(tail[:0], tail[1:]...)
+			}
+			tail = append(tail, chunk{key, parts, nextInfo})
+		default:
+			fetchDocs(q, key, parts, nextInfo)
+			if atomic.LoadInt32(&q.groups) >= int32(limit) {
+				return errLimitReached
+			}
+		}
+		return nil
+	}
 
 	err = db.AllDocuments(q.from, q.to, func(db *gouchstore.Gouchstore, di *gouchstore.DocumentInfo, userContext interface{}) error {
 		kstr := di.ID
 		var err error
 
+		if err := contextErr(q.ctx); err != nil {
+			return err
+		}
 		atomic.AddInt32(&q.totalKeys, 1)
 
-		if kstr >= nextg {
+		switch {
+		case kstr >= nextg:
 			if len(infos) > 0 {
-				atomic.AddInt32(&q.started, 1)
-				fetchDocs(q.dbname, g, infos, di,
-					q.ptrs, q.reds, q.filters, q.filtervals,
-					q.before, q.out)
+				parts = append(parts, infos)
+				if err := startChunk(g, parts, di); err != nil {
+					return err
+				}
 
 				infos = make([]*gouchstore.DocumentInfo, 0, len(infos))
+				parts = nil
 			}
 
-			k := parseKey(kstr)
-			g = (k / chunk) * chunk
-			nextgi := g + chunk
-			nextgt := time.Unix(nextgi/1e9, nextgi%1e9).UTC()
-			nextg = nextgt.Format(time.RFC3339Nano)
+			g, nextgi = q.grouper.bucket(parseKey(kstr))
+			nextg = keyString(nextgi)
+			nextp = keyString(q.partEnd(parseKey(kstr), nextgi))
+		case kstr >= nextp:
+			parts = append(parts, infos)
+			infos = make([]*gouchstore.DocumentInfo, 0, len(infos))
+			nextp = keyString(q.partEnd(parseKey(kstr), nextgi))
 		}
 		infos = append(infos, di)
 
@@ -289,47 +603,44 @@ func runQuery(q *queryIn) {
 	}, nil)
 
 	if err == nil && len(infos) > 0 {
-		atomic.AddInt32(&q.started, 1)
-		fetchDocs(q.dbname, g, infos, nil,
-			q.ptrs, q.reds, q.filters, q.filtervals,
-			q.before, q.out)
+		startChunk(g, append(parts, infos), nil)
+	}
+	if err == errLimitReached {
+		err = nil
+	}
+	for _, c := range tail {
+		fetchDocs(q, c.key, c.parts, c.nextInfo)
 	}
+	q.stats.scanning = time.Since(scanStart)
 
 	q.cherr <- err
 }
 
 func queryExecutor() {
 	for q := range queryInput {
-		if time.Now().Before(q.before) {
-			runQuery(q)
+		if err := contextErr(q.ctx); err != nil {
+			log.Printf("Dropping query queued for %v: %v",
+				time.Since(q.start), err)
+			q.cherr <- err
 		} else {
-			log.Printf("Timed out query that's %v late",
-				time.Since(q.before))
-			q.cherr <- errTimeout
+			q.stats.queued = time.Since(q.start)
+			runQuery(q)
 		}
 	}
 }
 
-func executeQuery(dbname, from, to string, group int,
-	ptrs, reds, filters, filtervals []string) *queryIn {
-	now := time.Now()
-
-	rv := &queryIn{
-		dbname:     dbname,
-		from:       from,
-		to:         to,
-		group:      group,
-		ptrs:       ptrs,
-		reds:       reds,
-		start:      now,
-		before:     now.Add(*queryTimeout),
-		filters:    filters,
-		filtervals: filtervals,
-		out:        make(chan *processOut),
-		cherr:      make(chan error),
-	}
-	queryInput <- rv
-	return rv
+// executeQuery submits a query for processing.  Results are
+// delivered on the query's out channel.  The query stops early if
+// ctx is canceled (e.g. when the requesting client disconnects).
+func executeQuery(ctx context.Context, q *queryIn) *queryIn {
+	q.start = time.Now()
+	q.ctx, q.cancel = context.WithTimeout(ctx, *queryTimeout)
+	q.partial = queryPartials(q.reds)
+	q.out = make(chan *processOut)
+	q.cherr = make(chan error)
+
+	queryInput <- q
+	return q
 }
 
 var processorInput chan *processIn
@@ -355,216 +666,206 @@ func convertTofloat64(in chan ptrval) chan float64 {
 	return ch
 }
 
-func convertTofloat64Rate(in chan ptrval) chan float64 {
-	ch := make(chan float64)
-	go func() {
-		defer close(ch)
-		var prevts int64
-		var preval float64
-
-		// First, find a part of the stream that has usable data.
-	FIND_USABLE:
-		for v := range in {
-			if v.di != nil && v.val != nil {
-				switch value := v.val.(type) {
-				case string:
-					x, err := strconv.ParseFloat(value, 64)
-					if err == nil {
-						prevts = parseKey(v.di.ID)
-						preval = x
-						break FIND_USABLE
-					}
+func init() {
+	registerReducer(reducerInfo{
+		Name:        "identity",
+		Description: "Every included value",
+		Input:       inputAny,
+		Mergeable:   true,
+		partial:     concatPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := []interface{}{}
+			for s := range input {
+				if s.included {
+					rv = append(rv, s.val)
 				}
 			}
-		}
-		// Then emit floats based on deltas from previous values.
-		for v := range in {
-			if v.di != nil && v.val != nil {
-				switch value := v.val.(type) {
-				case string:
-					x, err := strconv.ParseFloat(value, 64)
-					if err == nil {
-						thists := parseKey(v.di.ID)
-
-						val := ((x - preval) /
-							(float64(thists-prevts) / 1e9))
-
-						if !(math.IsNaN(val) || math.IsInf(val, 0)) {
-							ch <- val
-						}
-
-						prevts = thists
-						preval = x
-					}
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "any",
+		Description: "Some non-null value",
+		Input:       inputAny,
+		Mergeable:   true,
+		partial:     anyPartial,
+		reduce: func(input chan ptrval) interface{} {
+			var rv interface{}
+			for v := range input {
+				if rv == nil && v.included && v.val != nil {
+					rv = v.val
 				}
 			}
-		}
-	}()
-
-	return ch
-}
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "distinct",
+		Description: "The distinct scalar values",
+		Input:       inputAny,
+		Mergeable:   true,
+		partial:     unionPartial,
+		reduce: func(input chan ptrval) interface{} {
+			uvm := map[interface{}]bool{}
+			for v := range input {
+				if v.included {
+
+					switch value := v.val.(type) {
+					case map[string]interface{}:
+					case []interface{}:
+						//unhashable
+						continue
+					default:
+						uvm[value] = true
+					}
 
-var reducers = map[string]reducer{
-	"identity": func(input chan ptrval) interface{} {
-		rv := []interface{}{}
-		for s := range input {
-			if s.included {
-				rv = append(rv, s.val)
+				}
 			}
-		}
-		return rv
-	},
-	"any": func(input chan ptrval) interface{} {
-		var rv interface{}
-		for v := range input {
-			if rv == nil && v.included && v.val != nil {
-				rv = v.val
+			rv := make([]interface{}, 0, len(uvm))
+			for k := range uvm {
+				rv = append(rv, k)
 			}
-		}
-		return rv
-	},
-	"distinct": func(input chan ptrval) interface{} {
-		uvm := map[interface{}]bool{}
-		for v := range input {
-			if v.included {
-
-				switch value := v.val.(type) {
-				case map[string]interface{}:
-				case []interface{}:
-					//unhashable
-					continue
-				default:
-					uvm[value] = true
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "count",
+		Description: "The number of non-null values",
+		Input:       inputAny,
+		Mergeable:   true,
+		partial:     sumPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := 0
+			for v := range input {
+				if v.included && v.val != nil {
+					rv++
 				}
-
 			}
-		}
-		rv := make([]interface{}, 0, len(uvm))
-		for k := range uvm {
-			rv = append(rv, k)
-		}
-		return rv
-	},
-	"count": func(input chan ptrval) interface{} {
-		rv := 0
-		for v := range input {
-			if v.included && v.val != nil {
-				rv++
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "sum",
+		Description: "The sum of the values",
+		Input:       inputNumber,
+		Mergeable:   true,
+		partial:     sumPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := float64(0)
+			for v := range convertTofloat64(input) {
+				rv += v
 			}
-		}
-		return rv
-	},
-	"sum": func(input chan ptrval) interface{} {
-		rv := float64(0)
-		for v := range convertTofloat64(input) {
-			rv += v
-		}
-		return rv
-	},
-	"sumsq": func(input chan ptrval) interface{} {
-		rv := float64(0)
-		for v := range convertTofloat64(input) {
-			rv += (v * v)
-		}
-		return rv
-	},
-	"max": func(input chan ptrval) interface{} {
-		rv := math.NaN()
-		for v := range convertTofloat64(input) {
-			if v > rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
-				rv = v
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "sumsq",
+		Description: "The sum of the squares of the values",
+		Input:       inputNumber,
+		Mergeable:   true,
+		partial:     sumPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := float64(0)
+			for v := range convertTofloat64(input) {
+				rv += (v * v)
 			}
-		}
-		return rv
-	},
-	"min": func(input chan ptrval) interface{} {
-		rv := math.NaN()
-		for v := range convertTofloat64(input) {
-			if v < rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
-				rv = v
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "max",
+		Description: "The largest value",
+		Input:       inputNumber,
+		Mergeable:   true,
+		partial:     maxPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := math.NaN()
+			for v := range convertTofloat64(input) {
+				if v > rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
+					rv = v
+				}
 			}
-		}
-		return rv
-	},
-	"avg": func(input chan ptrval) interface{} {
-		nums := float64(0)
-		sum := float64(0)
-		for v := range convertTofloat64(input) {
-			nums++
-			sum += v
-		}
-		if nums > 0 {
-			return sum / nums
-		}
-		return math.NaN()
-	},
-	"c": func(input chan ptrval) interface{} {
-		sum := float64(0)
-		for v := range convertTofloat64Rate(input) {
-			sum += v
-		}
-		return sum
-	},
-	"c_min": func(input chan ptrval) interface{} {
-		rv := math.NaN()
-		for v := range convertTofloat64Rate(input) {
-			if v < rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
-				rv = v
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "min",
+		Description: "The smallest value",
+		Input:       inputNumber,
+		Mergeable:   true,
+		partial:     minPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := math.NaN()
+			for v := range convertTofloat64(input) {
+				if v < rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
+					rv = v
+				}
 			}
-		}
-		return rv
-	},
-	"c_avg": func(input chan ptrval) interface{} {
-		nums := float64(0)
-		sum := float64(0)
-		for v := range convertTofloat64Rate(input) {
-			nums++
-			sum += v
-		}
-		if nums > 0 {
-			return sum / nums
-		}
-		return math.NaN()
-	},
-	"c_max": func(input chan ptrval) interface{} {
-		rv := math.NaN()
-		for v := range convertTofloat64Rate(input) {
-			if v > rv || math.IsNaN(rv) || math.IsInf(rv, 0) {
-				rv = v
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "avg",
+		Description: "The mean of the values",
+		Input:       inputNumber,
+		partial:     avgPartial,
+		reduce: func(input chan ptrval) interface{} {
+			nums := float64(0)
+			sum := float64(0)
+			for v := range convertTofloat64(input) {
+				nums++
+				sum += v
 			}
-		}
-		return rv
-	},
-	"obj_keys": func(input chan ptrval) interface{} {
-		rv := []string{}
-		for v := range input {
-			if v.included {
-				switch value := v.val.(type) {
-				case map[string]interface{}:
-					for mapk := range value {
-						rv = append(rv, mapk)
+			if nums > 0 {
+				return sum / nums
+			}
+			return math.NaN()
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "obj_keys",
+		Description: "The keys of every object value",
+		Input:       inputObject,
+		Mergeable:   true,
+		partial:     concatPartial,
+		reduce: func(input chan ptrval) interface{} {
+			rv := []string{}
+			for v := range input {
+				if v.included {
+					switch value := v.val.(type) {
+					case map[string]interface{}:
+						for mapk := range value {
+							rv = append(rv, mapk)
+						}
 					}
 				}
 			}
-		}
-		return rv
-	},
-	"obj_distinct_keys": func(input chan ptrval) interface{} {
-		ukm := map[string]bool{}
-		for v := range input {
-			if v.included {
-				switch value := v.val.(type) {
-				case map[string]interface{}:
-					for mapk := range value {
-						ukm[mapk] = true
+			return rv
+		},
+	})
+	registerReducer(reducerInfo{
+		Name:        "obj_distinct_keys",
+		Description: "The distinct keys of the object values",
+		Input:       inputObject,
+		Mergeable:   true,
+		partial:     unionPartial,
+		reduce: func(input chan ptrval) interface{} {
+			ukm := map[string]bool{}
+			for v := range input {
+				if v.included {
+					switch value := v.val.(type) {
+					case map[string]interface{}:
+						for mapk := range value {
+							ukm[mapk] = true
+						}
 					}
 				}
 			}
-		}
-		rv := make([]string, 0, len(ukm))
-		for k := range ukm {
-			rv = append(rv, k)
-		}
-		return rv
-	},
+			rv := make([]string, 0, len(ukm))
+			for k := range ukm {
+				rv = append(rv, k)
+			}
+			return rv
+		},
+	})
 }
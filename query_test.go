@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"io/ioutil"
 	"math"
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -51,7 +53,7 @@ func streamCollection(s []interface{}) chan ptrval {
 
 func TestEmptyRateConversion(t *testing.T) {
 	ch := make(chan ptrval)
-	rch := convertTofloat64Rate(ch)
+	rch := convertTofloat64Rate(ch, 0)
 	close(ch)
 	val, got := <-rch
 	if got {
@@ -61,7 +63,7 @@ func TestEmptyRateConversion(t *testing.T) {
 
 func TestSingleRateConversion(t *testing.T) {
 	ch := make(chan ptrval, 1)
-	rch := convertTofloat64Rate(ch)
+	rch := convertTofloat64Rate(ch, 0)
 	ch <- ptrval{nil, &nextValue, true}
 	close(ch)
 	val, got := <-rch
@@ -72,7 +74,7 @@ func TestSingleRateConversion(t *testing.T) {
 
 func TestPairRateConversion(t *testing.T) {
 	ch := make(chan ptrval, 2)
-	rch := convertTofloat64Rate(ch)
+	rch := convertTofloat64Rate(ch, 0)
 
 	tm := time.Now().UTC()
 	val1 := "20"
@@ -107,10 +109,13 @@ func TestReducers(t *testing.T) {
 		{"max", float64(63)},
 		{"min", float64(17)},
 		{"avg", float64(37)},
-		{"c", float64(10.5)},
-		{"c_min", float64(-23)},
-		{"c_avg", float64(3.5)},
+		// 63 -> 17 is a counter reset
+		{"c", float64(42)},
+		{"c_min", float64(1.5)},
+		{"c_avg", float64(14)},
 		{"c_max", float64(32)},
+		{"increase", float64(61)},
+		{"delta", float64(-2)},
 		{"identity", testInput},
 		{"obj_keys", []string{"key", "key", "key"}},
 		{"obj_distinct_keys", []string{"key"}},
@@ -172,6 +177,8 @@ func TestEmptyReducers(t *testing.T) {
 		{"c_min", math.NaN()},
 		{"c_avg", math.NaN()},
 		{"c_max", math.NaN()},
+		{"increase", 0.0},
+		{"delta", 0.0},
 		{"identity", emptyInput},
 		{"obj_keys", []string{}},
 		{"obj_distinct_keys", []string{}},
@@ -214,6 +221,8 @@ func TestNilReducers(t *testing.T) {
 		{"c_min", math.NaN()},
 		{"c_avg", math.NaN()},
 		{"c_max", math.NaN()},
+		{"increase", 0.0},
+		{"delta", 0.0},
 		{"identity", emptyInput},
 		{"obj_keys", []string{}},
 		{"obj_distinct_keys", []string{}},
@@ -253,7 +262,9 @@ func TestPointers(t *testing.T) {
 	for _, test := range tests {
 		chans := make([]chan ptrval, 0, 1)
 		chans = append(chans, make(chan ptrval))
-		go processDoc(di, chans, bigInput, []string{test.pointer}, []string{}, []string{}, true)
+		go processDoc(di, func(string, bool) []chan ptrval {
+			return chans
+		}, bigInput, []string{test.pointer}, nil, nil, nil, true)
 		got := <-chans[0]
 		if test.exp != got.val {
 			t.Errorf("Expected %v for %v, got %v",
@@ -262,3 +273,96 @@ func TestPointers(t *testing.T) {
 	}
 
 }
+
+func TestGroupedProcessDoc(t *testing.T) {
+	di := gouchstore.NewDocumentInfo("2013-02-22T16:29:19.750264Z")
+	tests := []struct {
+		groupBy []string
+		exp     string
+	}{
+		{nil, ""},
+		{[]string{"/kind"}, "Listing"},
+		{[]string{"/kind", "/data/after"}, "Listing,t3_w4nqz"},
+		{[]string{"/nothere"}, ""},
+	}
+
+	for _, test := range tests {
+		var got string
+		ch := make(chan ptrval, 1)
+		processDoc(di, func(g string, included bool) []chan ptrval {
+			got = g
+			return []chan ptrval{ch}
+		}, bigInput, []string{"/kind"}, nil, test.groupBy, nil, true)
+		if got != test.exp {
+			t.Errorf("Expected group %q for %v, got %q",
+				test.exp, test.groupBy, got)
+		}
+	}
+}
+
+func TestGroupName(t *testing.T) {
+	a := groupName(groupKey(map[string]interface{}{"/a": "a,b", "/b": "c"},
+		[]string{"/a", "/b"})...)
+	b := groupName(groupKey(map[string]interface{}{"/a": "a", "/b": "b,c"},
+		[]string{"/a", "/b"})...)
+	if a != `a\,b,c` || b != `a,b\,c` {
+		t.Errorf("Expected distinct escaped groups, got %q and %q", a, b)
+	}
+	if got := groupName(`a\`, "b"); got != `a\\,b` {
+		t.Errorf("Expected escaped backslash, got %q", got)
+	}
+	if got := groupName("host1"); got != "host1" {
+		t.Errorf("Expected plain group unchanged, got %q", got)
+	}
+}
+
+func TestSeriesSet(t *testing.T) {
+	s := newSeriesSet([]reducer{reducers["count"], reducers["max"]})
+	if chs := s.channels("a", false); chs != nil {
+		t.Fatalf("Expected no channels before creation, got %v", chs)
+	}
+	for i, g := range []string{"a", "b", "a"} {
+		chs := s.channels(g, true)
+		v := ptrval{nil, strconv.Itoa(i), true}
+		chs[0] <- v
+		chs[1] <- v
+	}
+	s.close()
+
+	exp := map[string][]interface{}{
+		"a": {2, float64(2)},
+		"b": {1, float64(1)},
+	}
+	for g, e := range exp {
+		if got := s.collect(g); !reflect.DeepEqual(got, e) {
+			t.Errorf("Expected %v for %v, got %v", e, g, got)
+		}
+	}
+}
+
+func TestCanceledChunk(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	ch := make(chan *processIn)
+	defer close(ch)
+	go docProcessor(ch)
+
+	for _, test := range []struct {
+		ctx context.Context
+		exp error
+	}{
+		{ctx, errCanceled},
+		{expired, errTimeout},
+	} {
+		out := make(chan *processOut, 1)
+		ch <- &processIn{key: 5, seq: 2, ptrs: []string{"/x"},
+			ctx: test.ctx, out: out}
+		po := <-out
+		if po.err != test.exp || po.key != 5 || po.seq != 2 {
+			t.Errorf("Expected %v for chunk 5/2, got %+v", test.exp, po)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// maxQueryBody limits the size of a JSON query body.
+const maxQueryBody = 1 << 20
+
+// queryBody is a query given as a JSON request body rather than as
+// parameters.  It's how serieslyclient.Query encodes itself in JSON.
+type queryBody struct {
+	// From, To and Group may be numbers (milliseconds) or strings.
+	From     interface{} `json:"from"`
+	To       interface{} `json:"to"`
+	Group    interface{} `json:"group"`
+	Interval string      `json:"interval"`
+	TimeZone string      `json:"timezone"`
+	Fields   []struct {
+		Pointer string `json:"pointer"`
+		Reducer string `json:"reducer"`
+		Alias   string `json:"alias"`
+	} `json:"fields"`
+	Filters []struct {
+		Pointer string `json:"pointer"`
+		Op      string `json:"op"`
+		Match   string `json:"match"`
+	} `json:"filters"`
+	GroupBy   []string `json:"group_by"`
+	Where     string   `json:"where"`
+	Fill      string   `json:"fill"`
+	Databases []string `json:"databases"`
+	Combine   string   `json:"combine"`
+	Format    string   `json:"format"`
+	Order     string   `json:"order"`
+	Limit     int      `json:"limit"`
+	Windows   []struct {
+		// Field is a position among the fields or a field's alias.
+		Field    interface{} `json:"field"`
+		Function string      `json:"function"`
+		Alias    string      `json:"alias"`
+	} `json:"windows"`
+	Top     int      `json:"top"`
+	Bottom  int      `json:"bottom"`
+	RankBy  string   `json:"rank_by"`
+	Offsets []string `json:"offsets"`
+	Explain bool     `json:"explain"`
+}
+
+// jsonParam converts a number or string from a query body to a
+// parameter value.
+func jsonParam(name string, v interface{}) (string, error) {
+	switch x := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return x, nil
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), nil
+	}
+	return "", paramError{"Bad " + name + " value", fmt.Sprint(v)}
+}
+
+// params converts a query body to the equivalent query parameters.
+func (b *queryBody) params() (url.Values, error) {
+	rv := url.Values{}
+	set := func(k, v string) {
+		if v != "" {
+			rv.Set(k, v)
+		}
+	}
+	for _, p := range []struct {
+		name string
+		v    interface{}
+	}{{"from", b.From}, {"to", b.To}, {"group", b.Group}} {
+		v, err := jsonParam(p.name, p.v)
+		if err != nil {
+			return nil, err
+		}
+		set(p.name, v)
+	}
+	set("group", b.Interval)
+	set("tz", b.TimeZone)
+
+	// Aliases name the fields and then the windows, so unnamed
+	// ones need a placeholder if any later one has a name.
+	var aliases []string
+	named := false
+	fieldIndex := map[string]int{}
+	for i, f := range b.Fields {
+		rv["ptr"] = append(rv["ptr"], f.Pointer)
+		rv["reducer"] = append(rv["reducer"], f.Reducer)
+		aliases = append(aliases, f.Alias)
+		named = named || f.Alias != ""
+		if f.Alias != "" {
+			fieldIndex[f.Alias] = i
+		}
+	}
+	for _, w := range b.Windows {
+		var field int
+		switch x := w.Field.(type) {
+		case float64:
+			field = int(x)
+		case string:
+			i, ok := fieldIndex[x]
+			if !ok {
+				return nil, paramError{"Bad window value",
+					fmt.Sprintf("no field %q", x)}
+			}
+			field = i
+		default:
+			return nil, paramError{"Bad window value",
+				fmt.Sprintf("bad field %v", w.Field)}
+		}
+		rv["window"] = append(rv["window"],
+			strconv.Itoa(field)+":"+w.Function)
+		aliases = append(aliases, w.Alias)
+		named = named || w.Alias != ""
+	}
+	if named {
+		rv["alias"] = aliases
+	}
+
+	for _, f := range b.Filters {
+		op := f.Op
+		if op == "" {
+			op = "="
+		}
+		rv["f"] = append(rv["f"], f.Pointer)
+		rv["fv"] = append(rv["fv"], f.Match)
+		rv["fo"] = append(rv["fo"], op)
+	}
+	rv["group_by"] = b.GroupBy
+	set("where", b.Where)
+	set("fill", b.Fill)
+	rv["db"] = b.Databases
+	set("combine", b.Combine)
+	set("format", b.Format)
+	set("order", b.Order)
+	if b.Limit > 0 {
+		rv.Set("limit", strconv.Itoa(b.Limit))
+	}
+	if b.Top > 0 {
+		rv.Set("top", strconv.Itoa(b.Top))
+	}
+	if b.Bottom > 0 {
+		rv.Set("bottom", strconv.Itoa(b.Bottom))
+	}
+
+	rankBy := b.RankBy
+	col, combine := rankBy, ""
+	if i := strings.Index(rankBy, ":"); i >= 0 {
+		col, combine = rankBy[:i], rankBy[i:]
+	}
+	for i, a := range aliases {
+		if a != "" && a == col {
+			rankBy = strconv.Itoa(i) + combine
+		}
+	}
+	set("rank_by", rankBy)
+	rv["offset"] = b.Offsets
+	if b.Explain {
+		rv.Set("explain", "true")
+	}
+
+	for k, v := range rv {
+		if len(v) == 0 {
+			delete(rv, k)
+		}
+	}
+	return rv, nil
+}
+
+// parseQueryBody reads a JSON query body into the request's form,
+// where its parameters replace any given in the URL.
+func parseQueryBody(req *http.Request) error {
+	req.ParseForm()
+	defer req.Body.Close()
+
+	var b queryBody
+	d := json.NewDecoder(io.LimitReader(req.Body, maxQueryBody))
+	if err := d.Decode(&b); err != nil {
+		return paramError{"Bad query body", err.Error()}
+	}
+	params, err := b.params()
+	if err != nil {
+		return err
+	}
+	for k, v := range params {
+		req.Form[k] = v
+	}
+	return nil
+}
+
+func postQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	if err := parseQueryBody(req); err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	query(args, w, req)
+}
+
+func postMultiQuery(args []string, w http.ResponseWriter, req *http.Request) {
+	if err := parseQueryBody(req); err != nil {
+		emitQueryError(w, err)
+		return
+	}
+	multiQuery(args, w, req)
+}
+
+// parseAliases checks the names given to a query's columns.  Columns
+// may be left unnamed with an empty alias.
+func parseAliases(aliases []string, ncolumns int) ([]string, error) {
+	if len(aliases) == 0 {
+		return nil, nil
+	}
+	if len(aliases) > ncolumns {
+		return nil, paramError{"Parameter mismatch",
+			"More aliases than fields and windows"}
+	}
+	seen := map[string]bool{}
+	for _, a := range aliases {
+		if a != "" && seen[a] {
+			return nil, paramError{"Bad alias value",
+				fmt.Sprintf("duplicate alias %q", a)}
+		}
+		seen[a] = true
+	}
+	return aliases, nil
+}
+
+// columnNames names each column of a query's results, or is nil if
+// none of them have aliases and rows should be reported as arrays.
+// Unnamed columns are named as in CSV headers.
+func (q *queryIn) columnNames() []string {
+	if len(q.aliases) == 0 {
+		return nil
+	}
+	cols := q.columns()
+	rv := make([]string, len(cols))
+	for i, c := range cols {
+		rv[i] = c.String()
+	}
+	return rv
+}
+
+// checkColumnNames makes sure no two columns of named rows share a
+// name, including the generated names of unnamed columns.
+func (q *queryIn) checkColumnNames() error {
+	seen := map[string]bool{}
+	for _, n := range q.columnNames() {
+		if seen[n] {
+			return paramError{"Bad alias value",
+				fmt.Sprintf("duplicate column name %q", n)}
+		}
+		seen[n] = true
+	}
+	return nil
+}
+
+// namedRow keys the values of a row by column name.
+func namedRow(names []string, row []interface{}) map[string]interface{} {
+	rv := make(map[string]interface{}, len(row))
+	for i, v := range row {
+		if i < len(names) {
+			rv[names[i]] = v
+		}
+	}
+	return rv
+}
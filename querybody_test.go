@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dustin/seriesly/serieslyclient"
+)
+
+func TestQueryBodyParams(t *testing.T) {
+	body := `{
+		"from": 1000, "to": "2020-01-01", "group": 60000,
+		"fields": [
+			{"pointer": "/cpu", "reducer": "avg", "alias": "cpu"},
+			{"pointer": "/mem", "reducer": "max"}
+		],
+		"filters": [
+			{"pointer": "/host", "match": "a"},
+			{"pointer": "/load", "op": ">", "match": "2"}
+		],
+		"group_by": ["/dc"],
+		"windows": [{"field": "cpu", "function": "cumsum", "alias": "total"}],
+		"top": 3, "rank_by": "total:max"
+	}`
+	var b queryBody
+	if err := json.Unmarshal([]byte(body), &b); err != nil {
+		t.Fatalf("Error parsing body: %v", err)
+	}
+	got, err := b.params()
+	if err != nil {
+		t.Fatalf("Error converting body: %v", err)
+	}
+	exp := url.Values{
+		"from":     {"1000"},
+		"to":       {"2020-01-01"},
+		"group":    {"60000"},
+		"ptr":      {"/cpu", "/mem"},
+		"reducer":  {"avg", "max"},
+		"alias":    {"cpu", "", "total"},
+		"f":        {"/host", "/load"},
+		"fv":       {"a", "2"},
+		"fo":       {"=", ">"},
+		"group_by": {"/dc"},
+		"window":   {"0:cumsum"},
+		"top":      {"3"},
+		"rank_by":  {"2:max"},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	bad := []string{
+		`{"from": true}`,
+		`{"fields": [{"pointer": "/a", "reducer": "avg"}],
+		  "windows": [{"field": "nope", "function": "cumsum"}]}`,
+	}
+	for _, s := range bad {
+		var b queryBody
+		if err := json.Unmarshal([]byte(s), &b); err != nil {
+			t.Fatalf("Error parsing %v: %v", s, err)
+		}
+		if got, err := b.params(); err == nil {
+			t.Errorf("Expected error for %v, got %v", s, got)
+		}
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	if got, err := parseAliases(nil, 2); err != nil || got != nil {
+		t.Errorf("Expected no aliases, got %v, %v", got, err)
+	}
+	if _, err := parseAliases([]string{"a", "", ""}, 3); err != nil {
+		t.Errorf("Error with unnamed columns: %v", err)
+	}
+	for _, a := range [][]string{{"a", "b", "c"}, {"a", "a"}} {
+		if _, err := parseAliases(a, 2); err == nil {
+			t.Errorf("Expected error for %v", a)
+		}
+	}
+}
+
+func TestCheckColumnNames(t *testing.T) {
+	tests := []struct {
+		q  *queryIn
+		ok bool
+	}{
+		{&queryIn{ptrs: []string{"/x", "/x"}, reds: []string{"avg", "avg"}}, true},
+		{&queryIn{ptrs: []string{"/x", "/x", "/y"},
+			reds:    []string{"avg", "avg", "max"},
+			aliases: []string{"", "", "m"}}, false},
+		{&queryIn{ptrs: []string{"/x", "/y"}, reds: []string{"avg", "max"},
+			aliases: []string{"max(/y)"}}, false},
+		{&queryIn{ptrs: []string{"/x"}, reds: []string{"avg"},
+			windows: []windowFunc{{field: 0, spec: "delta"}, {field: 0, spec: "delta"}},
+			aliases: []string{"a"}}, false},
+		{&queryIn{ptrs: []string{"/x", "/y"}, reds: []string{"avg", "max"},
+			aliases: []string{"", "m"}}, true},
+	}
+	for _, test := range tests {
+		if err := test.q.checkColumnNames(); (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %v, got %v",
+				test.ok, test.q.columnNames(), err)
+		}
+	}
+}
+
+func TestNamedResults(t *testing.T) {
+	q := &queryIn{
+		ptrs:    []string{"/cpu", "/mem"},
+		reds:    []string{"avg", "max"},
+		aliases: []string{"cpu"},
+	}
+	names := q.columnNames()
+	if exp := []string{"cpu", "max(/mem)"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("Expected names %v, got %v", exp, names)
+	}
+
+	po := &processOut{value: []interface{}{1.5, 3.0}}
+	exp := map[string]interface{}{"cpu": 1.5, "max(/mem)": 3.0}
+	if got := po.result(names); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+
+	po = &processOut{groups: map[string][]interface{}{
+		"a": {1.5, 3.0},
+	}}
+	gexp := map[string]interface{}{"a": exp}
+	if got := po.result(names); !reflect.DeepEqual(got, gexp) {
+		t.Errorf("Expected %v, got %v", gexp, got)
+	}
+
+	q.aliases = nil
+	if got := q.columnNames(); got != nil {
+		t.Errorf("Expected no names without aliases, got %v", got)
+	}
+}
+
+func TestClientQueryBody(t *testing.T) {
+	cq := serieslyclient.Query{
+		From:  time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		Group: time.Minute,
+		Fields: []serieslyclient.Field{
+			{Pointer: "/cpu", Reducer: "avg", Alias: "cpu"},
+			{Pointer: "/mem", Reducer: "max"},
+		},
+		Filters: []serieslyclient.Filter{{Pointer: "/h", Match: "a"}},
+		GroupBy: []string{"/dc"},
+		Windows: []serieslyclient.Window{{Field: 0, Function: "cumsum"}},
+		RankBy:  "1:max",
+		Top:     3,
+		Offsets: []string{"1d"},
+	}
+	d, err := json.Marshal(cq)
+	if err != nil {
+		t.Fatalf("Error encoding: %v", err)
+	}
+	var b queryBody
+	if err := json.Unmarshal(d, &b); err != nil {
+		t.Fatalf("Error decoding %s: %v", d, err)
+	}
+	got, err := b.params()
+	if err != nil {
+		t.Fatalf("Error converting %s: %v", d, err)
+	}
+
+	exp := cq.Params()
+	exp["fo"] = []string{"="}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v from %s, got %v", exp, d, got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A ranking selects the top (or bottom) n series of a grouped query
+// by the values of one of its columns, or the top n groups of an
+// ungrouped query.
+type ranking struct {
+	n      int
+	bottom bool
+	column int
+	// combine summarizes a series' values across groups so the
+	// series can be compared.
+	combine string
+}
+
+// rankCombiners summarize the values of a series for ranking.
+var rankCombiners = map[string]func(vals []float64) float64{
+	"avg": func(vals []float64) float64 {
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		return sum / float64(len(vals))
+	},
+	"sum": func(vals []float64) float64 {
+		sum := 0.0
+		for _, v := range vals {
+			sum += v
+		}
+		return sum
+	},
+	"min": func(vals []float64) float64 {
+		rv := vals[0]
+		for _, v := range vals[1:] {
+			if v < rv {
+				rv = v
+			}
+		}
+		return rv
+	},
+	"max": func(vals []float64) float64 {
+		rv := vals[0]
+		for _, v := range vals[1:] {
+			if v > rv {
+				rv = v
+			}
+		}
+		return rv
+	},
+	"last": func(vals []float64) float64 {
+		return vals[len(vals)-1]
+	},
+}
+
+// parseRanking reads the top or bottom count and the column to rank
+// by, given as column[:combiner] (e.g. 0:max), where column is a
+// position in the query's columns.
+func parseRanking(top, bottom, rankBy string, ncolumns int) (*ranking, error) {
+	if top == "" && bottom == "" {
+		if rankBy != "" {
+			return nil, paramError{"Bad rank_by value",
+				"rank_by requires top or bottom"}
+		}
+		return nil, nil
+	}
+	if top != "" && bottom != "" {
+		return nil, paramError{"Parameter mismatch",
+			"Can't have both top and bottom"}
+	}
+
+	r := &ranking{bottom: bottom != "", combine: "avg"}
+	count := top
+	if r.bottom {
+		count = bottom
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return nil, paramError{"Bad top or bottom value", count}
+	}
+	r.n = n
+
+	if rankBy != "" {
+		col := rankBy
+		if i := strings.Index(rankBy, ":"); i >= 0 {
+			col, r.combine = rankBy[:i], rankBy[i+1:]
+		}
+		if rankCombiners[r.combine] == nil {
+			return nil, paramError{"Bad rank_by value",
+				fmt.Sprintf("no such combiner %q", r.combine)}
+		}
+		r.column, err = strconv.Atoi(col)
+		if err != nil || r.column < 0 || r.column >= ncolumns {
+			return nil, paramError{"Bad rank_by value",
+				fmt.Sprintf("no column %q", col)}
+		}
+	}
+	return r, nil
+}
+
+type rankedName struct {
+	name  string
+	score float64
+}
+
+// byRank orders names best first, breaking ties by name.
+type byRank struct {
+	names  []rankedName
+	bottom bool
+}
+
+func (b byRank) Len() int      { return len(b.names) }
+func (b byRank) Swap(i, j int) { b.names[i], b.names[j] = b.names[j], b.names[i] }
+func (b byRank) Less(i, j int) bool {
+	x, y := b.names[i], b.names[j]
+	if x.score != y.score {
+		return (x.score > y.score) != b.bottom
+	}
+	return x.name < y.name
+}
+
+// best returns the names of the first n candidates.
+func (r *ranking) best(candidates []rankedName) map[string]bool {
+	sort.Sort(byRank{candidates, r.bottom})
+	rv := map[string]bool{}
+	for i := 0; i < len(candidates) && i < r.n; i++ {
+		rv[candidates[i].name] = true
+	}
+	return rv
+}
+
+// apply drops everything from a set of results in ascending order
+// except the winning series, or the winning groups if the results
+// aren't grouped.
+func (r *ranking) apply(results []*processOut, grouped bool) []*processOut {
+	value := func(row []interface{}) (float64, bool) {
+		if r.column < len(row) {
+			return toFloat(row[r.column])
+		}
+		return 0, false
+	}
+
+	var candidates []rankedName
+	if !grouped {
+		for _, po := range results {
+			if f, ok := value(po.value); ok {
+				name := strconv.FormatInt(po.key, 10)
+				candidates = append(candidates, rankedName{name, f})
+			}
+		}
+		winners := r.best(candidates)
+		rv := results[:0]
+		for _, po := range results {
+			if winners[strconv.FormatInt(po.key, 10)] {
+				rv = append(rv, po)
+			}
+		}
+		return rv
+	}
+
+	series := map[string][]float64{}
+	for _, po := range results {
+		for g, row := range po.groups {
+			if f, ok := value(row); ok {
+				series[g] = append(series[g], f)
+			}
+		}
+	}
+	combine := rankCombiners[r.combine]
+	for g, vals := range series {
+		candidates = append(candidates, rankedName{g, combine(vals)})
+	}
+	winners := r.best(candidates)
+
+	rv := results[:0]
+	for _, po := range results {
+		for g := range po.groups {
+			if !winners[g] {
+				delete(po.groups, g)
+			}
+		}
+		if len(po.groups) > 0 {
+			rv = append(rv, po)
+		}
+	}
+	return rv
+}
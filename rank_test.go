@@ -0,0 +1,108 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseRanking(t *testing.T) {
+	tests := []struct {
+		top, bottom, rankBy string
+		exp                 *ranking
+	}{
+		{"", "", "", nil},
+		{"3", "", "", &ranking{n: 3, combine: "avg"}},
+		{"", "2", "1:max", &ranking{n: 2, bottom: true, column: 1,
+			combine: "max"}},
+		{"5", "", "1", &ranking{n: 5, column: 1, combine: "avg"}},
+	}
+	for _, test := range tests {
+		got, err := parseRanking(test.top, test.bottom, test.rankBy, 2)
+		if err != nil {
+			t.Errorf("Error parsing %v/%v/%v: %v",
+				test.top, test.bottom, test.rankBy, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %+v for %v/%v/%v, got %+v", test.exp,
+				test.top, test.bottom, test.rankBy, got)
+		}
+	}
+
+	bad := [][3]string{
+		{"", "", "0"},
+		{"1", "1", ""},
+		{"0", "", ""},
+		{"x", "", ""},
+		{"1", "", "2"},
+		{"1", "", "0:median"},
+	}
+	for _, b := range bad {
+		if got, err := parseRanking(b[0], b[1], b[2], 2); err == nil {
+			t.Errorf("Expected error for %v, got %+v", b, got)
+		}
+	}
+}
+
+func TestRankGroups(t *testing.T) {
+	mkresults := func() []*processOut {
+		return []*processOut{
+			{key: 1, groups: map[string][]interface{}{
+				"a": {1.0}, "b": {5.0}, "c": {3.0}, "d": {"x"}}},
+			{key: 2, groups: map[string][]interface{}{
+				"a": {9.0}, "c": {4.0}}},
+			{key: 3, groups: map[string][]interface{}{"b": {5.0}}},
+		}
+	}
+	names := func(results []*processOut) []string {
+		seen := map[string]bool{}
+		for _, po := range results {
+			for g := range po.groups {
+				seen[g] = true
+			}
+		}
+		rv := []string{}
+		for g := range seen {
+			rv = append(rv, g)
+		}
+		sort.Strings(rv)
+		return rv
+	}
+
+	tests := []struct {
+		r    ranking
+		exp  []string
+		keys int
+	}{
+		{ranking{n: 1, combine: "avg"}, []string{"a"}, 2},
+		{ranking{n: 1, combine: "sum"}, []string{"a"}, 2},
+		{ranking{n: 2, combine: "last"}, []string{"a", "b"}, 3},
+		{ranking{n: 1, bottom: true, combine: "max"}, []string{"c"}, 2},
+		{ranking{n: 10, combine: "min"}, []string{"a", "b", "c"}, 3},
+	}
+	for _, test := range tests {
+		got := test.r.apply(mkresults(), true)
+		if n := names(got); !reflect.DeepEqual(n, test.exp) {
+			t.Errorf("Expected %v for %+v, got %v", test.exp, test.r, n)
+		}
+		if len(got) != test.keys {
+			t.Errorf("Expected %v groups for %+v, got %v",
+				test.keys, test.r, len(got))
+		}
+	}
+}
+
+func TestRankUngrouped(t *testing.T) {
+	results := []*processOut{
+		{key: 1, value: []interface{}{1.0}},
+		{key: 2, value: []interface{}{7.0}},
+		{key: 3, value: []interface{}{nil}},
+		{key: 4, value: []interface{}{3.0}},
+	}
+	r := ranking{n: 2, combine: "avg"}
+	got := r.apply(results, false)
+	if len(got) != 2 || got[0].key != 2 || got[1].key != 4 {
+		t.Errorf("Expected groups 2 and 4, got %v", got)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The kinds of values reducers work with.
+const (
+	inputAny     = "any"
+	inputNumber  = "number"
+	inputCounter = "counter"
+	inputObject  = "object"
+)
+
+// reducerInfo describes a reducer available to queries.
+type reducerInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Input is the kind of value the reducer expects.  Values of
+	// other kinds are ignored.
+	Input string `json:"input"`
+	// Mergeable reducers' results over separate groups of values
+	// can be combined into their result over all of the values.
+	Mergeable bool `json:"mergeable"`
+	// Args describes the arguments the reducer takes after a colon
+	// in its name, if any.
+	Args         string `json:"args,omitempty"`
+	ArgsRequired bool   `json:"args_required,omitempty"`
+	// Expr is the expression computing a user defined reducer.
+	Expr string `json:"expr,omitempty"`
+	// Partial reducers' results over large groups can be assembled
+	// from partial aggregates over smaller ones.
+	Partial bool `json:"partial"`
+
+	reduce  reducer
+	make    func(args string) (reducer, error)
+	partial *partialAgg
+}
+
+// reducerLock guards the registered reducers, which may change at
+// runtime as users define them.
+var reducerLock sync.RWMutex
+
+var reducerRegistry = map[string]*reducerInfo{}
+
+// reducers and reducerMakers index the registered reducers by name.
+// reducerMakers build reducers that are parameterized by arguments
+// given after a colon in the reducer name (e.g. "histogram:1,5,10").
+var reducers = map[string]reducer{}
+var reducerMakers = map[string]func(args string) (reducer, error){}
+
+// registerReducer makes a reducer available to queries.  A reducer
+// has a plain implementation, a maker taking arguments, or both.
+func registerReducer(info reducerInfo) {
+	reducerLock.Lock()
+	defer reducerLock.Unlock()
+	if _, exists := reducerRegistry[info.Name]; exists {
+		panic(fmt.Sprintf("reducer %q registered twice", info.Name))
+	}
+	if info.reduce == nil && info.make == nil {
+		panic(fmt.Sprintf("reducer %q has no implementation", info.Name))
+	}
+	addReducer(&info)
+}
+
+// addReducer adds or replaces a reducer.  reducerLock must be held.
+func addReducer(info *reducerInfo) {
+	removeReducer(info.Name)
+	info.ArgsRequired = info.reduce == nil
+	info.Partial = info.partial != nil
+	reducerRegistry[info.Name] = info
+	if info.reduce != nil {
+		reducers[info.Name] = info.reduce
+	}
+	if info.make != nil {
+		reducerMakers[info.Name] = info.make
+	}
+}
+
+// removeReducer removes a reducer.  reducerLock must be held.
+func removeReducer(name string) {
+	delete(reducerRegistry, name)
+	delete(reducers, name)
+	delete(reducerMakers, name)
+}
+
+// findReducer resolves a reducer name as given in a query.
+func findReducer(name string) (reducer, error) {
+	reducerLock.RLock()
+	defer reducerLock.RUnlock()
+	if r, ok := reducers[name]; ok {
+		return r, nil
+	}
+	base, args := name, ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		base, args = name[:i], name[i+1:]
+	}
+	mk, ok := reducerMakers[base]
+	if !ok {
+		return nil, errNoSuchReducer
+	}
+	return mk(args)
+}
+
+type reducerInfos []*reducerInfo
+
+func (r reducerInfos) Len() int           { return len(r) }
+func (r reducerInfos) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r reducerInfos) Less(i, j int) bool { return r[i].Name < r[j].Name }
+
+func listReducers(args []string, w http.ResponseWriter, req *http.Request) {
+	reducerLock.RLock()
+	rv := make(reducerInfos, 0, len(reducerRegistry))
+	for _, info := range reducerRegistry {
+		rv = append(rv, info)
+	}
+	reducerLock.RUnlock()
+	sort.Sort(rv)
+	mustEncode(200, w, rv)
+}
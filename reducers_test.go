@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReducerRegistry(t *testing.T) {
+	for name := range reducers {
+		if reducerRegistry[name] == nil {
+			t.Errorf("Reducer %v isn't registered", name)
+		}
+	}
+	for name, info := range reducerRegistry {
+		if info.Description == "" || info.Input == "" {
+			t.Errorf("Reducer %v is missing its description", name)
+		}
+		if (info.make != nil) != (info.Args != "") {
+			t.Errorf("Reducer %v args %q don't match its maker",
+				name, info.Args)
+		}
+	}
+
+	h := reducerRegistry["histogram"]
+	if h == nil || !h.ArgsRequired || !h.Mergeable {
+		t.Errorf("Expected histogram to require args, got %+v", h)
+	}
+	if a := reducerRegistry["avg"]; a == nil || a.ArgsRequired || a.Mergeable {
+		t.Errorf("Expected plain, unmergeable avg, got %+v", a)
+	}
+}
+
+func TestRegisterReducerTwice(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic registering sum again")
+		}
+	}()
+	registerReducer(reducerInfo{Name: "sum", reduce: reducers["sum"]})
+}
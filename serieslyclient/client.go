@@ -2,7 +2,9 @@
 package serieslyclient
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/url"
 
@@ -41,6 +43,54 @@ type DBInfo struct {
 	Error        string
 }
 
+// Reducer describes a reducer available to queries.
+type Reducer struct {
+	Name        string
+	Description string
+	// Input is the kind of value the reducer expects: any, number,
+	// counter or object.
+	Input string
+	// Mergeable reducers' results over separate sets of values can
+	// be combined into their result over all of the values.
+	Mergeable bool
+	// Args describes the arguments the reducer takes after a colon
+	// in its name, if any.
+	Args         string
+	ArgsRequired bool `json:"args_required"`
+	// Expr is the expression computing a user defined reducer.
+	Expr string
+	// Partial reducers' results over large groups can be assembled
+	// from partial aggregates over smaller ones, which the server
+	// caches independently of the grouping.
+	Partial bool
+}
+
+// Query runs a query across the databases given by q.Databases,
+// sending it as a JSON body.  The caller must close the returned
+// results.
+func (s *Seriesly) Query(q *Query) (io.ReadCloser, error) {
+	u := s.URL()
+	u.Path = "/_query"
+	return s.postQuery(u, q)
+}
+
+func (s *Seriesly) postQuery(u *url.URL, q *Query) (io.ReadCloser, error) {
+	body, err := json.Marshal(q)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Post(u.String(), "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		defer res.Body.Close()
+		return nil, httputil.HTTPError(res)
+	}
+	return res.Body, nil
+}
+
 // URL returns a copy of the Seriesly client's URL.
 func (s *Seriesly) URL() *url.URL {
 	rv := *s.u
@@ -65,6 +115,71 @@ func (s *Seriesly) List() ([]string, error) {
 	return rv, err
 }
 
+// Reducers lists the reducers available to queries.
+func (s *Seriesly) Reducers() ([]Reducer, error) {
+	u := *s.u
+	u.Path = "/_reducers"
+	res, err := s.client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPError(res)
+	}
+
+	rv := []Reducer{}
+	err = json.NewDecoder(res.Body).Decode(&rv)
+	return rv, err
+}
+
+// DefineReducer creates or replaces a user defined reducer computed
+// by an expression over aggregates of its values, such as
+// "sum(/latency * /count) / sum(/count)".
+func (s *Seriesly) DefineReducer(name, description, expr string) error {
+	u := *s.u
+	u.Path = "/_reducers/" + name
+	body, err := json.Marshal(map[string]string{
+		"description": description,
+		"expr":        expr,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 201 {
+		return httputil.HTTPErrorf(res, "Error defining reducer: %S -- %B")
+	}
+	return nil
+}
+
+// DeleteReducer removes a user defined reducer.
+func (s *Seriesly) DeleteReducer(name string) error {
+	u := *s.u
+	u.Path = "/_reducers/" + name
+	req, err := http.NewRequest("DELETE", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return httputil.HTTPErrorf(res, "Error deleting reducer: %S -- %B")
+	}
+	return nil
+}
+
 // DB returns a SerieslyDB instance for the given DB.
 func (s *Seriesly) DB(db string) *SerieslyDB {
 	return &SerieslyDB{s, db}
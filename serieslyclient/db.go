@@ -63,6 +63,14 @@ func (s *SerieslyDB) Compact() error {
 	return nil
 }
 
+// Query runs a query against this database, sending it as a JSON
+// body.  The caller must close the returned results.
+func (s *SerieslyDB) Query(q *Query) (io.ReadCloser, error) {
+	u := s.URL()
+	u.Path += "/_query"
+	return s.s.postQuery(u, q)
+}
+
 func setTimeParam(uv url.Values, name, val string) error {
 	if val == "" {
 		return nil
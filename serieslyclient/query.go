@@ -1,32 +1,110 @@
 package serieslyclient
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Field represents a JSON pointer field and reducer for a query.
+//
+// The pointer may instead be an arithmetic expression over pointers
+// prefixed with "expr:", e.g. "expr:/used * 100 / /total".  If any
+// field or window has an Alias, results are keyed by name rather
+// than by position.
+//
+// Pointers may have wildcard segments, e.g. "/cpu/*/user", in which
+// case the values are reported as a series for each match, named
+// after the keys the wildcards matched.
 type Field struct {
 	Pointer, Reducer string
+	Alias            string
 }
 
-// Filter represents an exact-match in a query.
+// Filter represents a condition on a JSON pointer in a query.
+//
+// Op is one of =, !=, >, >=, <, <=, range, in, ~ (regular expression),
+// exists, missing or prefix.  An empty Op is an exact match.  Match
+// is "low,high" for range and a comma separated list for in.
 type Filter struct {
 	Pointer, Match string
+	Op             string
+}
+
+// Window applies a window function such as "moving_avg:5", "ewma:0.3",
+// "cumsum", "derivative" or "holt_winters:0.5,0.5" across the groups
+// of one of a query's fields, given by its position in Fields.
+type Window struct {
+	Field    int
+	Function string
+	Alias    string
 }
 
 // Query represents a seriesly query.
 type Query struct {
 	From, To time.Time
 	Group    time.Duration
+	// Interval groups by calendar day, week, month, quarter or
+	// year instead of by Group.
+	Interval string
+	// TimeZone is the IANA time zone groups are aligned to.  The
+	// default is UTC.
+	TimeZone string
 	Fields   []Field
 	Filters  []Filter
+	// GroupBy lists pointers whose values split each time group
+	// into separate series.  Series are named by the values joined
+	// with commas, with commas and backslashes in them escaped by a
+	// backslash.
+	GroupBy []string
+	// Where is an optional boolean filter expression such as
+	// (/host = "a" OR /host = "b") AND NOT /status = "ok"
+	Where string
+	// Fill controls how groups without data are reported: null,
+	// zero, previous or linear.  By default they are omitted.
+	Fill string
+	// Databases names the databases (or globs over database names)
+	// of a query run across several databases at /_query.
+	Databases []string
+	// Combine sums or averages the values of each database in a
+	// multi-database query rather than reporting them separately.
+	Combine string
+	// Format selects the output format: json (the default), csv,
+	// ndjson or columnar.
+	Format string
+	// Order is asc or desc to report groups in time order.
+	Order string
+	// Limit is the maximum number of groups to report.  It
+	// implies ascending order unless Order is desc.
+	Limit int
+	// Windows are reported as extra fields after Fields.
+	Windows []Window
+	// Top or Bottom keeps only that many series of a grouped query
+	// (or groups of an ungrouped one), ranked by RankBy: a position
+	// among the fields and windows optionally followed by how to
+	// combine a series' values, e.g. "0:max".  The default is the
+	// average of the first field.
+	Top, Bottom int
+	RankBy      string
+	// Offsets compare the results with those of the same query
+	// shifted back by each offset, such as "1w", "1d" or "90m".
+	// Each offset's results are reported as a separate series named
+	// after it, keyed by the unshifted groups, with the unshifted
+	// results named "0".
+	Offsets []string
+	// Explain requests statistics about running the query (documents
+	// scanned and matched, chunks, cache hits and timings) in place
+	// of its results.
+	Explain bool
 }
 
-func (q *Query) validate() error {
-	if q.Group < 1 {
+// Validate checks this Query for errors.  Reducers are checked
+// against known, as returned by Seriesly.Reducers, unless it's nil.
+func (q *Query) Validate(known []Reducer) error {
+	if q.Group < 1 && q.Interval == "" {
 		return fmt.Errorf("Grouping value must be >0, was %v", q.Group)
 	}
 	if len(q.Fields) == 0 {
@@ -34,34 +112,211 @@ func (q *Query) validate() error {
 			len(q.Fields))
 	}
 	for _, f := range q.Fields {
-		if !validReducer(f.Reducer) {
+		if known != nil && !validReducer(f.Reducer, known) {
 			return fmt.Errorf("Invalid reducer: %v", f.Reducer)
 		}
 	}
 	return nil
 }
 
-func validReducer(r string) bool {
-	return true
+// validate checks this Query for errors without knowing which
+// reducers the server has.
+func (q *Query) validate() error {
+	return q.Validate(nil)
+}
+
+// validReducer checks a reducer name, possibly followed by a colon
+// and arguments, against the known reducers.
+func validReducer(r string, known []Reducer) bool {
+	name, args := r, false
+	if i := strings.Index(r, ":"); i >= 0 {
+		name, args = r[:i], true
+	}
+	for _, k := range known {
+		if k.Name == name {
+			if args {
+				return k.Args != ""
+			}
+			return !k.ArgsRequired
+		}
+	}
+	return false
 }
 
 // Params converts this Query to query parameters.
 func (q *Query) Params() url.Values {
 	rv := url.Values{}
-	rv.Set("group", strconv.FormatUint(uint64(q.Group/time.Millisecond), 10))
+	if q.Interval != "" {
+		rv.Set("group", q.Interval)
+	} else {
+		rv.Set("group", strconv.FormatUint(uint64(q.Group/time.Millisecond), 10))
+	}
+	if q.TimeZone != "" {
+		rv.Set("tz", q.TimeZone)
+	}
 	if !q.From.IsZero() {
 		rv.Set("from", q.From.Format(time.RFC3339Nano))
 	}
 	if !q.To.IsZero() {
 		rv.Set("to", q.To.Format(time.RFC3339Nano))
 	}
+	var aliases []string
+	named := false
 	for _, f := range q.Fields {
 		rv["ptr"] = append(rv["ptr"], f.Pointer)
 		rv["reducer"] = append(rv["reducer"], f.Reducer)
+		aliases = append(aliases, f.Alias)
+		named = named || f.Alias != ""
 	}
+	hasOps := false
 	for _, f := range q.Filters {
 		rv["f"] = append(rv["f"], f.Pointer)
 		rv["fv"] = append(rv["fv"], f.Match)
+		hasOps = hasOps || f.Op != ""
+	}
+	if hasOps {
+		for _, f := range q.Filters {
+			op := f.Op
+			if op == "" {
+				op = "="
+			}
+			rv["fo"] = append(rv["fo"], op)
+		}
+	}
+	for _, g := range q.GroupBy {
+		rv["group_by"] = append(rv["group_by"], g)
+	}
+	if q.Where != "" {
+		rv.Set("where", q.Where)
+	}
+	if q.Fill != "" {
+		rv.Set("fill", q.Fill)
+	}
+	for _, db := range q.Databases {
+		rv["db"] = append(rv["db"], db)
+	}
+	if q.Combine != "" {
+		rv.Set("combine", q.Combine)
+	}
+	if q.Format != "" {
+		rv.Set("format", q.Format)
+	}
+	if q.Order != "" {
+		rv.Set("order", q.Order)
+	}
+	if q.Limit > 0 {
+		rv.Set("limit", strconv.Itoa(q.Limit))
+	}
+	for _, w := range q.Windows {
+		rv["window"] = append(rv["window"],
+			strconv.Itoa(w.Field)+":"+w.Function)
+		aliases = append(aliases, w.Alias)
+		named = named || w.Alias != ""
+	}
+	if named {
+		rv["alias"] = aliases
+	}
+	if q.Top > 0 {
+		rv.Set("top", strconv.Itoa(q.Top))
+	}
+	if q.Bottom > 0 {
+		rv.Set("bottom", strconv.Itoa(q.Bottom))
+	}
+	if q.RankBy != "" {
+		rv.Set("rank_by", q.RankBy)
+	}
+	for _, o := range q.Offsets {
+		rv["offset"] = append(rv["offset"], o)
+	}
+	if q.Explain {
+		rv.Set("explain", "true")
 	}
 	return rv
 }
+
+// fieldBody, filterBody and windowBody are the JSON encodings of
+// Field, Filter and Window in a query body.
+type fieldBody struct {
+	Pointer string `json:"pointer"`
+	Reducer string `json:"reducer"`
+	Alias   string `json:"alias,omitempty"`
+}
+
+type filterBody struct {
+	Pointer string `json:"pointer"`
+	Op      string `json:"op,omitempty"`
+	Match   string `json:"match"`
+}
+
+type windowBody struct {
+	Field    int    `json:"field"`
+	Function string `json:"function"`
+	Alias    string `json:"alias,omitempty"`
+}
+
+// queryBody is the JSON encoding of a Query accepted by POST
+// requests to _query.
+type queryBody struct {
+	From      string       `json:"from,omitempty"`
+	To        string       `json:"to,omitempty"`
+	Group     int64        `json:"group,omitempty"`
+	Interval  string       `json:"interval,omitempty"`
+	TimeZone  string       `json:"timezone,omitempty"`
+	Fields    []fieldBody  `json:"fields"`
+	Filters   []filterBody `json:"filters,omitempty"`
+	GroupBy   []string     `json:"group_by,omitempty"`
+	Where     string       `json:"where,omitempty"`
+	Fill      string       `json:"fill,omitempty"`
+	Databases []string     `json:"databases,omitempty"`
+	Combine   string       `json:"combine,omitempty"`
+	Format    string       `json:"format,omitempty"`
+	Order     string       `json:"order,omitempty"`
+	Limit     int          `json:"limit,omitempty"`
+	Windows   []windowBody `json:"windows,omitempty"`
+	Top       int          `json:"top,omitempty"`
+	Bottom    int          `json:"bottom,omitempty"`
+	RankBy    string       `json:"rank_by,omitempty"`
+	Offsets   []string     `json:"offsets,omitempty"`
+	Explain   bool         `json:"explain,omitempty"`
+}
+
+// MarshalJSON encodes this Query as the JSON body of a POST to
+// _query, with Group in milliseconds.
+func (q Query) MarshalJSON() ([]byte, error) {
+	b := queryBody{
+		Interval:  q.Interval,
+		TimeZone:  q.TimeZone,
+		GroupBy:   q.GroupBy,
+		Where:     q.Where,
+		Fill:      q.Fill,
+		Databases: q.Databases,
+		Combine:   q.Combine,
+		Format:    q.Format,
+		Order:     q.Order,
+		Limit:     q.Limit,
+		Top:       q.Top,
+		Bottom:    q.Bottom,
+		RankBy:    q.RankBy,
+		Offsets:   q.Offsets,
+		Explain:   q.Explain,
+	}
+	if q.Interval == "" {
+		b.Group = int64(q.Group / time.Millisecond)
+	}
+	if !q.From.IsZero() {
+		b.From = q.From.Format(time.RFC3339Nano)
+	}
+	if !q.To.IsZero() {
+		b.To = q.To.Format(time.RFC3339Nano)
+	}
+	for _, f := range q.Fields {
+		b.Fields = append(b.Fields, fieldBody{f.Pointer, f.Reducer, f.Alias})
+	}
+	for _, f := range q.Filters {
+		b.Filters = append(b.Filters, filterBody{f.Pointer, f.Op, f.Match})
+	}
+	for _, w := range q.Windows {
+		b.Windows = append(b.Windows, windowBody{w.Field, w.Function, w.Alias})
+	}
+	return json.Marshal(b)
+}
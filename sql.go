@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var validDBName = regexp.MustCompile("^" + dbMatch + "$")
+
+// parseSQL parses a query in seriesly's SQL-like query language:
+//
+//	SELECT avg(/cpu), max(/mem) FROM web
+//	WHERE /dc = "east" AND time > now - 1h
+//	GROUP BY time(1m), /host
+//	FILL(previous) ORDER BY time DESC LIMIT 10
+//
+// Each selected field is a reducer applied to a JSON pointer or to an
+// arithmetic expression over pointers, e.g. avg(/used * 100 / /total).
+// Reducers taking arguments get them as a second string parameter,
+// e.g. histogram(/latency, "linear:0,10,20").  Window functions such
+// as moving_avg(avg(/cpu), 5) compute a value across groups from a
+// selected field and are reported after the other fields.  The WHERE
+// clause accepts any filter expression (see parseFilterExpr);
+// comparisons against time restrict the range of the query.  Pointers
+// listed alongside the time grouping produce a separate series for
+// each distinct value found.  A trailing FILL(null|zero|previous|linear)
+// fills in groups without data.  TOP n BY field (or BOTTOM) keeps
+// only the n series with the highest values of the field on average,
+// or by a combiner such as TOP n BY max(field).  ORDER BY time
+// [ASC|DESC] and LIMIT n order and limit the groups reported.
+// Prefixing the query with EXPLAIN reports statistics about running
+// it instead of its results.
+func parseSQL(in string) (*queryIn, error) {
+	s, err := newTokenStream(in)
+	if err != nil {
+		return nil, paramError{"Bad query", err.Error()}
+	}
+	explain := s.accept("explain")
+	q, err := parseSelect(s)
+	if err != nil {
+		if _, ok := err.(paramError); !ok {
+			err = paramError{"Bad query", err.Error()}
+		}
+		return nil, err
+	}
+	q.explain = explain
+	return q, nil
+}
+
+func parseSelect(s *tokenStream) (*queryIn, error) {
+	q := &queryIn{}
+
+	if err := s.expect("select"); err != nil {
+		return nil, err
+	}
+	var windows []sqlWindow
+	for {
+		t := s.peek()
+		if t.typ == tokIdent && windowMakers[strings.ToLower(t.val)] != nil {
+			w, err := parseWindowField(s)
+			if err != nil {
+				return nil, err
+			}
+			windows = append(windows, w)
+		} else {
+			ptr, red, err := parseSelectField(s)
+			if err != nil {
+				return nil, err
+			}
+			q.ptrs = append(q.ptrs, ptr)
+			q.reds = append(q.reds, red)
+		}
+		if !s.accept(",") {
+			break
+		}
+	}
+	if err := validateReducers(q.reds); err != nil {
+		return nil, err
+	}
+	for _, w := range windows {
+		if err := w.resolve(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.expect("from"); err != nil {
+		return nil, err
+	}
+	db := s.peek()
+	if (db.typ != tokIdent && db.typ != tokString) ||
+		!validDBName.MatchString(db.val) {
+		return nil, s.errorf("expected database name")
+	}
+	s.next()
+	q.dbname = db.val
+
+	if s.accept("where") {
+		f, err := parseOrExpr(s)
+		if err != nil {
+			return nil, err
+		}
+		var conds []timeCond
+		q.filter, conds, err = splitTimeConds(f)
+		if err != nil {
+			return nil, err
+		}
+		q.from, q.to = narrowRange("", "", conds)
+	}
+
+	if err := s.expect("group"); err != nil {
+		return nil, err
+	}
+	if err := s.expect("by"); err != nil {
+		return nil, err
+	}
+	for {
+		if t := s.peek(); t.typ == tokPointer {
+			s.next()
+			q.groupBy = append(q.groupBy, t.val)
+		} else if q.grouper == nil {
+			g, err := parseTimeGroup(s)
+			if err != nil {
+				return nil, err
+			}
+			q.grouper = g
+		} else {
+			return nil, s.errorf("expected JSON pointer")
+		}
+		if !s.accept(",") {
+			break
+		}
+	}
+	if q.grouper == nil {
+		return nil, s.errorf("expected time grouping")
+	}
+
+	if s.accept("fill") {
+		if err := s.expect("("); err != nil {
+			return nil, err
+		}
+		t := s.next()
+		q.fill = strings.ToLower(t.val)
+		if t.typ != tokIdent || !fillModes[q.fill] {
+			return nil, paramError{"Bad fill value", t.val}
+		}
+		if err := s.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if t := s.peek(); t.is("top") || t.is("bottom") {
+		s.next()
+		r, err := parseTopClause(s, q)
+		if err != nil {
+			return nil, err
+		}
+		r.bottom = t.is("bottom")
+		q.rank = r
+	}
+
+	if s.accept("order") {
+		if err := s.expect("by"); err != nil {
+			return nil, err
+		}
+		if err := s.expect("time"); err != nil {
+			return nil, err
+		}
+		q.order = orderAsc
+		if s.accept("desc") {
+			q.order = orderDesc
+		} else {
+			s.accept("asc")
+		}
+	}
+
+	if s.accept("limit") {
+		t := s.next()
+		if t.typ != tokNumber {
+			return nil, paramError{"Bad limit value", t.String()}
+		}
+		var err error
+		q.order, q.limit, err = parseOrder(q.order, t.val)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if s.peek().typ != tokEOF {
+		return nil, s.errorf("unexpected input")
+	}
+	return q, nil
+}
+
+// parseTimeGroup reads time(duration) or time(unit), optionally
+// followed by a time zone, e.g. time(day, "America/New_York").
+func parseTimeGroup(s *tokenStream) (grouper, error) {
+	if err := s.expect("time"); err != nil {
+		return nil, err
+	}
+	if err := s.expect("("); err != nil {
+		return nil, err
+	}
+
+	var d time.Duration
+	unit := s.peek()
+	calendar := unit.typ == tokIdent && calendarUnits[strings.ToLower(unit.val)]
+	if calendar {
+		s.next()
+	} else {
+		var err error
+		d, err = parseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tz := ""
+	if s.accept(",") {
+		t := s.peek()
+		if t.typ != tokString {
+			return nil, s.errorf("expected time zone")
+		}
+		s.next()
+		tz = t.val
+	}
+	if err := s.expect(")"); err != nil {
+		return nil, err
+	}
+
+	loc, err := loadLocation(tz)
+	if err != nil {
+		return nil, err
+	}
+	if calendar {
+		return calendarGrouper{strings.ToLower(unit.val), loc}, nil
+	}
+	return newFixedGrouper(d, loc)
+}
+
+// parseTopClause reads the rest of TOP n BY field or, with a
+// combiner for the values of each series, TOP n BY max(field).  The
+// field must be one of the selected fields.
+func parseTopClause(s *tokenStream, q *queryIn) (*ranking, error) {
+	t := s.next()
+	n, err := strconv.Atoi(t.val)
+	if t.typ != tokNumber || err != nil || n < 1 {
+		return nil, paramError{"Bad top or bottom value", t.String()}
+	}
+	if err := s.expect("by"); err != nil {
+		return nil, err
+	}
+
+	r := &ranking{n: n, combine: "avg"}
+	name := s.peek()
+	if name.typ != tokIdent {
+		return nil, s.errorf("expected field")
+	}
+	s.next()
+	if err := s.expect("("); err != nil {
+		return nil, err
+	}
+	var ptr, red string
+	if t := s.peek(); t.typ == tokIdent && t.val != "_id" {
+		if rankCombiners[name.val] == nil {
+			return nil, s.errorf("no such combiner %v", name.val)
+		}
+		r.combine = name.val
+		ptr, red, err = parseSelectField(s)
+		if err == nil {
+			err = s.expect(")")
+		}
+	} else {
+		ptr, red, err = parseFieldArgs(s, name.val)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.column = -1
+	for i := range q.ptrs {
+		if q.ptrs[i] == ptr && q.reds[i] == red {
+			r.column = i
+		}
+	}
+	if r.column < 0 {
+		return nil, paramError{"Bad query",
+			fmt.Sprintf("%v(%v) is not a selected field", red, ptr)}
+	}
+	return r, nil
+}
+
+// An sqlWindow is a window function over a field, which must also be
+// selected itself.
+type sqlWindow struct {
+	name, ptr, red string
+	args           []string
+}
+
+// parseWindowField reads a window function over a field, e.g.
+// moving_avg(avg(/cpu), 5).  The field is found among the selected
+// ones once they've all been read (see resolve).
+func parseWindowField(s *tokenStream) (sqlWindow, error) {
+	w := sqlWindow{name: strings.ToLower(s.next().val)}
+	if err := s.expect("("); err != nil {
+		return w, err
+	}
+	var err error
+	w.ptr, w.red, err = parseSelectField(s)
+	if err != nil {
+		return w, err
+	}
+
+	for s.accept(",") {
+		t := s.next()
+		if t.typ != tokNumber {
+			return w, s.errorf("expected window function argument")
+		}
+		w.args = append(w.args, t.val)
+	}
+	return w, s.expect(")")
+}
+
+// resolve adds a window function over one of the selected fields to
+// a query.
+func (w sqlWindow) resolve(q *queryIn) error {
+	field := -1
+	for i := range q.ptrs {
+		if q.ptrs[i] == w.ptr && q.reds[i] == w.red {
+			field = i
+		}
+	}
+	if field < 0 {
+		return paramError{"Bad window value", fmt.Sprintf(
+			"%v(%v) must be selected to apply %v to it",
+			w.red, w.ptr, w.name)}
+	}
+	spec := fmt.Sprintf("%d:%s", field, w.name)
+	if len(w.args) > 0 {
+		spec += ":" + strings.Join(w.args, ",")
+	}
+	win, err := parseWindow(spec, len(q.ptrs))
+	if err != nil {
+		return paramError{"Bad window value", err.Error()}
+	}
+	q.windows = append(q.windows, win)
+	return nil
+}
+
+// parseSelectField reads reducer(/pointer) or reducer(/pointer, "args")
+// where the pointer may also be an arithmetic expression over
+// pointers.
+func parseSelectField(s *tokenStream) (string, string, error) {
+	red := s.peek()
+	if red.typ != tokIdent {
+		return "", "", s.errorf("expected reducer")
+	}
+	s.next()
+	if err := s.expect("("); err != nil {
+		return "", "", err
+	}
+	return parseFieldArgs(s, red.val)
+}
+
+// parseFieldArgs reads the rest of a selected field after the
+// reducer and opening parenthesis.
+func parseFieldArgs(s *tokenStream, rname string) (string, string, error) {
+	var ptr string
+	if t := s.peek(); t.typ == tokIdent && t.val == "_id" {
+		s.next()
+		ptr = t.val
+	} else {
+		e, err := parseSum(s)
+		if err != nil {
+			return "", "", err
+		}
+		ptr = exprPrefix + e.String()
+		if p, ok := e.(pointerExpr); ok {
+			ptr = string(p)
+		}
+	}
+	if s.accept(",") {
+		args := s.peek()
+		if args.typ != tokString && args.typ != tokNumber {
+			return "", "", s.errorf("expected reducer arguments")
+		}
+		s.next()
+		rname += ":" + args.val
+	}
+	return ptr, rname, s.expect(")")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSQL(t *testing.T) {
+	q, err := parseSQL(`SELECT avg(/cpu), max(/mem),
+		histogram(/lat, "linear:0,10,5") FROM web
+		WHERE /dc = "east" AND time >= "2013-02-22T00:00:00Z"
+		AND time < '2013-02-23' GROUP BY time(1m)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+
+	if q.dbname != "web" {
+		t.Errorf("Expected db web, got %v", q.dbname)
+	}
+	exp := []string{"/cpu", "/mem", "/lat"}
+	if !reflect.DeepEqual(q.ptrs, exp) {
+		t.Errorf("Expected ptrs %v, got %v", exp, q.ptrs)
+	}
+	exp = []string{"avg", "max", "histogram:linear:0,10,5"}
+	if !reflect.DeepEqual(q.reds, exp) {
+		t.Errorf("Expected reducers %v, got %v", exp, q.reds)
+	}
+	if exp := (fixedGrouper{int64(time.Minute), time.UTC}); q.grouper != exp {
+		t.Errorf("Expected grouper %v, got %v", exp, q.grouper)
+	}
+	if q.from != "2013-02-22T00:00:00Z" {
+		t.Errorf("Expected from 2013-02-22T00:00:00Z, got %v", q.from)
+	}
+	if q.to != "2013-02-22T23:59:59.999999999Z" {
+		t.Errorf("Expected to just before 2013-02-23, got %v", q.to)
+	}
+	if q.filter == nil || q.filter.String() != `/dc = "east"` {
+		t.Errorf("Expected dc filter, got %v", q.filter)
+	}
+}
+
+func TestParseSQLRelativeTime(t *testing.T) {
+	q, err := parseSQL(`select sum(/x) from db where time > now-1h30m ` +
+		`and /y exists group by time(2d)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if exp := (fixedGrouper{int64(48 * time.Hour), time.UTC}); q.grouper != exp {
+		t.Errorf("Expected two day grouping, got %v", q.grouper)
+	}
+	from, err := time.Parse(time.RFC3339Nano, q.from)
+	if err != nil {
+		t.Fatalf("Error parsing from %q: %v", q.from, err)
+	}
+	if d := time.Since(from) - 90*time.Minute; d < 0 || d > time.Minute {
+		t.Errorf("Expected from to be 90m ago, was %v", time.Since(from))
+	}
+	if q.to != "" {
+		t.Errorf("Expected no upper bound, got %v", q.to)
+	}
+}
+
+func TestParseSQLFill(t *testing.T) {
+	q, err := parseSQL(`SELECT avg(/x) FROM db GROUP BY time(1h) FILL(Linear)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if q.fill != "linear" {
+		t.Errorf("Expected linear fill, got %q", q.fill)
+	}
+}
+
+func TestParseSQLExpressions(t *testing.T) {
+	q, err := parseSQL(`SELECT avg(/used * 100 / /total), max(-/x),
+		count(_id), min((/y)) FROM db GROUP BY time(1h)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	exp := []string{"expr:((/used * 100) / /total)", "expr:-/x", "_id", "/y"}
+	if !reflect.DeepEqual(q.ptrs, exp) {
+		t.Errorf("Expected ptrs %v, got %v", exp, q.ptrs)
+	}
+	if _, err := parsePointerExprs(q.ptrs); err != nil {
+		t.Errorf("Error reparsing expressions: %v", err)
+	}
+}
+
+func TestParseSQLOrder(t *testing.T) {
+	tests := []struct {
+		in    string
+		order string
+		limit int
+	}{
+		{"", "", 0},
+		{" ORDER BY time", orderAsc, 0},
+		{" order by time desc", orderDesc, 0},
+		{" FILL(zero) ORDER BY time ASC LIMIT 5", orderAsc, 5},
+		{" LIMIT 10", orderAsc, 10},
+		{" ORDER BY time DESC LIMIT 10", orderDesc, 10},
+	}
+	for _, test := range tests {
+		q, err := parseSQL(`SELECT avg(/x) FROM db GROUP BY time(1h)` + test.in)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.in, err)
+			continue
+		}
+		if q.order != test.order || q.limit != test.limit {
+			t.Errorf("Expected %v/%v for %q, got %v/%v", test.order,
+				test.limit, test.in, q.order, q.limit)
+		}
+	}
+}
+
+func TestParseSQLErrors(t *testing.T) {
+	tests := []string{
+		``,
+		`SELECT FROM web GROUP BY time(1m)`,
+		`SELECT avg(/cpu) web GROUP BY time(1m)`,
+		`SELECT nosuch(/cpu) FROM web GROUP BY time(1m)`,
+		`SELECT histogram(/cpu, "10,5") FROM web GROUP BY time(1m)`,
+		`SELECT avg(cpu) FROM web GROUP BY time(1m)`,
+		`SELECT avg(/cpu) FROM "../etc" GROUP BY time(1m)`,
+		`SELECT avg(/cpu) FROM web`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(0)`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) extra`,
+		`SELECT avg(/cpu) FROM web WHERE /a = 1 OR time > now ` +
+			`GROUP BY time(1m)`,
+		`SELECT avg(/cpu) FROM web WHERE time > soon GROUP BY time(1m)`,
+		`SELECT avg(/cpu) FROM web WHERE time GROUP BY time(1m)`,
+		`SELECT avg(/cpu +) FROM web GROUP BY time(1m)`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) ORDER BY /cpu`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) LIMIT 0`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) LIMIT ten`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) LIMIT 5 FILL(zero)`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) FILL(nearest)`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m) FILL(zero`,
+	}
+
+	for _, test := range tests {
+		_, err := parseSQL(test)
+		if err == nil {
+			t.Errorf("Expected error parsing %q", test)
+		} else if _, ok := err.(paramError); !ok {
+			t.Errorf("Expected a paramError for %q, got %v", test, err)
+		}
+	}
+}
+
+func TestNarrowRange(t *testing.T) {
+	t1 := time.Date(2013, 2, 22, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	tests := []struct {
+		from, to string
+		conds    []timeCond
+		efrom    string
+		eto      string
+	}{
+		{"", "", nil, "", ""},
+		{"", "", []timeCond{{">=", t1}},
+			"2013-02-22T00:00:00Z", ""},
+		{"", "", []timeCond{{">", t1}, {"<=", t2}},
+			"2013-02-22T00:00:00.000000001Z", "2013-02-22T01:00:00Z"},
+		{"2013-02-22T00:30:00Z", "", []timeCond{{">=", t1}, {"<", t2}},
+			"2013-02-22T00:30:00Z", "2013-02-22T00:59:59.999999999Z"},
+		{"", "", []timeCond{{"=", t2}},
+			"2013-02-22T01:00:00Z", "2013-02-22T01:00:00Z"},
+	}
+
+	for _, test := range tests {
+		from, to := narrowRange(test.from, test.to, test.conds)
+		if from != test.efrom || to != test.eto {
+			t.Errorf("Expected %v-%v for %v, got %v-%v",
+				test.efrom, test.eto, test.conds, from, to)
+		}
+	}
+}
+
+func TestParseSQLGroupBy(t *testing.T) {
+	q, err := parseSQL(`SELECT avg(/cpu) FROM web GROUP BY /dc, time(1m), /host`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if exp := (fixedGrouper{int64(time.Minute), time.UTC}); q.grouper != exp {
+		t.Errorf("Expected grouper %v, got %v", exp, q.grouper)
+	}
+	exp := []string{"/dc", "/host"}
+	if !reflect.DeepEqual(q.groupBy, exp) {
+		t.Errorf("Expected group by %v, got %v", exp, q.groupBy)
+	}
+
+	for _, bad := range []string{
+		`SELECT avg(/cpu) FROM web GROUP BY /host`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(1m), time(1h)`,
+	} {
+		if _, err := parseSQL(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseSQLCalendarGroup(t *testing.T) {
+	q, err := parseSQL(`SELECT avg(/cpu) FROM web GROUP BY time(Month, "UTC")`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if exp := (calendarGrouper{"month", time.UTC}); q.grouper != exp {
+		t.Errorf("Expected grouper %v, got %v", exp, q.grouper)
+	}
+
+	for _, bad := range []string{
+		`SELECT avg(/cpu) FROM web GROUP BY time(month, "Nowhere/Special")`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(month, UTC)`,
+		`SELECT avg(/cpu) FROM web GROUP BY time(fortnight)`,
+	} {
+		if _, err := parseSQL(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseSQLWindows(t *testing.T) {
+	q, err := parseSQL(`SELECT max(/x), moving_avg(max(/x), 3),
+		HOLT_WINTERS(avg(/y), 0.5, 0.25), avg(/y), cumsum(max(/x))
+		FROM db GROUP BY time(1h)`)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if exp := []string{"/x", "/y"}; !reflect.DeepEqual(q.ptrs, exp) {
+		t.Errorf("Expected ptrs %v, got %v", exp, q.ptrs)
+	}
+	exp := []string{"moving_avg:3", "holt_winters:0.5,0.25", "cumsum"}
+	fields := []int{0, 1, 0}
+	if len(q.windows) != len(exp) {
+		t.Fatalf("Expected %v windows, got %v", len(exp), q.windows)
+	}
+	for i, w := range q.windows {
+		if w.spec != exp[i] || w.field != fields[i] {
+			t.Errorf("Expected %v on %v, got %v on %v",
+				exp[i], fields[i], w.spec, w.field)
+		}
+	}
+
+	for _, bad := range []string{
+		`SELECT moving_avg(max(/x)) FROM db GROUP BY time(1h)`,
+		`SELECT ewma(max(/x), "a") FROM db GROUP BY time(1h)`,
+		`SELECT cumsum(/x) FROM db GROUP BY time(1h)`,
+		`SELECT max(/x), cumsum(avg(/x)) FROM db GROUP BY time(1h)`,
+	} {
+		if _, err := parseSQL(bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseSQLTop(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp *ranking
+	}{
+		{"TOP 10 BY max(/lat)", &ranking{n: 10, combine: "avg"}},
+		{"BOTTOM 2 BY sum(avg(/cpu))",
+			&ranking{n: 2, bottom: true, column: 1, combine: "sum"}},
+		{"top 3 by last(histogram(/lat, \"1,2\"))",
+			&ranking{n: 3, column: 2, combine: "last"}},
+	}
+	for _, test := range tests {
+		q, err := parseSQL(`SELECT max(/lat), avg(/cpu),
+			histogram(/lat, "1,2") FROM db GROUP BY time(1h), /host ` +
+			test.in + ` ORDER BY time`)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(q.rank, test.exp) {
+			t.Errorf("Expected %+v for %q, got %+v", test.exp, test.in, q.rank)
+		}
+	}
+
+	for _, bad := range []string{
+		"TOP 0 BY max(/lat)",
+		"TOP 3 max(/lat)",
+		"TOP 3 BY min(/lat)",
+		"TOP 3 BY median(max(/lat))",
+	} {
+		if _, err := parseSQL(`SELECT max(/lat) FROM db GROUP BY time(1h) ` +
+			bad); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseSQLExplain(t *testing.T) {
+	for in, exp := range map[string]bool{
+		"SELECT max(/x) FROM db GROUP BY time(1h)":         false,
+		"EXPLAIN SELECT max(/x) FROM db GROUP BY time(1h)": true,
+		"explain select max(/x) from db group by time(1h)": true,
+	} {
+		q, err := parseSQL(in)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", in, err)
+			continue
+		}
+		if q.explain != exp {
+			t.Errorf("Expected explain=%v for %q", exp, in)
+		}
+	}
+}
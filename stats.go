@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// queryStats records the work done by a query.  Fields updated by
+// chunk workers are modified atomically.
+type queryStats struct {
+	docsMatched int64
+	cacheHits   int32
+	cacheMisses int32
+	// queued is how long the query waited for a query executor,
+	// and scanning how long it spent walking the database.
+	queued   time.Duration
+	scanning time.Duration
+	// chunkQueued and reducing are nanoseconds summed across all
+	// of the query's chunks: the time spent waiting for a document
+	// processor and processing documents respectively.
+	chunkQueued int64
+	reducing    int64
+}
+
+func (s *queryStats) chunkStarted(queued time.Time) time.Time {
+	now := time.Now()
+	atomic.AddInt64(&s.chunkQueued, int64(now.Sub(queued)))
+	return now
+}
+
+func (s *queryStats) chunkDone(started time.Time, matched int64) {
+	atomic.AddInt64(&s.reducing, int64(time.Since(started)))
+	atomic.AddInt64(&s.docsMatched, matched)
+}
+
+// queryExplanation is the response to a query with explain=true.
+// Times are in milliseconds.  The chunk times are summed over all
+// chunks, so they may exceed the total when chunks are processed
+// concurrently.
+type queryExplanation struct {
+	DocsScanned int32 `json:"docs_scanned"`
+	DocsMatched int64 `json:"docs_matched"`
+	Chunks      int32 `json:"chunks"`
+	Results     int   `json:"results"`
+	CacheHits   int32 `json:"cache_hits"`
+	CacheMisses int32 `json:"cache_misses"`
+	Timings     struct {
+		Total       float64 `json:"total"`
+		Queued      float64 `json:"queued"`
+		Scanning    float64 `json:"scanning"`
+		ChunkQueued float64 `json:"chunk_queued"`
+		Reducing    float64 `json:"reducing"`
+	} `json:"timings"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// explanation summarizes a completed query that produced the given
+// number of results.
+func (q *queryIn) explanation(results int) *queryExplanation {
+	s := &q.stats
+	rv := &queryExplanation{
+		DocsScanned: atomic.LoadInt32(&q.totalKeys),
+		DocsMatched: atomic.LoadInt64(&s.docsMatched),
+		Chunks:      atomic.LoadInt32(&q.started),
+		Results:     results,
+		CacheHits:   atomic.LoadInt32(&s.cacheHits),
+		CacheMisses: atomic.LoadInt32(&s.cacheMisses),
+	}
+	rv.Timings.Total = millis(time.Since(q.start))
+	rv.Timings.Queued = millis(s.queued)
+	rv.Timings.Scanning = millis(s.scanning)
+	rv.Timings.ChunkQueued = millis(time.Duration(atomic.LoadInt64(&s.chunkQueued)))
+	rv.Timings.Reducing = millis(time.Duration(atomic.LoadInt64(&s.reducing)))
+	return rv
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExplanation(t *testing.T) {
+	q := &queryIn{start: time.Now().Add(-time.Second), started: 3,
+		totalKeys: 40}
+	q.stats.queued = 5 * time.Millisecond
+	q.stats.scanning = 20 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		started := q.stats.chunkStarted(time.Now().Add(-time.Millisecond))
+		q.stats.chunkDone(started.Add(-2*time.Millisecond), 10)
+	}
+
+	e := q.explanation(2)
+	if e.DocsScanned != 40 || e.DocsMatched != 30 || e.Chunks != 3 ||
+		e.Results != 2 {
+		t.Errorf("Expected 40 scanned, 30 matched, 3 chunks, 2 results; got %+v", e)
+	}
+	if e.Timings.Queued != 5 || e.Timings.Scanning != 20 {
+		t.Errorf("Expected 5ms queued and 20ms scanning, got %+v", e.Timings)
+	}
+	if e.Timings.Total < 1000 || e.Timings.ChunkQueued < 3 ||
+		e.Timings.Reducing < 6 {
+		t.Errorf("Timings too short: %+v", e.Timings)
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/gojson"
+)
+
+// User defined reducers compute a number from aggregates of the
+// values they're given, e.g.
+//
+//	sum(/latency * /count) / sum(/count)
+//	sum(value < 300) / count(value)
+//
+// The aggregates are sum, count, min, max, avg, first and last.
+// Within an aggregate, value is the value being reduced and pointers
+// refer to fields within it when it's an object.  Comparisons are 1
+// when true and 0 when false, and abs, sqrt, ln, log10, exp, pow,
+// floor and ceil are available anywhere.  The language has no loops
+// or variables, so a reducer takes a bounded number of steps for each
+// value and constant memory however many values it sees.
+
+var errBuiltinReducer = errors.New("can't replace a built in reducer")
+
+var validReducerName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Limits on the size of a user defined reducer's expression.
+const (
+	maxUDRLength     = 4096
+	maxUDRNodes      = 256
+	maxUDRAggregates = 32
+)
+
+type udrFunc struct {
+	nargs int
+	f     func(args []float64) (float64, bool)
+}
+
+func udrMath(f func(float64) float64, valid func(float64) bool) udrFunc {
+	return udrFunc{1, func(args []float64) (float64, bool) {
+		return f(args[0]), valid == nil || valid(args[0])
+	}}
+}
+
+var udrFuncs = map[string]udrFunc{
+	"abs":   udrMath(math.Abs, nil),
+	"sqrt":  udrMath(math.Sqrt, func(x float64) bool { return x >= 0 }),
+	"ln":    udrMath(math.Log, func(x float64) bool { return x > 0 }),
+	"log10": udrMath(math.Log10, func(x float64) bool { return x > 0 }),
+	"exp":   udrMath(math.Exp, nil),
+	"floor": udrMath(math.Floor, nil),
+	"ceil":  udrMath(math.Ceil, nil),
+	"pow": {2, func(args []float64) (float64, bool) {
+		rv := math.Pow(args[0], args[1])
+		return rv, !(math.IsNaN(rv) || math.IsInf(rv, 0))
+	}},
+}
+
+var udrAggregates = map[string]bool{
+	"sum": true, "count": true, "min": true, "max": true, "avg": true,
+	"first": true, "last": true,
+}
+
+// valueExpr is the value being reduced.  It reads the "" pointer,
+// which refers to the whole value.
+type valueExpr struct{}
+
+func (valueExpr) eval(fetched map[string]interface{}) (float64, bool) {
+	return filterNumber(fetched[""])
+}
+
+func (valueExpr) pointers(ptrs []string) []string {
+	return append(ptrs, "")
+}
+
+func (valueExpr) String() string {
+	return "value"
+}
+
+type compareExpr struct {
+	op   string
+	l, r arithExpr
+}
+
+func (c compareExpr) eval(fetched map[string]interface{}) (float64, bool) {
+	l, lok := c.l.eval(fetched)
+	r, rok := c.r.eval(fetched)
+	if !(lok && rok) {
+		return 0, false
+	}
+	var rv bool
+	switch c.op {
+	case "=", "==":
+		rv = l == r
+	case "!=":
+		rv = l != r
+	case "<":
+		rv = l < r
+	case "<=":
+		rv = l <= r
+	case ">":
+		rv = l > r
+	case ">=":
+		rv = l >= r
+	default:
+		panic("unhandled comparison " + c.op)
+	}
+	if rv {
+		return 1, true
+	}
+	return 0, true
+}
+
+func (c compareExpr) pointers(ptrs []string) []string {
+	return c.r.pointers(c.l.pointers(ptrs))
+}
+
+func (c compareExpr) String() string {
+	return "(" + c.l.String() + " " + c.op + " " + c.r.String() + ")"
+}
+
+type callExpr struct {
+	name string
+	args []arithExpr
+}
+
+func (c callExpr) eval(fetched map[string]interface{}) (float64, bool) {
+	args := make([]float64, len(c.args))
+	for i, a := range c.args {
+		v, ok := a.eval(fetched)
+		if !ok {
+			return 0, false
+		}
+		args[i] = v
+	}
+	return udrFuncs[c.name].f(args)
+}
+
+func (c callExpr) pointers(ptrs []string) []string {
+	for _, a := range c.args {
+		ptrs = a.pointers(ptrs)
+	}
+	return ptrs
+}
+
+func (c callExpr) String() string {
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		args[i] = a.String()
+	}
+	return c.name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// aggregateExpr is an aggregate of an expression over every value.
+// Once the values have been aggregated, it reads its result from the
+// key "#i", where i is its position among the reducer's aggregates.
+type aggregateExpr struct {
+	name string
+	key  string
+	e    arithExpr
+	// steps is how many nodes e evaluates for each value.
+	steps int
+}
+
+func (a *aggregateExpr) eval(results map[string]interface{}) (float64, bool) {
+	f, ok := results[a.key].(float64)
+	return f, ok
+}
+
+func (a *aggregateExpr) pointers(ptrs []string) []string {
+	return ptrs
+}
+
+func (a *aggregateExpr) String() string {
+	return a.name + "(" + a.e.String() + ")"
+}
+
+// aggState accumulates the values of an aggregate.
+type aggState struct {
+	n                          int
+	sum, min, max, first, last float64
+}
+
+func (s *aggState) add(f float64) {
+	if s.n == 0 || f < s.min {
+		s.min = f
+	}
+	if s.n == 0 || f > s.max {
+		s.max = f
+	}
+	if s.n == 0 {
+		s.first = f
+	}
+	s.last = f
+	s.sum += f
+	s.n++
+}
+
+func (s *aggState) result(name string) (float64, bool) {
+	if name == "count" {
+		return float64(s.n), true
+	}
+	if s.n == 0 {
+		return 0, false
+	}
+	switch name {
+	case "sum":
+		return s.sum, true
+	case "min":
+		return s.min, true
+	case "max":
+		return s.max, true
+	case "avg":
+		return s.sum / float64(s.n), true
+	case "first":
+		return s.first, true
+	}
+	return s.last, true
+}
+
+// A userReducer is a reducer defined at runtime.
+type userReducer struct {
+	Description string `json:"description"`
+	Expr        string `json:"expr"`
+
+	top  arithExpr
+	aggs []*aggregateExpr
+	ptrs []string
+}
+
+// udrParser parses a user defined reducer expression, tracking its
+// aggregates and size.
+type udrParser struct {
+	s     *tokenStream
+	aggs  []*aggregateExpr
+	nodes int
+	// agg is the aggregate being parsed, if any.
+	agg *aggregateExpr
+}
+
+func (p *udrParser) node(e arithExpr) (arithExpr, error) {
+	p.nodes++
+	if p.nodes > maxUDRNodes {
+		return nil, fmt.Errorf("expression has more than %v terms",
+			maxUDRNodes)
+	}
+	if p.agg != nil {
+		p.agg.steps++
+	}
+	return e, nil
+}
+
+func (p *udrParser) compare() (arithExpr, error) {
+	l, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	t := p.s.peek()
+	switch {
+	case t.is("="), t.is("=="), t.is("!="), t.is("<"), t.is("<="),
+		t.is(">"), t.is(">="):
+		p.s.next()
+		r, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return p.node(compareExpr{t.val, l, r})
+	}
+	return l, nil
+}
+
+func (p *udrParser) sum() (arithExpr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.s.peek(); t.is("+") || t.is("-"); t = p.s.peek() {
+		p.s.next()
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		if l, err = p.node(binaryExpr{t.val, l, r}); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (p *udrParser) product() (arithExpr, error) {
+	l, err := p.negation()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.s.peek(); t.is("*") || t.is("/") || t.is("%"); t = p.s.peek() {
+		p.s.next()
+		r, err := p.negation()
+		if err != nil {
+			return nil, err
+		}
+		if l, err = p.node(binaryExpr{t.val, l, r}); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (p *udrParser) negation() (arithExpr, error) {
+	if p.s.accept("-") {
+		e, err := p.negation()
+		if err != nil {
+			return nil, err
+		}
+		return p.node(negExpr{e})
+	}
+	return p.operand()
+}
+
+func (p *udrParser) operand() (arithExpr, error) {
+	t := p.s.peek()
+	switch t.typ {
+	case tokNumber:
+		p.s.next()
+		f, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %v at %v", t.val, t.pos)
+		}
+		return p.node(numberExpr(f))
+	case tokPointer:
+		if p.agg == nil {
+			return nil, p.s.errorf("%v outside of an aggregate", t.val)
+		}
+		p.s.next()
+		return p.node(pointerExpr(t.val))
+	case tokIdent:
+		p.s.next()
+		if t.val == "value" {
+			if p.agg == nil {
+				return nil, fmt.Errorf("value outside of an aggregate at %v",
+					t.pos)
+			}
+			return p.node(valueExpr{})
+		}
+		return p.call(t)
+	}
+	if p.s.accept("(") {
+		e, err := p.compare()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.s.expect(")")
+	}
+	return nil, p.s.errorf("expected number, value, pointer, function or (")
+}
+
+func (p *udrParser) call(name token) (arithExpr, error) {
+	if err := p.s.expect("("); err != nil {
+		return nil, err
+	}
+
+	if udrAggregates[name.val] {
+		if p.agg != nil {
+			return nil, fmt.Errorf("%v at %v is within another aggregate",
+				name.val, name.pos)
+		}
+		if len(p.aggs) == maxUDRAggregates {
+			return nil, fmt.Errorf("more than %v aggregates",
+				maxUDRAggregates)
+		}
+		p.agg = &aggregateExpr{name: name.val,
+			key: "#" + strconv.Itoa(len(p.aggs))}
+		e, err := p.compare()
+		if err != nil {
+			return nil, err
+		}
+		a := p.agg
+		a.e, p.agg = e, nil
+		p.aggs = append(p.aggs, a)
+		if err := p.s.expect(")"); err != nil {
+			return nil, err
+		}
+		return p.node(a)
+	}
+
+	fn, ok := udrFuncs[name.val]
+	if !ok {
+		return nil, fmt.Errorf("no such function %v at %v", name.val, name.pos)
+	}
+	var args []arithExpr
+	for {
+		a, err := p.compare()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if !p.s.accept(",") {
+			break
+		}
+	}
+	if len(args) != fn.nargs {
+		return nil, fmt.Errorf("%v takes %v arguments, got %v",
+			name.val, fn.nargs, len(args))
+	}
+	if err := p.s.expect(")"); err != nil {
+		return nil, err
+	}
+	return p.node(callExpr{name.val, args})
+}
+
+// parseUserReducer compiles a user defined reducer's expression.
+func parseUserReducer(expr string) (*userReducer, error) {
+	if len(expr) > maxUDRLength {
+		return nil, fmt.Errorf("expression is longer than %v bytes",
+			maxUDRLength)
+	}
+	s, err := newTokenStream(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &udrParser{s: s}
+	top, err := p.compare()
+	if err != nil {
+		return nil, err
+	}
+	if s.peek().typ != tokEOF {
+		return nil, s.errorf("unexpected input")
+	}
+	if len(p.aggs) == 0 {
+		return nil, fmt.Errorf("expression has no aggregates")
+	}
+
+	u := &userReducer{Expr: expr, top: top, aggs: p.aggs}
+	seen := map[string]bool{}
+	for _, a := range p.aggs {
+		for _, ptr := range a.e.pointers(nil) {
+			if !seen[ptr] {
+				u.ptrs = append(u.ptrs, ptr)
+				seen[ptr] = true
+			}
+		}
+	}
+	return u, nil
+}
+
+// resolveValue finds the value a JSON pointer refers to within a
+// decoded JSON value.
+func resolveValue(val interface{}, ptr string) interface{} {
+	if ptr == "" {
+		return val
+	}
+	for _, part := range strings.Split(ptr[1:], "/") {
+		part = strings.Replace(part, "~1", "/", -1)
+		part = strings.Replace(part, "~0", "~", -1)
+		switch x := val.(type) {
+		case map[string]interface{}:
+			val = x[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil
+			}
+			val = x[i]
+		default:
+			return nil
+		}
+	}
+	return val
+}
+
+// reduce evaluates the reducer over a group of values.  It gives up,
+// returning null, after more than udrMaxSteps steps.
+func (u *userReducer) reduce(input chan ptrval) interface{} {
+	states := make([]aggState, len(u.aggs))
+	fetched := make(map[string]interface{}, len(u.ptrs))
+	steps, exceeded := 0, false
+	for v := range input {
+		if !v.included || v.val == nil || exceeded {
+			continue
+		}
+		for _, ptr := range u.ptrs {
+			fetched[ptr] = resolveValue(v.val, ptr)
+		}
+		for i, a := range u.aggs {
+			steps += a.steps
+			if f, ok := a.e.eval(fetched); ok {
+				states[i].add(f)
+			}
+		}
+		exceeded = steps > *udrMaxSteps
+	}
+	if exceeded {
+		log.Printf("Reducer %q exceeded %v steps", u.Expr, *udrMaxSteps)
+		return nil
+	}
+
+	results := make(map[string]interface{}, len(u.aggs))
+	for i, a := range u.aggs {
+		if f, ok := states[i].result(a.name); ok {
+			results[a.key] = f
+		}
+	}
+	if f, ok := u.top.eval(results); ok {
+		return f
+	}
+	return nil
+}
+
+// userReducers are the reducers defined at runtime, guarded by
+// reducerLock.
+var userReducers = map[string]*userReducer{}
+
+func userReducersPath() string {
+	return filepath.Join(*dbRoot, "_reducers.json")
+}
+
+// loadUserReducers defines the reducers saved by a previous run.
+func loadUserReducers() error {
+	data, err := ioutil.ReadFile(userReducersPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	saved := map[string]*userReducer{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	for name, u := range saved {
+		if err := defineUserReducer(name, u.Description, u.Expr,
+			false); err != nil {
+			return fmt.Errorf("reducer %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// saveUserReducers writes the user defined reducers so they survive
+// a restart.  reducerLock must be held.
+func saveUserReducers() error {
+	data, err := json.MarshalIndent(userReducers, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := userReducersPath()
+	if err := ioutil.WriteFile(path+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// defineUserReducer adds or replaces a user defined reducer.
+func defineUserReducer(name, desc, expr string, save bool) error {
+	if !validReducerName.MatchString(name) {
+		return paramError{"Bad reducer name", name}
+	}
+	u, err := parseUserReducer(expr)
+	if err != nil {
+		return paramError{"Bad reducer expression", err.Error()}
+	}
+	u.Description = desc
+
+	reducerLock.Lock()
+	defer reducerLock.Unlock()
+	if info, exists := reducerRegistry[name]; exists && info.Expr == "" {
+		return errBuiltinReducer
+	}
+	if desc == "" {
+		desc = expr
+	}
+	addReducer(&reducerInfo{
+		Name:        name,
+		Description: desc,
+		Input:       inputAny,
+		Expr:        expr,
+		reduce:      u.reduce,
+	})
+	userReducers[name] = u
+	if save {
+		return saveUserReducers()
+	}
+	return nil
+}
+
+// userReducerExpr returns the expression of a user defined reducer,
+// or "" if name isn't one.
+func userReducerExpr(name string) string {
+	reducerLock.RLock()
+	defer reducerLock.RUnlock()
+	if u, ok := userReducers[name]; ok {
+		return u.Expr
+	}
+	return ""
+}
+
+func putReducer(args []string, w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+	def := struct {
+		Description string `json:"description"`
+		Expr        string `json:"expr"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&def); err != nil {
+		emitError(400, w, "Error parsing JSON data", err.Error())
+		return
+	}
+
+	err := defineUserReducer(args[0], def.Description, def.Expr, true)
+	if err == errBuiltinReducer {
+		emitError(409, w, "Reducer exists", err.Error())
+	} else if err != nil {
+		emitQueryError(w, err)
+	} else {
+		mustEncode(201, w, map[string]interface{}{"ok": true})
+	}
+}
+
+func getReducer(args []string, w http.ResponseWriter, req *http.Request) {
+	reducerLock.RLock()
+	defer reducerLock.RUnlock()
+	info, ok := reducerRegistry[args[0]]
+	if !ok {
+		emitError(404, w, "No such reducer", args[0])
+		return
+	}
+	mustEncode(200, w, info)
+}
+
+func deleteReducer(args []string, w http.ResponseWriter, req *http.Request) {
+	reducerLock.Lock()
+	defer reducerLock.Unlock()
+	if _, ok := userReducers[args[0]]; !ok {
+		emitError(404, w, "No such user defined reducer", args[0])
+		return
+	}
+	delete(userReducers, args[0])
+	removeReducer(args[0])
+	if err := saveUserReducers(); err != nil {
+		emitError(500, w, "Error saving reducers", err.Error())
+		return
+	}
+	mustEncode(200, w, map[string]interface{}{"ok": true})
+}
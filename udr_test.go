@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUserReducer(t *testing.T) {
+	objects := []interface{}{
+		map[string]interface{}{"lat": 100.0, "n": 1.0},
+		map[string]interface{}{"lat": 400.0, "n": 3.0},
+		map[string]interface{}{"lat": "x", "n": 1.0},
+		map[string]interface{}{"other": []interface{}{2.0, 4.0}},
+	}
+	scalars := []interface{}{"31", "63", "foo", "17", "100"}
+
+	tests := []struct {
+		expr string
+		in   []interface{}
+		exp  interface{}
+	}{
+		{"sum(/lat * /n) / sum(/n)", objects, 260.0},
+		{"sum(value < 50) / count(value)", scalars, 0.5},
+		{"max(value) - min(value)", scalars, 83.0},
+		{"avg(value) * 2", scalars, 105.5},
+		{"first(value) + last(value)", scalars, 131.0},
+		{"count(/other/1)", objects, 1.0},
+		{"sqrt(sum(/other/1 * /other/1))", objects, 4.0},
+		{"pow(count(value), 2)", scalars, 16.0},
+		{"count(/missing)", objects, 0.0},
+		{"max(/missing)", objects, nil},
+		{"sum(value) / count(/missing)", scalars, nil},
+	}
+	for _, test := range tests {
+		u, err := parseUserReducer(test.expr)
+		if err != nil {
+			t.Errorf("Error parsing %q: %v", test.expr, err)
+			continue
+		}
+		got := u.reduce(streamCollection(test.in))
+		if got != test.exp {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.expr, got)
+		}
+	}
+}
+
+func TestUserReducerErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"value",
+		"/x + 1",
+		"sum(value) +",
+		"sum(max(value))",
+		"nosuch(value)",
+		"pow(sum(value))",
+		"sum(value) value",
+		"42",
+	} {
+		if _, err := parseUserReducer(expr); err == nil {
+			t.Errorf("Expected error parsing %q", expr)
+		}
+	}
+}
+
+func TestUserReducerStepLimit(t *testing.T) {
+	defer func(n int) { *udrMaxSteps = n }(*udrMaxSteps)
+	*udrMaxSteps = 3
+
+	u, err := parseUserReducer("sum(value)")
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	if got := u.reduce(streamCollection([]interface{}{"1", "2"})); got != 3.0 {
+		t.Errorf("Expected 3 within the limit, got %v", got)
+	}
+	if got := u.reduce(streamCollection([]interface{}{"1", "2", "3", "4"})); got != nil {
+		t.Errorf("Expected nil past the limit, got %v", got)
+	}
+}
+
+func TestDefineUserReducer(t *testing.T) {
+	defer func(root string) { *dbRoot = root }(*dbRoot)
+	dir, err := ioutil.TempDir("", "udr")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	*dbRoot = dir
+
+	if err := defineUserReducer("sum", "", "sum(value)", true); err != errBuiltinReducer {
+		t.Errorf("Expected to be refused replacing sum, got %v", err)
+	}
+	if err := defineUserReducer("bad:name", "", "sum(value)", true); err == nil {
+		t.Errorf("Expected error for a bad name")
+	}
+	if err := defineUserReducer("wavg", "weighted", "sum(/v * /w) / sum(/w)",
+		true); err != nil {
+		t.Fatalf("Error defining wavg: %v", err)
+	}
+
+	reducerLock.Lock()
+	delete(userReducers, "wavg")
+	removeReducer("wavg")
+	reducerLock.Unlock()
+	if _, err := findReducer("wavg"); err != errNoSuchReducer {
+		t.Fatalf("Expected wavg to be gone, got %v", err)
+	}
+
+	if err := loadUserReducers(); err != nil {
+		t.Fatalf("Error loading reducers: %v", err)
+	}
+	defer func() {
+		reducerLock.Lock()
+		delete(userReducers, "wavg")
+		removeReducer("wavg")
+		reducerLock.Unlock()
+	}()
+	if _, err := findReducer("wavg"); err != nil {
+		t.Errorf("Expected wavg to be reloaded, got %v", err)
+	}
+	if userReducerExpr("wavg") != "sum(/v * /w) / sum(/w)" {
+		t.Errorf("Expected wavg's expression, got %q", userReducerExpr("wavg"))
+	}
+}
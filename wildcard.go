@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A wildcard pointer such as /cpu/*/user has * segments matching
+// every key of an object (or index of an array).  Each document's
+// values are split into a series for each match, named after the
+// keys the wildcards matched.
+
+// isWildcard reports whether a pointer has a wildcard segment.
+func isWildcard(p string) bool {
+	return strings.Contains(p+"/", "/*/")
+}
+
+// splitWildcard returns the part of a wildcard pointer before its
+// first wildcard and the segments from there on.
+func splitWildcard(p string) (string, []string) {
+	i := strings.Index(p+"/", "/*/")
+	return p[:i], strings.Split(p[i+1:], "/")
+}
+
+// valuePointers lists the pointers the values of a query's fields
+// are found at.  exprs holds the parsed computed fields, if any.
+func valuePointers(ptrs []string, exprs []arithExpr) []string {
+	if exprs == nil {
+		return ptrs
+	}
+	var rv []string
+	for i, p := range ptrs {
+		if exprs[i] != nil {
+			rv = exprs[i].pointers(rv)
+		} else {
+			rv = append(rv, p)
+		}
+	}
+	return rv
+}
+
+// hasWildcards reports whether any of a query's values are found at
+// wildcard pointers, so they're split into a series per match.
+func hasWildcards(ptrs []string) bool {
+	exprs, _ := parsePointerExprs(ptrs)
+	for _, p := range valuePointers(ptrs, exprs) {
+		if isWildcard(p) {
+			return true
+		}
+	}
+	return false
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// expandWildcard finds the values below v matched by the segments of
+// a wildcard pointer.  They're added to rv keyed by the keys matched
+// by the wildcards, escaped as in a pointer and joined by /.
+func expandWildcard(v interface{}, segs []string, match string,
+	rv map[string]interface{}) {
+
+	if len(segs) == 0 {
+		rv[match] = v
+		return
+	}
+
+	if segs[0] != "*" {
+		seg := pointerUnescaper.Replace(segs[0])
+		switch x := v.(type) {
+		case map[string]interface{}:
+			if c, ok := x[seg]; ok {
+				expandWildcard(c, segs[1:], match, rv)
+			}
+		case []interface{}:
+			if i, err := strconv.Atoi(seg); err == nil && i >= 0 && i < len(x) {
+				expandWildcard(x[i], segs[1:], match, rv)
+			}
+		}
+		return
+	}
+
+	descend := func(k string, c interface{}) {
+		m := pointerEscaper.Replace(k)
+		if match != "" {
+			m = match + "/" + m
+		}
+		expandWildcard(c, segs[1:], m, rv)
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, c := range x {
+			descend(k, c)
+		}
+	case []interface{}:
+		for i, c := range x {
+			descend(strconv.Itoa(i), c)
+		}
+	}
+}
+
+// wildcardMatches splits the values fetched from a document for each
+// match of its wildcard pointers.  Each match's values are keyed by
+// pointer as fetched, with the wildcard pointers resolved for that
+// match.  The prefixes of the wildcard pointers must have been
+// fetched.
+func wildcardMatches(fetched map[string]interface{},
+	wild []string) (names []string, values []map[string]interface{}) {
+
+	found := make([]map[string]interface{}, len(wild))
+	seen := map[string]bool{}
+	for i, w := range wild {
+		prefix, segs := splitWildcard(w)
+		found[i] = map[string]interface{}{}
+		expandWildcard(fetched[prefix], segs, "", found[i])
+		for m := range found[i] {
+			if !seen[m] {
+				seen[m] = true
+				names = append(names, m)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	for _, m := range names {
+		vals := make(map[string]interface{}, len(fetched)+len(wild))
+		for k, v := range fetched {
+			vals[k] = v
+		}
+		for i, w := range wild {
+			vals[w] = found[i][m]
+		}
+		values = append(values, vals)
+	}
+	return names, values
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mschoch/gouchstore"
+)
+
+func TestWildcardPointers(t *testing.T) {
+	tests := []struct {
+		ptr    string
+		wild   bool
+		prefix string
+		segs   []string
+	}{
+		{"/cpu/*/user", true, "/cpu", []string{"*", "user"}},
+		{"/*", true, "", []string{"*"}},
+		{"/a/*/b/*", true, "/a", []string{"*", "b", "*"}},
+		{"/a*/b", false, "", nil},
+		{"/a/b", false, "", nil},
+	}
+	for _, test := range tests {
+		if got := isWildcard(test.ptr); got != test.wild {
+			t.Errorf("Expected wildcard %v for %v", test.wild, test.ptr)
+		}
+		if !test.wild {
+			continue
+		}
+		prefix, segs := splitWildcard(test.ptr)
+		if prefix != test.prefix || !reflect.DeepEqual(segs, test.segs) {
+			t.Errorf("Expected %q %v for %v, got %q %v", test.prefix,
+				test.segs, test.ptr, prefix, segs)
+		}
+	}
+
+	if !hasWildcards([]string{"/a", "expr:/b/*/c * 2"}) {
+		t.Errorf("Expected wildcards in an expression")
+	}
+	if hasWildcards([]string{"/a", "expr:/b * 2"}) {
+		t.Errorf("Expected no wildcards")
+	}
+}
+
+func TestExpandWildcard(t *testing.T) {
+	doc := []byte(`{
+		"cpu": {"cpu0": {"user": 1}, "cpu1": {"sys": 2}, "a/b": {"user": 3}},
+		"disks": [{"r": 4}, {"r": 5}]
+	}`)
+
+	tests := []struct {
+		ptr string
+		exp map[string]interface{}
+	}{
+		{"/cpu/*/user", map[string]interface{}{
+			"cpu0": 1.0, "a~1b": 3.0}},
+		{"/disks/*/r", map[string]interface{}{"0": 4.0, "1": 5.0}},
+		{"/*/cpu0/user", map[string]interface{}{"cpu": 1.0}},
+		{"/*/*/user", map[string]interface{}{
+			"cpu/cpu0": 1.0, "cpu/a~1b": 3.0}},
+		{"/disks/*/nope", map[string]interface{}{}},
+	}
+	for _, test := range tests {
+		prefix, segs := splitWildcard(test.ptr)
+		got := map[string]interface{}{}
+		expandWildcard(resolveFetch(doc, []string{prefix})[prefix], segs,
+			"", got)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.ptr, got)
+		}
+	}
+}
+
+func TestProcessDocWildcards(t *testing.T) {
+	di := gouchstore.NewDocumentInfo("2020-01-01T00:00:00Z")
+	doc := []byte(`{"h": "a",
+		"cpu": {"cpu0": {"user": 1, "sys": 2}, "cpu1": {"user": 3}}}`)
+	ptrs := []string{"/cpu/*/user", "/cpu/*/sys", "/h"}
+
+	tests := []struct {
+		groupBy []string
+		exp     map[string][]interface{}
+	}{
+		{nil, map[string][]interface{}{
+			"cpu0": {"1", "2", "a"},
+			"cpu1": {"3", nil, "a"},
+		}},
+		{[]string{"/h"}, map[string][]interface{}{
+			"a,cpu0": {"1", "2", "a"},
+			"a,cpu1": {"3", nil, "a"},
+		}},
+	}
+	for _, test := range tests {
+		chans := map[string][]chan ptrval{}
+		processDoc(di, func(g string, included bool) []chan ptrval {
+			chs := make([]chan ptrval, len(ptrs))
+			for i := range chs {
+				chs[i] = make(chan ptrval, 1)
+			}
+			chans[g] = chs
+			return chs
+		}, doc, ptrs, nil, test.groupBy, nil, true)
+
+		got := map[string][]interface{}{}
+		for g, chs := range chans {
+			for _, ch := range chs {
+				got[g] = append(got[g], (<-ch).val)
+			}
+		}
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v, got %v", test.exp, got)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A windowApply computes a window function's value for each group
+// given the values of a field in ascending group order.
+type windowApply func(vals []interface{}, keys []int64) []interface{}
+
+// A windowFunc computes a value for each group of a query from the
+// values of a field in that group and the ones before it.  Its
+// results are reported as an extra column after the query's fields.
+type windowFunc struct {
+	field int
+	// spec is the function as given in the query, e.g. moving_avg:5
+	spec  string
+	apply windowApply
+}
+
+// windowMakers build window functions from their arguments.
+var windowMakers = map[string]func(args string) (windowApply, error){
+	"moving_avg":   makeMovingAvg,
+	"ewma":         makeEWMA,
+	"cumsum":       noWindowArgs(cumsum),
+	"derivative":   noWindowArgs(derivative),
+	"holt_winters": makeHoltWinters,
+}
+
+// parseWindow parses a window function applied to one of a query's
+// fields: field:function[:args], e.g. 0:moving_avg:5
+func parseWindow(spec string, nfields int) (windowFunc, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return windowFunc{}, fmt.Errorf("expected field:function, got %q", spec)
+	}
+	field, err := strconv.Atoi(parts[0])
+	if err != nil || field < 0 || field >= nfields {
+		return windowFunc{}, fmt.Errorf("no field %q in %q", parts[0], spec)
+	}
+	name, args := parts[1], ""
+	if i := strings.Index(name, ":"); i >= 0 {
+		name, args = name[:i], name[i+1:]
+	}
+	mk, ok := windowMakers[name]
+	if !ok {
+		return windowFunc{}, fmt.Errorf("no such window function %q", name)
+	}
+	apply, err := mk(args)
+	if err != nil {
+		return windowFunc{}, fmt.Errorf("%v: %v", name, err)
+	}
+	return windowFunc{field, parts[1], apply}, nil
+}
+
+func parseWindows(specs []string, nfields int) ([]windowFunc, error) {
+	var rv []windowFunc
+	for _, s := range specs {
+		w, err := parseWindow(s, nfields)
+		if err != nil {
+			return nil, paramError{"Bad window value", err.Error()}
+		}
+		rv = append(rv, w)
+	}
+	return rv, nil
+}
+
+// applyWindows adds the window function columns to each series of a
+// set of results in ascending order.
+func applyWindows(results []*processOut, windows []windowFunc) {
+	keys := make([]int64, len(results))
+	names := map[string]bool{}
+	for i, po := range results {
+		keys[i] = po.key
+		for g := range po.groups {
+			names[g] = true
+		}
+	}
+
+	extend := func(row func(po *processOut) []interface{},
+		set func(po *processOut, vals []interface{})) {
+		cols := make([][]interface{}, len(windows))
+		for i, w := range windows {
+			vals := make([]interface{}, len(results))
+			for j, po := range results {
+				if r := row(po); w.field < len(r) {
+					vals[j] = r[w.field]
+				}
+			}
+			cols[i] = w.apply(vals, keys)
+		}
+		for j, po := range results {
+			r := row(po)
+			if r == nil {
+				continue
+			}
+			for i := range windows {
+				r = append(r, cols[i][j])
+			}
+			set(po, r)
+		}
+	}
+
+	if len(names) == 0 {
+		extend(func(po *processOut) []interface{} { return po.value },
+			func(po *processOut, vals []interface{}) { po.value = vals })
+		return
+	}
+	for g := range names {
+		extend(func(po *processOut) []interface{} { return po.groups[g] },
+			func(po *processOut, vals []interface{}) { po.groups[g] = vals })
+	}
+}
+
+func noWindowArgs(f windowApply) func(string) (windowApply, error) {
+	return func(args string) (windowApply, error) {
+		if args != "" {
+			return nil, fmt.Errorf("takes no arguments")
+		}
+		return f, nil
+	}
+}
+
+// makeMovingAvg averages the values in the last n groups.
+func makeMovingAvg(args string) (windowApply, error) {
+	n, err := strconv.Atoi(args)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("window size must be a positive integer")
+	}
+	return func(vals []interface{}, keys []int64) []interface{} {
+		rv := make([]interface{}, len(vals))
+		for i := range vals {
+			sum, count := 0.0, 0
+			for j := i; j >= 0 && j > i-n; j-- {
+				if f, ok := toFloat(vals[j]); ok {
+					sum += f
+					count++
+				}
+			}
+			if count > 0 {
+				rv[i] = sum / float64(count)
+			}
+		}
+		return rv
+	}, nil
+}
+
+// parseSmoothing reads a smoothing factor between 0 and 1.
+func parseSmoothing(s string) (float64, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f <= 0 || f > 1 {
+		return 0, fmt.Errorf("smoothing factor must be in (0, 1], not %q", s)
+	}
+	return f, nil
+}
+
+// makeEWMA computes an exponentially weighted moving average.
+func makeEWMA(args string) (windowApply, error) {
+	alpha, err := parseSmoothing(args)
+	if err != nil {
+		return nil, err
+	}
+	return func(vals []interface{}, keys []int64) []interface{} {
+		rv := make([]interface{}, len(vals))
+		var avg float64
+		started := false
+		for i, v := range vals {
+			f, ok := toFloat(v)
+			if !ok {
+				continue
+			}
+			if started {
+				avg = alpha*f + (1-alpha)*avg
+			} else {
+				avg, started = f, true
+			}
+			rv[i] = avg
+		}
+		return rv
+	}, nil
+}
+
+// cumsum is the running total of the values.
+func cumsum(vals []interface{}, keys []int64) []interface{} {
+	rv := make([]interface{}, len(vals))
+	sum := 0.0
+	for i, v := range vals {
+		if f, ok := toFloat(v); ok {
+			sum += f
+			rv[i] = sum
+		}
+	}
+	return rv
+}
+
+// derivative is the per second change from the previous value.
+func derivative(vals []interface{}, keys []int64) []interface{} {
+	rv := make([]interface{}, len(vals))
+	prev := -1
+	var pf float64
+	for i, v := range vals {
+		f, ok := toFloat(v)
+		if !ok {
+			continue
+		}
+		if prev >= 0 {
+			rv[i] = (f - pf) / (float64(keys[i]-keys[prev]) / 1e9)
+		}
+		prev, pf = i, f
+	}
+	return rv
+}
+
+// makeHoltWinters smooths values with Holt-Winters exponential
+// smoothing.  The arguments are the level and trend smoothing
+// factors, optionally followed by the seasonal smoothing factor and
+// the number of groups in a season: alpha,beta[,gamma,period]
+func makeHoltWinters(args string) (windowApply, error) {
+	parts := strings.Split(args, ",")
+	if len(parts) != 2 && len(parts) != 4 {
+		return nil, fmt.Errorf("expected alpha,beta[,gamma,period]")
+	}
+	nfactors := 2
+	if len(parts) == 4 {
+		nfactors = 3
+	}
+	var factors [3]float64
+	for i, p := range parts[:nfactors] {
+		f, err := parseSmoothing(p)
+		if err != nil {
+			return nil, err
+		}
+		factors[i] = f
+	}
+	alpha, beta, gamma := factors[0], factors[1], factors[2]
+	period := 0
+	if len(parts) == 4 {
+		var err error
+		period, err = strconv.Atoi(parts[3])
+		if err != nil || period < 2 {
+			return nil, fmt.Errorf("season period must be at least 2")
+		}
+	}
+
+	return func(vals []interface{}, keys []int64) []interface{} {
+		rv := make([]interface{}, len(vals))
+		seasons := make([]float64, period)
+		var level, trend float64
+		n := 0
+		for i, v := range vals {
+			x, ok := toFloat(v)
+			if !ok {
+				continue
+			}
+			if n == 0 {
+				level = x
+				rv[i] = x
+				n++
+				continue
+			}
+			s := 0.0
+			if period > 0 {
+				s = seasons[n%period]
+			}
+			prevLevel := level
+			level = alpha*(x-s) + (1-alpha)*(level+trend)
+			trend = beta*(level-prevLevel) + (1-beta)*trend
+			if period > 0 {
+				s = gamma*(x-level) + (1-gamma)*s
+				seasons[n%period] = s
+			}
+			rv[i] = level + s
+			n++
+		}
+		return rv
+	}, nil
+}
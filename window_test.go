@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWindowFunctions(t *testing.T) {
+	vals := []interface{}{1.0, 3.0, nil, 7.0, 9}
+	keys := []int64{0, 1e9, 2e9, 3e9, 4e9}
+
+	tests := []struct {
+		spec string
+		exp  []interface{}
+	}{
+		{"0:moving_avg:2", []interface{}{1.0, 2.0, 3.0, 7.0, 8.0}},
+		{"0:moving_avg:1", []interface{}{1.0, 3.0, nil, 7.0, 9.0}},
+		{"0:ewma:0.5", []interface{}{1.0, 2.0, nil, 4.5, 6.75}},
+		{"0:cumsum", []interface{}{1.0, 4.0, nil, 11.0, 20.0}},
+		{"0:derivative", []interface{}{nil, 2.0, nil, 2.0, 2.0}},
+		{"0:holt_winters:1,1", []interface{}{1.0, 3.0, nil, 7.0, 9.0}},
+	}
+
+	for _, test := range tests {
+		w, err := parseWindow(test.spec, 1)
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", test.spec, err)
+		}
+		got := w.apply(vals, keys)
+		if !reflect.DeepEqual(got, test.exp) {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.spec, got)
+		}
+	}
+}
+
+func TestHoltWintersTrend(t *testing.T) {
+	w, err := parseWindow("0:holt_winters:0.5,0.5,0.5,2", 1)
+	if err != nil {
+		t.Fatalf("Error parsing: %v", err)
+	}
+	vals := make([]interface{}, 40)
+	keys := make([]int64, 40)
+	for i := range vals {
+		vals[i] = float64(2*i + 10*(i%2))
+		keys[i] = int64(i)
+	}
+	got := w.apply(vals, keys)
+	// Once the trend and season are learned, the smoothed values
+	// should track the input closely.
+	last := got[len(got)-1].(float64)
+	if exp := vals[len(vals)-1].(float64); math.Abs(last-exp) > 1 {
+		t.Errorf("Expected about %v at the end, got %v", exp, last)
+	}
+}
+
+func TestParseWindowErrors(t *testing.T) {
+	tests := []string{
+		"cumsum",
+		"1:cumsum",
+		"-1:cumsum",
+		"0:nosuch",
+		"0:cumsum:1",
+		"0:moving_avg",
+		"0:moving_avg:0",
+		"0:ewma:0",
+		"0:ewma:1.5",
+		"0:holt_winters:0.5",
+		"0:holt_winters:0.5,0.5,0.5",
+		"0:holt_winters:0.5,0.5,0.5,1",
+	}
+	for _, test := range tests {
+		if w, err := parseWindow(test, 1); err == nil {
+			t.Errorf("Expected error parsing %v, got %v", test, w.spec)
+		}
+	}
+}
+
+func TestApplyWindowsGrouped(t *testing.T) {
+	results := []*processOut{
+		{key: 1, groups: map[string][]interface{}{"a": {1.0}, "b": {5.0}}},
+		{key: 2, groups: map[string][]interface{}{"a": {2.0}}},
+		{key: 3, groups: map[string][]interface{}{"a": {3.0}, "b": {6.0}}},
+	}
+	w, _ := parseWindow("0:cumsum", 1)
+	applyWindows(results, []windowFunc{w})
+
+	exp := []map[string][]interface{}{
+		{"a": {1.0, 1.0}, "b": {5.0, 5.0}},
+		{"a": {2.0, 3.0}},
+		{"a": {3.0, 6.0}, "b": {6.0, 11.0}},
+	}
+	for i, po := range results {
+		if !reflect.DeepEqual(po.groups, exp[i]) {
+			t.Errorf("Expected %v at %v, got %v", exp[i], i, po.groups)
+		}
+	}
+}